@@ -0,0 +1,283 @@
+// Package config loads the server configuration file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"research/flow"
+	"research/health"
+	"research/httpapi"
+	"research/mcphost"
+	"research/telemetry"
+)
+
+// DefaultPath is used when RESEARCH_CONFIG is not set
+const DefaultPath = "research.yaml"
+
+// DefaultRunDir is where runs are stored when the config names no directory
+const DefaultRunDir = "runs"
+
+// DefaultModel is used when the config names no default model
+const DefaultModel = "googleai/gemini-2.5-flash-lite"
+
+// Local model providers
+const (
+	LocalProviderOllama = "ollama"
+	LocalProviderOpenAI = "openai"
+)
+
+type Config struct {
+	// Server configures the HTTP server that serves the flows
+	Server ServerConfig `yaml:"server"`
+	// PromptDir holds the .prompt files; RESEARCH_PROMPT_DIR overrides it
+	PromptDir string `yaml:"promptDir"`
+	// ReportTypeDir holds the report type skeletons; unset uses report_types in PromptDir
+	ReportTypeDir string `yaml:"reportTypeDir"`
+	// MCPServers lists the MCP servers whose tools the flows use; unset uses the servers in mcp/local_mcp.go
+	MCPServers []MCPServerConfig `yaml:"mcpServers"`
+	// MCPSupervision governs how dead MCP servers are detected and restarted
+	MCPSupervision mcphost.SupervisionConfig `yaml:"mcpSupervision"`
+	// Tools limits the MCP tools each flow and research phase may use
+	Tools flow.ToolPolicy `yaml:"tools"`
+	// Chat configures how the ask-me server reaches the user
+	Chat ChatConfig `yaml:"chat"`
+	// Features switches optional endpoints on or off
+	Features Features `yaml:"features"`
+	// Models configures the model and generation settings per research phase
+	Models flow.ModelConfig `yaml:"models"`
+	// LocalModel registers a locally hosted model server alongside Gemini
+	LocalModel *LocalModelConfig `yaml:"localModel"`
+	// Search backs research on models without built-in search
+	Search SearchConfig `yaml:"search"`
+	// Retry governs retries of failed model calls; unset fields keep flow.DefaultRetryPolicy
+	Retry flow.RetryPolicy `yaml:"retry"`
+	// ClarifyingQuestions caps the questions asked about a vague topic; 0 uses flow.DefaultClarifyingQuestions
+	ClarifyingQuestions int `yaml:"clarifyingQuestions"`
+	// ResearchEffort sets search depth and output budget per chapter importance; unset fields keep flow.DefaultResearchEffort
+	ResearchEffort flow.ResearchEffortConfig `yaml:"researchEffort"`
+	// Synthesis decides when reports are drafted chapter by chapter; unset fields keep flow.DefaultSynthesisConfig
+	Synthesis flow.SynthesisConfig `yaml:"synthesis"`
+	// Prices estimate the cost of model calls per million tokens; entries add to or override flow.DefaultPrices
+	Prices flow.PriceTable `yaml:"prices"`
+	// Budget caps the tokens, model calls and time of each deep research run
+	Budget flow.RunBudget `yaml:"budget"`
+	// Cache stores model and search responses on disk for repeated runs
+	Cache flow.CacheConfig `yaml:"cache"`
+	// RateLimits caps requests and tokens per minute per model across all flows
+	RateLimits flow.RateLimitConfig `yaml:"rateLimits"`
+	// RunDir stores deep research runs, so paused runs survive a restart
+	RunDir string `yaml:"runDir"`
+	// Telemetry configures trace export; metrics are always served on /metrics
+	Telemetry telemetry.Config `yaml:"telemetry"`
+	// Health governs the checks behind /readyz
+	Health health.Config `yaml:"health"`
+	// Auth lists the API keys allowed to invoke flows; without keys the flows are open
+	Auth httpapi.AuthConfig `yaml:"auth"`
+}
+
+// LocalModelConfig points at an Ollama or OpenAI-compatible server. Its models
+// are addressed as "ollama/<name>" or "local/<name>" respectively.
+type LocalModelConfig struct {
+	Provider string `yaml:"provider"`
+	BaseURL  string `yaml:"baseURL"`
+	// APIKey is only sent to OpenAI-compatible servers; LOCAL_MODEL_API_KEY overrides it
+	APIKey string   `yaml:"apiKey"`
+	Models []string `yaml:"models"`
+}
+
+type SearchConfig struct {
+	// Provider is "searxng" or empty for none
+	Provider string `yaml:"provider"`
+	BaseURL  string `yaml:"baseURL"`
+}
+
+// Path returns the config file path from RESEARCH_CONFIG, or DefaultPath
+func Path() string {
+	if path := os.Getenv("RESEARCH_CONFIG"); path != "" {
+		return path
+	}
+	return DefaultPath
+}
+
+// envOverrides are the environment variables that take precedence over the
+// config file, so that deployments can adjust a shared file
+var envOverrides = []struct {
+	name  string
+	apply func(c *Config, value string)
+}{
+	{"RESEARCH_ADDR", func(c *Config, v string) { c.Server.Addr = v }},
+	{"RESEARCH_PROMPT_DIR", func(c *Config, v string) { c.PromptDir = v }},
+	{"RESEARCH_DEFAULT_MODEL", func(c *Config, v string) {
+		if c.Models == nil {
+			c.Models = flow.ModelConfig{}
+		}
+		m := c.Models[flow.PhaseDefault]
+		m.Model = v
+		c.Models[flow.PhaseDefault] = m
+	}},
+	{"RESEARCH_RUN_DIR", func(c *Config, v string) { c.RunDir = v }},
+	{"RESEARCH_CACHE_DIR", func(c *Config, v string) { c.Cache.Dir = v }},
+	{"SLACK_CHANNEL", func(c *Config, v string) { c.Chat.Channel = v }},
+	{"SLACK_OAUTH_TOKEN", func(c *Config, v string) { c.Chat.Token = v }},
+	{"LOCAL_MODEL_API_KEY", func(c *Config, v string) {
+		if c.LocalModel != nil {
+			c.LocalModel.APIKey = v
+		}
+	}},
+}
+
+// Load reads the config file, applies the environment overrides and
+// validates the result. A missing file yields the defaults.
+func Load(path string) (*Config, error) {
+	cfg := &Config{
+		Server: ServerConfig{
+			Addr:              DefaultAddr,
+			ReadHeaderTimeout: DefaultReadHeaderTimeout,
+			IdleTimeout:       DefaultIdleTimeout,
+			ShutdownTimeout:   DefaultShutdownTimeout,
+		},
+		PromptDir: DefaultPromptDir,
+		Features:  Features{Metrics: true, ExampleFlows: true},
+		Health:    health.Config{ProbeModels: true},
+		Retry:     flow.DefaultRetryPolicy,
+		Synthesis: flow.DefaultSynthesisConfig,
+		Prices:    maps.Clone(flow.DefaultPrices),
+		RunDir:    DefaultRunDir,
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	default:
+		// Unknown keys are errors, so that a misspelled setting is not
+		// silently left at its default
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+
+	for _, o := range envOverrides {
+		if v := os.Getenv(o.name); v != "" {
+			o.apply(cfg, v)
+		}
+	}
+	if cfg.ReportTypeDir == "" {
+		cfg.ReportTypeDir = filepath.Join(cfg.PromptDir, "report_types")
+	}
+	for i, k := range cfg.Auth.Keys {
+		if k.KeyEnv != "" {
+			cfg.Auth.Keys[i].Key = os.Getenv(k.KeyEnv)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if err := c.Server.validate(); err != nil {
+		return err
+	}
+	if c.PromptDir == "" {
+		return fmt.Errorf("promptDir must not be empty")
+	}
+	names := map[string]bool{}
+	for i, s := range c.MCPServers {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("mcpServers[%d] %w", i, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("mcpServers: %s is listed twice", s.Name)
+		}
+		names[s.Name] = true
+	}
+	if err := c.MCPSupervision.Validate(); err != nil {
+		return err
+	}
+	if err := c.Tools.Validate(); err != nil {
+		return err
+	}
+	if err := c.Chat.validate(); err != nil {
+		return err
+	}
+	if err := c.Models.Validate(); err != nil {
+		return err
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return err
+	}
+	if c.ClarifyingQuestions < 0 {
+		return fmt.Errorf("clarifyingQuestions must not be negative, got %d", c.ClarifyingQuestions)
+	}
+	if err := c.ResearchEffort.Validate(); err != nil {
+		return err
+	}
+	if err := c.Synthesis.Validate(); err != nil {
+		return err
+	}
+	if err := c.Prices.Validate(); err != nil {
+		return err
+	}
+	if err := c.Budget.Validate(); err != nil {
+		return err
+	}
+	if err := c.Cache.Validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimits.Validate(); err != nil {
+		return err
+	}
+	if err := c.Health.Validate(); err != nil {
+		return err
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return err
+	}
+
+	if l := c.LocalModel; l != nil {
+		if l.Provider != LocalProviderOllama && l.Provider != LocalProviderOpenAI {
+			return fmt.Errorf("localModel.provider must be %q or %q, got %q", LocalProviderOllama, LocalProviderOpenAI, l.Provider)
+		}
+		if l.BaseURL == "" {
+			return fmt.Errorf("localModel.baseURL is required")
+		}
+		if len(l.Models) == 0 {
+			return fmt.Errorf("localModel.models must list at least one model")
+		}
+	}
+
+	switch c.Search.Provider {
+	case "":
+	case "searxng":
+		if c.Search.BaseURL == "" {
+			return fmt.Errorf("search.baseURL is required for provider %q", c.Search.Provider)
+		}
+	default:
+		return fmt.Errorf("unknown search.provider %q", c.Search.Provider)
+	}
+
+	return nil
+}
+
+// DefaultModelName is the model used by flows and phases without an explicit model
+func (c *Config) DefaultModelName() string {
+	if m := c.Models.For(flow.PhaseDefault).Model; m != "" {
+		return m
+	}
+	return DefaultModel
+}
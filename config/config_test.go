@@ -0,0 +1,146 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"research/flow"
+)
+
+func TestLoadMissingFileUsesDefaults(t *testing.T) {
+	cfg, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DefaultModelName() != DefaultModel {
+		t.Errorf("default model = %q", cfg.DefaultModelName())
+	}
+	if want := filepath.Join(DefaultPromptDir, "report_types"); cfg.ReportTypeDir != want {
+		t.Errorf("report type dir = %q, want %q", cfg.ReportTypeDir, want)
+	}
+}
+
+func TestLoadRejectsUnknownPhase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "research.yaml")
+	if err := os.WriteFile(path, []byte("models:\n  synthesys:\n    model: googleai/gemini-2.5-pro\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for an unknown phase")
+	}
+}
+
+func TestLoadRejectsUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "research.yaml")
+	if err := os.WriteFile(path, []byte("budget:\n  maxModelCals: 10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "maxModelCals") {
+		t.Errorf("err = %v, want an error naming the misspelled key", err)
+	}
+}
+
+func TestLoadEmptyFileUsesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "research.yaml")
+	if err := os.WriteFile(path, []byte("# everything commented out\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err != nil {
+		t.Errorf("empty config: %v", err)
+	}
+}
+
+func TestLoadRetryKeepsDefaultsForUnsetFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "research.yaml")
+	if err := os.WriteFile(path, []byte("retry:\n  maxAttempts: 2\n  initialBackoff: 500ms\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retry.MaxAttempts != 2 || cfg.Retry.InitialBackoff != 500*time.Millisecond {
+		t.Errorf("retry = %+v", cfg.Retry)
+	}
+	if cfg.Retry.MaxBackoff != flow.DefaultRetryPolicy.MaxBackoff {
+		t.Errorf("maxBackoff = %v, want default", cfg.Retry.MaxBackoff)
+	}
+}
+
+func TestLoadRepoConfig(t *testing.T) {
+	cfg, err := Load(filepath.Join("..", DefaultPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DefaultModelName() == "" {
+		t.Error("repo config has no default model")
+	}
+}
+
+func TestLoadAppliesEnvOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "research.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  addr: 127.0.0.1:3400\nchat:\n  provider: slack\n  channel: research\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RESEARCH_ADDR", "0.0.0.0:8080")
+	t.Setenv("RESEARCH_DEFAULT_MODEL", "googleai/gemini-2.5-pro")
+	t.Setenv("SLACK_OAUTH_TOKEN", "xoxb-test")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != "0.0.0.0:8080" || cfg.DefaultModelName() != "googleai/gemini-2.5-pro" || cfg.Chat.Token != "xoxb-test" {
+		t.Errorf("addr = %q, model = %q, token = %q; want the environment's values", cfg.Server.Addr, cfg.DefaultModelName(), cfg.Chat.Token)
+	}
+	if cfg.Server.IdleTimeout != DefaultIdleTimeout || !cfg.Features.Metrics {
+		t.Errorf("server = %+v, features = %+v; want the defaults for unset fields", cfg.Server, cfg.Features)
+	}
+
+	var askMe []string
+	for _, c := range cfg.MCPClients() {
+		if c.Name == "ask-me" {
+			askMe = c.Stdio.Env
+		}
+	}
+	if !slices.Contains(askMe, "SLACK_OAUTH_TOKEN=xoxb-test") || !slices.Contains(askMe, "SLACK_CHANNEL=research") {
+		t.Errorf("ask-me env = %q, want the chat settings", askMe)
+	}
+}
+
+func TestLoadMCPServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "research.yaml")
+	yaml := "mcpServers:\n  - name: docs\n    url: https://mcp.example.com/mcp\n    transport: sse\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := cfg.MCPClients()
+	if len(clients) != 1 || clients[0].SSE == nil || clients[0].SSE.BaseURL != "https://mcp.example.com/mcp" {
+		t.Errorf("clients = %+v, want the docs server over SSE", clients)
+	}
+
+	for _, bad := range []string{
+		"mcpServers:\n  - name: docs\n",
+		"mcpServers:\n  - name: docs\n    command: docs-mcp\n    url: https://mcp.example.com/mcp\n",
+		"mcpServers:\n  - name: docs\n    url: https://mcp.example.com/mcp\n    transport: websocket\n",
+		"mcpServers:\n  - name: docs\n    command: docs-mcp\n  - name: docs\n    command: docs-mcp\n",
+		"server:\n  addr: localhost\n",
+		"chat:\n  provider: teams\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("expected an error for\n%s", bad)
+		}
+	}
+}
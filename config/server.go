@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/firebase/genkit/go/plugins/mcp"
+
+	mcpconfig "research/mcp"
+)
+
+// Server defaults
+const (
+	DefaultAddr              = "127.0.0.1:3400"
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultShutdownTimeout   = 30 * time.Second
+	DefaultPromptDir         = "prompts"
+)
+
+// MCP transports of remote servers
+const (
+	MCPTransportHTTP = "http"
+	MCPTransportSSE  = "sse"
+)
+
+// ChatProviderSlack is the chat provider of the ask-me server
+const ChatProviderSlack = "slack"
+
+// ServerConfig configures the HTTP server that serves the flows
+type ServerConfig struct {
+	// Addr is the listen address; RESEARCH_ADDR overrides it
+	Addr              string        `yaml:"addr"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	// ReadTimeout and WriteTimeout cap a whole request; zero leaves them open,
+	// since a deep research run can take many minutes
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+	// ShutdownTimeout is how long running requests may finish after SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+func (s ServerConfig) validate() error {
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		return fmt.Errorf("server.addr %q: %w", s.Addr, err)
+	}
+	for name, d := range map[string]time.Duration{
+		"readHeaderTimeout": s.ReadHeaderTimeout,
+		"readTimeout":       s.ReadTimeout,
+		"writeTimeout":      s.WriteTimeout,
+		"idleTimeout":       s.IdleTimeout,
+		"shutdownTimeout":   s.ShutdownTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("server.%s must not be negative, got %s", name, d)
+		}
+	}
+	return nil
+}
+
+// MCPServerConfig is an MCP server whose tools the flows may use. A server
+// is either started as a subprocess (command) or reached over the network (url).
+type MCPServerConfig struct {
+	Name string `yaml:"name"`
+	// Command, Args and Env start a stdio server; Env adds to the server's inherited environment
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+	// URL is the endpoint of a remote server
+	URL string `yaml:"url"`
+	// Transport of a remote server is "http" (streamable HTTP, the default) or "sse"
+	Transport string            `yaml:"transport"`
+	Headers   map[string]string `yaml:"headers"`
+	// Timeout caps each request to a streamable HTTP server
+	Timeout  time.Duration `yaml:"timeout"`
+	Disabled bool          `yaml:"disabled"`
+}
+
+func (s MCPServerConfig) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("has no name")
+	}
+	switch {
+	case s.Command == "" && s.URL == "":
+		return fmt.Errorf("%s: needs a command or a url", s.Name)
+	case s.Command != "" && s.URL != "":
+		return fmt.Errorf("%s: has both a command and a url", s.Name)
+	case s.URL != "":
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("%s: url must be an http or https URL, got %q", s.Name, s.URL)
+		}
+		if s.Transport != "" && s.Transport != MCPTransportHTTP && s.Transport != MCPTransportSSE {
+			return fmt.Errorf("%s: transport must be %q or %q, got %q", s.Name, MCPTransportHTTP, MCPTransportSSE, s.Transport)
+		}
+	default:
+		if s.Transport != "" || len(s.Headers) > 0 {
+			return fmt.Errorf("%s: transport and headers only apply to servers with a url", s.Name)
+		}
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("%s: timeout must not be negative, got %s", s.Name, s.Timeout)
+	}
+	return nil
+}
+
+// clientOptions converts s for the Genkit MCP host
+func (s MCPServerConfig) clientOptions() mcp.MCPClientOptions {
+	opts := mcp.MCPClientOptions{Name: s.Name, Disabled: s.Disabled}
+	switch {
+	case s.Command != "":
+		opts.Stdio = &mcp.StdioConfig{Command: s.Command, Args: s.Args}
+		for _, k := range slices.Sorted(maps.Keys(s.Env)) {
+			opts.Stdio.Env = append(opts.Stdio.Env, k+"="+s.Env[k])
+		}
+	case s.Transport == MCPTransportSSE:
+		opts.SSE = &mcp.SSEConfig{BaseURL: s.URL, Headers: s.Headers}
+	default:
+		opts.StreamableHTTP = &mcp.StreamableHTTPConfig{BaseURL: s.URL, Headers: s.Headers, Timeout: s.Timeout}
+	}
+	return opts
+}
+
+// ChatConfig configures how the ask-me server reaches the user
+type ChatConfig struct {
+	// Provider is "slack", or empty to leave the ask-me server's environment as it is
+	Provider string `yaml:"provider"`
+	// Channel is the Slack channel name; SLACK_CHANNEL overrides it
+	Channel string `yaml:"channel"`
+	// Token is the Slack OAuth token; SLACK_OAUTH_TOKEN overrides it
+	Token string `yaml:"token"`
+	// ReplyTimeout is how long a question waits for the user; zero keeps the provider's default
+	ReplyTimeout time.Duration `yaml:"replyTimeout"`
+}
+
+func (c ChatConfig) validate() error {
+	if c.ReplyTimeout < 0 {
+		return fmt.Errorf("chat.replyTimeout must not be negative, got %s", c.ReplyTimeout)
+	}
+	switch c.Provider {
+	case "":
+		return nil
+	case ChatProviderSlack:
+		if c.Channel == "" {
+			return fmt.Errorf("chat.channel is required for provider %q", c.Provider)
+		}
+		if c.Token == "" {
+			return fmt.Errorf("chat.token or SLACK_OAUTH_TOKEN is required for provider %q", c.Provider)
+		}
+	default:
+		return fmt.Errorf("unknown chat.provider %q", c.Provider)
+	}
+	return nil
+}
+
+// env is passed to the ask-me server
+func (c ChatConfig) env() []string {
+	if c.Provider == "" {
+		return nil
+	}
+	env := []string{"SLACK_OAUTH_TOKEN=" + c.Token, "SLACK_CHANNEL=" + c.Channel}
+	if c.ReplyTimeout > 0 {
+		env = append(env, "ASK_ME_REPLY_TIMEOUT="+c.ReplyTimeout.String())
+	}
+	return env
+}
+
+// Features switches optional parts of the server on or off
+type Features struct {
+	// Metrics serves Prometheus metrics on GET /metrics
+	Metrics bool `yaml:"metrics"`
+	// ExampleFlows serves recipeGeneratorFlow and simpleFlow
+	ExampleFlows bool `yaml:"exampleFlows"`
+}
+
+// MCPClients returns the MCP servers to connect to: those of the config, or
+// the servers registered in mcp/local_mcp.go when the config lists none. The
+// ask-me server gets the chat settings in its environment.
+func (c *Config) MCPClients() []mcp.MCPClientOptions {
+	var clients []mcp.MCPClientOptions
+	if c.MCPServers == nil {
+		clients = slices.Clone(mcpconfig.Servers)
+	} else {
+		for _, s := range c.MCPServers {
+			clients = append(clients, s.clientOptions())
+		}
+	}
+
+	for i, client := range clients {
+		if client.Name == mcpconfig.ServerAskMe && client.Stdio != nil {
+			stdio := *client.Stdio
+			stdio.Env = append(slices.Clone(stdio.Env), c.Chat.env()...)
+			clients[i].Stdio = &stdio
+		}
+	}
+	return clients
+}
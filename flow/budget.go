@@ -0,0 +1,132 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// ErrBudgetExceeded is returned for model calls made after the run's budget ran out
+var ErrBudgetExceeded = errors.New("run budget exceeded")
+
+// RunBudget caps what a deep research run may spend. Zero fields are unlimited.
+type RunBudget struct {
+	// MaxTokens caps the input and output tokens of all model calls together
+	MaxTokens     int `yaml:"maxTokens"`
+	MaxModelCalls int `yaml:"maxModelCalls"`
+	// MaxDuration caps the time spent working on the run; time paused for a reply does not count
+	MaxDuration time.Duration `yaml:"maxDuration"`
+	// FinalAllowance is the share of each limit that writing and delivering
+	// the first report may go past it, so that a stopped run still ends with a
+	// report. Unset uses DefaultFinalAllowance; 0 holds them to the limits.
+	FinalAllowance *float64 `yaml:"finalAllowance"`
+}
+
+// DefaultFinalAllowance lets the report be written with up to half of each limit on top
+const DefaultFinalAllowance = 0.5
+
+// Validate rejects negative limits
+func (b RunBudget) Validate() error {
+	if b.MaxTokens < 0 || b.MaxModelCalls < 0 || b.MaxDuration < 0 {
+		return fmt.Errorf("budget limits must not be negative")
+	}
+	if b.FinalAllowance != nil && *b.FinalAllowance < 0 {
+		return fmt.Errorf("budget.finalAllowance must not be negative, got %v", *b.FinalAllowance)
+	}
+	return nil
+}
+
+// final returns the limits raised by the final allowance
+func (b RunBudget) final() RunBudget {
+	share := DefaultFinalAllowance
+	if b.FinalAllowance != nil {
+		share = *b.FinalAllowance
+	}
+	return RunBudget{
+		MaxTokens:     b.MaxTokens + int(float64(b.MaxTokens)*share),
+		MaxModelCalls: b.MaxModelCalls + int(math.Ceil(float64(b.MaxModelCalls)*share)),
+		MaxDuration:   b.MaxDuration + time.Duration(float64(b.MaxDuration)*share),
+	}
+}
+
+// budgetGuard enforces a RunBudget on every model call of a run
+type budgetGuard struct {
+	budget RunBudget
+	usage  *usageStats
+	start  time.Time
+	// prior is the time spent on the run in earlier requests
+	prior time.Duration
+	// final applies the final allowance, see withFinalAllowance
+	final bool
+}
+
+func newBudgetGuard(budget RunBudget, usage *usageStats, prior time.Duration) *budgetGuard {
+	return &budgetGuard{budget: budget, usage: usage, start: time.Now(), prior: prior}
+}
+
+// elapsed is the time spent on the run so far
+func (b *budgetGuard) elapsed() time.Duration {
+	if b == nil {
+		return 0
+	}
+	return b.prior + time.Since(b.start)
+}
+
+// check returns an error wrapping ErrBudgetExceeded once any limit is reached
+func (b *budgetGuard) check() error {
+	if b == nil {
+		return nil
+	}
+	limits := b.budget
+	if b.final {
+		limits = limits.final()
+	}
+	total := b.usage.total()
+	if tokens := total.InputTokens + total.OutputTokens; limits.MaxTokens > 0 && tokens >= limits.MaxTokens {
+		return fmt.Errorf("%w: %d of %d tokens used", ErrBudgetExceeded, tokens, limits.MaxTokens)
+	}
+	if limits.MaxModelCalls > 0 && total.Calls >= limits.MaxModelCalls {
+		return fmt.Errorf("%w: %d of %d model calls made", ErrBudgetExceeded, total.Calls, limits.MaxModelCalls)
+	}
+	if elapsed := b.elapsed(); limits.MaxDuration > 0 && elapsed >= limits.MaxDuration {
+		return fmt.Errorf("%w: %s of %s spent", ErrBudgetExceeded, elapsed.Round(time.Second), limits.MaxDuration)
+	}
+	return nil
+}
+
+// middleware refuses model calls once the budget is spent
+func (b *budgetGuard) middleware() ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			if err := b.check(); err != nil {
+				return nil, err
+			}
+			return next(ctx, req, cb)
+		}
+	}
+}
+
+// withBudget enforces budget on the model calls made with ctx
+func withBudget(ctx context.Context, budget RunBudget, prior time.Duration) context.Context {
+	run := *runStateFrom(ctx)
+	run.budget = newBudgetGuard(budget, run.usage, prior)
+	return withRunState(ctx, &run)
+}
+
+// withFinalAllowance lets the model calls made with ctx go past the budget by
+// its final allowance. It is for writing and delivering the first report of a
+// run whose research the budget stopped; revisions are held to the limits.
+func withFinalAllowance(ctx context.Context) context.Context {
+	run := *runStateFrom(ctx)
+	if run.budget == nil {
+		return ctx
+	}
+	guard := *run.budget
+	guard.final = true
+	run.budget = &guard
+	return withRunState(ctx, &run)
+}
@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestDeepResearchFlowWritesReportWhenBudgetRunsOut(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	// Planning, plan confirmation and the first of two research questions,
+	// then synthesis, summary and report delivery on the final allowance
+	allowance := 1.0
+	cfg := DeepResearchConfig{Budget: RunBudget{MaxModelCalls: 3, FinalAllowance: &allowance}}
+	got, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	if !got.BudgetTruncated {
+		t.Error("result is not marked as budget-truncated")
+	}
+
+	research, synthesis := 0, 0
+	for _, req := range fake.Calls() {
+		switch {
+		case fakemodel.Prompt(g, "research")(req):
+			research++
+		case fakemodel.Prompt(g, "synthesis")(req):
+			synthesis++
+		}
+	}
+	if research != 1 {
+		t.Errorf("got %d research calls, want research to stop after the budget ran out", research)
+	}
+	if synthesis != 1 || got.DetailedReport == "" {
+		t.Error("no report was written from the findings gathered")
+	}
+	if len(got.Coverage) != 1 || !got.Coverage[0].Thin {
+		t.Errorf("coverage = %+v, want the chapter flagged as thin", got.Coverage)
+	}
+}
+
+func TestDeepResearchFlowFailsWhenBudgetRunsOutBeforeResearch(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Budget: RunBudget{MaxModelCalls: 1}}
+	_, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("got %v, want ErrBudgetExceeded", err)
+	}
+	var pe *PhaseError
+	if !errors.As(err, &pe) || pe.Phase != PhasePlanConfirmation {
+		t.Errorf("got %v, want a plan confirmation failure", err)
+	}
+}
+
+func TestDeepResearchFlowStopsWritingPastFinalAllowance(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	allowance := 0.0
+	cfg := DeepResearchConfig{Budget: RunBudget{MaxModelCalls: 3, FinalAllowance: &allowance}}
+	_, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	var pe *PhaseError
+	if !errors.As(err, &pe) || pe.Phase != PhaseSynthesis || pe.Cause != ErrBudgetExceeded {
+		t.Errorf("got %v, want the synthesis held to the budget", err)
+	}
+}
+
+func TestRegenerateChapterIsHeldToBudget(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewMemoryRunStore()}
+	first, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	calls := len(fake.Calls())
+
+	cfg.Budget = RunBudget{MaxModelCalls: first.Usage.Total.Calls}
+	_, err = RegenerateChapterFlow(g, cfg).Run(context.Background(), &RegenerateChapterInput{RunID: first.RunID, Chapter: 1})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("got %v, want ErrBudgetExceeded", err)
+	}
+	if len(fake.Calls()) != calls {
+		t.Errorf("regeneration made %d model calls past the budget", len(fake.Calls())-calls)
+	}
+}
@@ -0,0 +1,272 @@
+package flow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+
+	"research/search"
+)
+
+// CacheSearch is the CacheConfig.TTLs key and CacheStats key of search results
+const CacheSearch = "search"
+
+// DefaultCacheTTL is how long cached responses are used when no TTL is configured
+const DefaultCacheTTL = 7 * 24 * time.Hour
+
+// DefaultCachedPhases are the phases whose model responses are cached. Phases
+// that talk to the user are left out, since replaying them would skip the user.
+var DefaultCachedPhases = []string{PhaseResearch, PhaseSynthesis, PhaseSummary}
+
+// CacheConfig enables the on-disk cache of model and search responses
+type CacheConfig struct {
+	// Dir holds the cache; caching is off when it is empty
+	Dir string `yaml:"dir"`
+	// TTL is how long an entry is used; zero uses DefaultCacheTTL
+	TTL time.Duration `yaml:"ttl"`
+	// TTLs overrides TTL per phase, or for search results under "search"
+	TTLs map[string]time.Duration `yaml:"ttls"`
+	// Phases lists the phases whose model responses are cached; empty uses DefaultCachedPhases
+	Phases []string `yaml:"phases"`
+}
+
+// Validate rejects unknown phases and negative TTLs
+func (c CacheConfig) Validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("cache ttl must not be negative, got %s", c.TTL)
+	}
+	for key, ttl := range c.TTLs {
+		if key != CacheSearch && !isPhase(key) {
+			return fmt.Errorf("unknown phase %q in cache ttls", key)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("cache ttl for %q must not be negative, got %s", key, ttl)
+		}
+	}
+	for _, phase := range c.Phases {
+		if !isPhase(phase) {
+			return fmt.Errorf("unknown phase %q in cache phases", phase)
+		}
+	}
+	return nil
+}
+
+// CacheStats counts the cache lookups of a phase or of search
+type CacheStats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+// ResponseCache stores model and search responses on disk, addressed by a
+// hash of everything that determines them
+type ResponseCache struct {
+	cfg CacheConfig
+}
+
+// NewResponseCache returns the cache described by cfg, or nil when caching is off
+func NewResponseCache(cfg CacheConfig) *ResponseCache {
+	if cfg.Dir == "" {
+		return nil
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultCacheTTL
+	}
+	if len(cfg.Phases) == 0 {
+		cfg.Phases = DefaultCachedPhases
+	}
+	return &ResponseCache{cfg: cfg}
+}
+
+type cacheEntry struct {
+	CreatedAt time.Time       `json:"createdAt"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// cacheKey hashes the parts that determine a cached response
+func cacheKey(parts ...any) (string, error) {
+	data, err := json.Marshal(parts)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cache key: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.cfg.Dir, key[:2], key+".json")
+}
+
+func (c *ResponseCache) ttl(kind string) time.Duration {
+	if ttl, ok := c.cfg.TTLs[kind]; ok && ttl > 0 {
+		return ttl
+	}
+	return c.cfg.TTL
+}
+
+// get decodes the entry for key into v, unless it is missing or older than the TTL of kind
+func (c *ResponseCache) get(kind, key string, v any) bool {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("cache: failed to read %s: %v", key, err)
+		}
+		return false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("cache: ignoring corrupt entry %s: %v", key, err)
+		return false
+	}
+	if time.Since(entry.CreatedAt) > c.ttl(kind) {
+		return false
+	}
+	return json.Unmarshal(entry.Value, v) == nil
+}
+
+// put stores v under key
+func (c *ResponseCache) put(key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+	data, err := json.Marshal(cacheEntry{CreatedAt: time.Now(), Value: value})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	// Concurrent runs may write the same entry, so each writes its own temporary file
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// cacheStats collects CacheStats over a run
+type cacheStats struct {
+	mu    sync.Mutex
+	stats map[string]CacheStats
+}
+
+func (s *cacheStats) record(kind string, hit bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats == nil {
+		s.stats = map[string]CacheStats{}
+	}
+	stats := s.stats[kind]
+	if hit {
+		stats.Hits++
+	} else {
+		stats.Misses++
+	}
+	s.stats[kind] = stats
+}
+
+func (s *cacheStats) snapshot() map[string]CacheStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stats) == 0 {
+		return nil
+	}
+	return maps.Clone(s.stats)
+}
+
+// cacheResponses answers model requests of cached phases from the cache. A
+// run that bypasses the cache still stores its fresh responses. Only
+// completed responses without tool calls are stored.
+func cacheResponses(phase, prompt, model string, run *runState) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		c := run.cache
+		if c == nil || !slices.Contains(c.cfg.Phases, phase) {
+			return next
+		}
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			key, err := cacheKey(prompt, model, req)
+			if err != nil {
+				log.Printf("%s: not caching: %v", prompt, err)
+				return next(ctx, req, cb)
+			}
+
+			var cached ai.ModelResponse
+			if !run.bypassCache && c.get(phase, key, &cached) {
+				run.caching.record(phase, true)
+				cached.Request = req
+				return &cached, nil
+			}
+			run.caching.record(phase, false)
+
+			resp, err := next(ctx, req, cb)
+			if err == nil && resp.FinishReason == ai.FinishReasonStop && len(resp.ToolRequests()) == 0 {
+				stored := *resp
+				stored.Request = nil
+				if err := c.put(key, &stored); err != nil {
+					log.Printf("%s: %v", prompt, err)
+				}
+			}
+			return resp, err
+		}
+	}
+}
+
+// cachedSearch runs a web search through the run's cache
+func cachedSearch(ctx context.Context, searcher search.Provider, query string, limit int) ([]search.Result, error) {
+	run := runStateFrom(ctx)
+	c := run.cache
+	if c == nil {
+		return searcher.Search(ctx, query, limit)
+	}
+	key, err := cacheKey(CacheSearch, searcher.CacheKey(), query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []search.Result
+	if !run.bypassCache && c.get(CacheSearch, key, &results) {
+		run.caching.record(CacheSearch, true)
+		return results, nil
+	}
+	run.caching.record(CacheSearch, false)
+
+	results, err = searcher.Search(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.put(key, results); err != nil {
+		log.Printf("search: %v", err)
+	}
+	return results, nil
+}
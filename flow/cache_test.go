@@ -0,0 +1,97 @@
+package flow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestDeepResearchFlowReusesCachedResponses(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Cache: NewResponseCache(CacheConfig{Dir: t.TempDir()})}
+	flow := DeepResearchFlow(g, user.Tools(), cfg)
+	research := func() int {
+		n := 0
+		for _, req := range fake.Calls() {
+			if fakemodel.Prompt(g, "research")(req) {
+				n++
+			}
+		}
+		return n
+	}
+
+	first, err := flow.Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("first run failed: %v", err)
+	}
+	if got := first.Cache[PhaseResearch]; got != (CacheStats{Misses: 2}) {
+		t.Errorf("first run research cache = %+v, want 2 misses", got)
+	}
+
+	second, err := flow.Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	if research() != 2 {
+		t.Errorf("research prompt called %d times, want the second run answered from the cache", research())
+	}
+	if got := second.Cache[PhaseResearch]; got != (CacheStats{Hits: 2}) {
+		t.Errorf("second run research cache = %+v, want 2 hits", got)
+	}
+	if second.DetailedReport != first.DetailedReport {
+		t.Error("cached run produced a different report")
+	}
+	if _, ok := second.Cache[PhasePlanning]; ok {
+		t.Error("planning talks to the user and must not be cached")
+	}
+
+	if _, err := flow.Run(context.Background(), &DeepResearchInput{Topic: "Go", NoCache: true}); err != nil {
+		t.Fatalf("uncached run failed: %v", err)
+	}
+	if research() != 4 {
+		t.Errorf("research prompt called %d times, want noCache to bypass the cache", research())
+	}
+}
+
+func TestResponseCacheExpiresEntries(t *testing.T) {
+	c := NewResponseCache(CacheConfig{Dir: t.TempDir(), TTLs: map[string]time.Duration{CacheSearch: time.Nanosecond}})
+	key, err := cacheKey("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.put(key, "hit"); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if !c.get(PhaseResearch, key, &got) || got != "hit" {
+		t.Errorf("got %q, want the entry within the default TTL", got)
+	}
+	time.Sleep(time.Millisecond)
+	if c.get(CacheSearch, key, &got) {
+		t.Error("entry older than the search TTL was used")
+	}
+}
+
+func TestSearchCacheKeysOnProvider(t *testing.T) {
+	run := &runState{cache: NewResponseCache(CacheConfig{Dir: t.TempDir()}), caching: &cacheStats{}}
+	ctx := withRunState(context.Background(), run)
+	staging, production := &stubSearch{key: "staging"}, &stubSearch{key: "production"}
+
+	for range 2 {
+		if _, err := cachedSearch(ctx, staging, "Go", 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cachedSearch(ctx, production, "Go", 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(staging.queries) != 1 || len(production.queries) != 1 {
+		t.Errorf("searches = %d and %d, want one each: repeats cached, backends kept apart", len(staging.queries), len(production.queries))
+	}
+}
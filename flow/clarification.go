@@ -0,0 +1,110 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// DefaultClarifyingQuestions is how many questions the clarification phase may ask
+const DefaultClarifyingQuestions = 3
+
+// ResearchConstraints are the conditions the user set for a run, fed into planning
+type ResearchConstraints struct {
+	Scope      string   `json:"scope,omitempty"`
+	Audience   string   `json:"audience,omitempty"`
+	Timeframe  string   `json:"timeframe,omitempty"`
+	Region     string   `json:"region,omitempty"`
+	Purpose    string   `json:"purpose,omitempty"`
+	Focus      []string `json:"focus,omitempty"`
+	Exclusions []string `json:"exclusions,omitempty"`
+}
+
+type ClarificationResult struct {
+	Constraints ResearchConstraints `json:"constraints"`
+}
+
+// ClarificationState is where the clarification stands between user replies
+type ClarificationState struct {
+	// Done is set once the constraints are known
+	Done        bool                 `json:"done"`
+	Constraints *ResearchConstraints `json:"constraints,omitempty"`
+	// Question is the pending question while the run is paused
+	Question string `json:"question,omitempty"`
+	// History is the conversation up to the interrupted tool call
+	History []*ai.Message `json:"history,omitempty"`
+}
+
+// clarificationPhase asks the user about ambiguities in the topic, at most
+// maxQuestions at once, and records the resulting constraints in state. Like
+// planConfirmationPhase it returns errPaused when asking through an interrupt
+// tool and continues from state when called again with the reply.
+func clarificationPhase(ctx context.Context, g *genkit.Genkit, state *ClarificationState, input *DeepResearchInput, reply string, toolRefs []ai.ToolRef, maxQuestions int) error {
+	clarificationPrompt := genkit.LookupPrompt(g, "clarification")
+	if clarificationPrompt == nil {
+		return promptNotFound(PhaseClarification, "clarification")
+	}
+
+	promptInput := map[string]any{
+		"topic":        input.Topic,
+		"maxQuestions": maxQuestions,
+		"language":     runLanguage(input),
+	}
+
+	var resp *ai.ModelResponse
+	var err error
+	if state.Question != "" {
+		if reply == "" {
+			return &PhaseError{Phase: PhaseClarification, Cause: ErrInvalidInput, Err: errors.New("a reply is required to resume clarification")}
+		}
+		resp, err = resumePrompt(ctx, g, clarificationPrompt, PhaseClarification, promptInput, state.History, reply, toolRefs)
+	} else {
+		resp, err = executePrompt(ctx, clarificationPrompt, PhaseClarification,
+			ai.WithInput(promptInput),
+			ai.WithTools(toolRefs...))
+	}
+	if err != nil {
+		return phaseError(PhaseClarification, err)
+	}
+
+	if resp.FinishReason == ai.FinishReasonInterrupted {
+		state.Question = interruptQuestion(resp)
+		state.History = resp.History()
+		return errPaused
+	}
+	state.Question, state.History = "", nil
+
+	var result ClarificationResult
+	if err := resp.Output(&result); err != nil {
+		return invalidOutput(PhaseClarification, err)
+	}
+	state.Done = true
+	state.Constraints = &result.Constraints
+	return nil
+}
+
+// formatConstraints renders the constraints for prompt input, or "" when there are none
+func formatConstraints(c *ResearchConstraints) string {
+	if c == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	line := func(label, value string) {
+		if value != "" {
+			b.WriteString(fmt.Sprintf("- %s: %s\n", label, value))
+		}
+	}
+	line("調査範囲", c.Scope)
+	line("想定読者", c.Audience)
+	line("対象期間", c.Timeframe)
+	line("対象地域", c.Region)
+	line("調査の用途", c.Purpose)
+	line("重点的に調べる観点", strings.Join(c.Focus, "、"))
+	line("除外する事項", strings.Join(c.Exclusions, "、"))
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package flow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestClarificationFeedsConstraintsIntoPlanning(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	fake.On(fakemodel.Prompt(g, "clarification"), fakemodel.JSON(ClarificationResult{
+		Constraints: ResearchConstraints{
+			Region: "日本",
+			Focus:  []string{"導入コスト", "人材"},
+		},
+	}))
+	scriptDeepResearch(g, fake)
+
+	_, err := DeepResearchFlow(g, user.Tools(), DeepResearchConfig{ClarifyingQuestions: 2}).Run(context.Background(), &DeepResearchInput{Topic: "Go", Clarify: true})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	var clarification, planning string
+	for _, req := range fake.Calls() {
+		switch {
+		case fakemodel.Prompt(g, "clarification")(req):
+			clarification = fakemodel.RequestText(req)
+		case fakemodel.Prompt(g, "planning")(req):
+			planning = fakemodel.RequestText(req)
+		}
+	}
+	if !strings.Contains(clarification, "最大2個") {
+		t.Errorf("clarification prompt does not cap the questions at 2:\n%s", clarification)
+	}
+	if !strings.Contains(planning, "- 対象地域: 日本") || !strings.Contains(planning, "- 重点的に調べる観点: 導入コスト、人材") {
+		t.Errorf("planning prompt lacks the constraints:\n%s", planning)
+	}
+}
+
+func TestClarificationPausesBeforePlanning(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	clarify := fakemodel.Prompt(g, "clarification")
+	fake.On(fakemodel.All(clarify, fakemodel.HasToolResponse(AskUserTool)), fakemodel.JSON(ClarificationResult{
+		Constraints: ResearchConstraints{Audience: "経営層"},
+	}))
+	fake.On(clarify, fakemodel.ToolCall(AskUserTool, map[string]any{"question": "1. 想定読者は誰ですか？"}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewMemoryRunStore()}
+	paused, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go", Clarify: true})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	if paused.Status != RunPaused || paused.PendingQuestion != "1. 想定読者は誰ですか？" {
+		t.Fatalf("got %+v, want a run paused at the clarifying question", paused)
+	}
+	for _, req := range fake.Calls() {
+		if fakemodel.Prompt(g, "planning")(req) {
+			t.Fatal("planning started before the clarifying questions were answered")
+		}
+	}
+
+	done, err := ResumeDeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &ResumeInput{RunID: paused.RunID, Reply: "経営層向けです"})
+	if err != nil {
+		t.Fatalf("resumeDeepResearchFlow failed: %v", err)
+	}
+	if done.Status != RunCompleted {
+		t.Errorf("status = %s, want completed", done.Status)
+	}
+
+	planned := false
+	for _, req := range fake.Calls() {
+		if fakemodel.Prompt(g, "planning")(req) && strings.Contains(fakemodel.RequestText(req), "- 想定読者: 経営層") {
+			planned = true
+		}
+	}
+	if !planned {
+		t.Error("planning did not receive the constraints from the reply")
+	}
+}
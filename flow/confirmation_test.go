@@ -0,0 +1,222 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/genai"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestPlanConfirmationApprovedAfterRevision(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g).Reply("期間を直近1年に絞ってください", "それで大丈夫です")
+
+	ask := func(msg string) fakemodel.Reply {
+		return fakemodel.ToolCallWithJSON(askmetest.ChatTool, map[string]any{"message": msg}, map[string]any{})
+	}
+	confirm := fakemodel.Prompt(g, "plan_confirmation")
+	fake.On(fakemodel.All(confirm, fakemodel.Contains("修正版をユーザーに提示し"), fakemodel.Not(fakemodel.HasToolResponse(askmetest.ChatTool))),
+		ask("修正版: 直近1年の動向"))
+	fake.On(fakemodel.All(confirm, fakemodel.Contains("修正版をユーザーに提示し")),
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+	fake.On(fakemodel.All(confirm, fakemodel.Not(fakemodel.HasToolResponse(askmetest.ChatTool))),
+		ask("初期計画をご確認ください"))
+	fake.On(confirm,
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanRevise, RevisedPlan: "直近1年の動向に限定した計画"}))
+
+	plan, err := planConfirmationPhase(context.Background(), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if err != nil {
+		t.Fatalf("planConfirmationPhase failed: %v", err)
+	}
+
+	if plan != "直近1年の動向に限定した計画" {
+		t.Errorf("plan = %q, want the revised plan", plan)
+	}
+	if sent := user.Sent(); len(sent) != 2 || sent[0] != "初期計画をご確認ください" || sent[1] != "修正版: 直近1年の動向" {
+		t.Errorf("sent = %q", sent)
+	}
+	if user.Pending() != 0 {
+		t.Errorf("%d replies were never consumed", user.Pending())
+	}
+}
+
+func TestPlanConfirmationAsksAgainWhenReplyIsAmbiguous(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g).Reply("うーん、OKかな？でも期間はどうだろう", "はい、このまま進めてください")
+
+	ask := func(msg string) fakemodel.Reply {
+		return fakemodel.ToolCallWithJSON(askmetest.ChatTool, map[string]any{"message": msg}, map[string]any{})
+	}
+	confirm := fakemodel.Prompt(g, "plan_confirmation")
+	clarify := fakemodel.Contains("判断できませんでした")
+	fake.On(fakemodel.All(confirm, clarify, fakemodel.Not(fakemodel.HasToolResponse(askmetest.ChatTool))),
+		ask("この計画で承認しますか？修正点があれば教えてください"))
+	fake.On(fakemodel.All(confirm, clarify),
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+	fake.On(fakemodel.All(confirm, fakemodel.Not(fakemodel.HasToolResponse(askmetest.ChatTool))),
+		ask("初期計画をご確認ください"))
+	fake.On(confirm,
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanUnclear}))
+
+	plan, err := planConfirmationPhase(context.Background(), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if err != nil {
+		t.Fatalf("planConfirmationPhase failed: %v", err)
+	}
+	if plan != "初期計画" {
+		t.Errorf("plan = %q, want the unchanged initial plan", plan)
+	}
+	if sent := user.Sent(); len(sent) != 2 {
+		t.Errorf("sent = %q, want the plan and a clarifying question", sent)
+	}
+}
+
+func TestPlanConfirmationIgnoresApprovalWordsInRevisedPlan(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+
+	// A reply without a decision must not be read as approval, whatever its text says
+	fake.On(fakemodel.Prompt(g, "plan_confirmation"),
+		fakemodel.JSON(map[string]any{"revisedPlan": "OK 承認 approved"}))
+
+	_, err := planConfirmationPhase(context.Background(), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if !errors.Is(err, ErrNotApproved) {
+		t.Errorf("err = %v, want ErrNotApproved", err)
+	}
+}
+
+// A free-text reply from the user reaches the plan only as the structured
+// decision the model derives from it; prose from the model is sent back for
+// a decision instead of being scanned for approval words.
+func TestPlanConfirmationFreeTextReplyFallback(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g).Reply("いいと思います、その方向で進めてください")
+
+	confirm := fakemodel.Prompt(g, "plan_confirmation")
+	fake.On(fakemodel.All(confirm, fakemodel.Contains("could not be used")),
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+	fake.On(fakemodel.All(confirm, fakemodel.HasToolResponse(askmetest.ChatTool)),
+		fakemodel.Text("ユーザーは「いいと思います」と回答しました。OK"))
+	fake.On(confirm,
+		fakemodel.ToolCallWithJSON(askmetest.ChatTool, map[string]any{"message": "初期計画をご確認ください"}, map[string]any{}))
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	plan, err := planConfirmationPhase(withRunState(context.Background(), run), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if err != nil {
+		t.Fatalf("planConfirmationPhase failed: %v", err)
+	}
+	if plan != "初期計画" {
+		t.Errorf("plan = %q, want the approved initial plan", plan)
+	}
+	if got := run.outputs.snapshot()["plan_confirmation"]; got.Reasked != 1 {
+		t.Errorf("stats = %+v, want the prose reply asked again once", got)
+	}
+	if user.Pending() != 0 {
+		t.Errorf("%d replies were never consumed", user.Pending())
+	}
+}
+
+func TestPlanConfirmationRetriesInternalError(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+
+	// Gemini surfaces transient server failures with an INTERNAL status
+	fake.On(fakemodel.Prompt(g, "plan_confirmation"),
+		fakemodel.Error(genai.APIError{Code: 500, Message: "Internal error encountered.", Status: "INTERNAL"}),
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+
+	plan, err := planConfirmationPhase(withTestRetry(context.Background()), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if err != nil {
+		t.Fatalf("planConfirmationPhase failed: %v", err)
+	}
+	if plan != "初期計画" {
+		t.Errorf("plan = %q, want the approved initial plan", plan)
+	}
+	if calls := len(fake.Calls()); calls != 2 {
+		t.Errorf("model called %d times, want 2", calls)
+	}
+}
+
+func TestPlanConfirmationPersistentErrorFails(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+
+	fake.On(fakemodel.Prompt(g, "plan_confirmation"),
+		fakemodel.Error(genai.APIError{Code: 503, Message: "The model is overloaded.", Status: "UNAVAILABLE"}))
+	fake.On(fakemodel.Any(), fakemodel.Text("無関係な応答"))
+
+	plan, err := planConfirmationPhase(withTestRetry(context.Background()), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if err == nil {
+		t.Fatalf("expected an error, got plan %q", plan)
+	}
+	var modelErr *ModelError
+	if !errors.As(err, &modelErr) || modelErr.Class != ErrorClassInternal || modelErr.Attempts != testRetryPolicy.MaxAttempts {
+		t.Errorf("err = %v, want an internal ModelError after %d attempts", err, testRetryPolicy.MaxAttempts)
+	}
+	if !errors.Is(err, ErrModelUnavailable) {
+		t.Errorf("err = %v, want ErrModelUnavailable", err)
+	}
+	if calls := len(fake.Calls()); calls != testRetryPolicy.MaxAttempts {
+		t.Errorf("model called %d times, want %d", calls, testRetryPolicy.MaxAttempts)
+	}
+}
+
+func TestPlanConfirmationInvalidArgumentNotRetried(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+
+	fake.On(fakemodel.Prompt(g, "plan_confirmation"),
+		fakemodel.Error(genai.APIError{Code: 400, Message: "Request contains an invalid argument.", Status: "INVALID_ARGUMENT"}))
+
+	_, err := planConfirmationPhase(withTestRetry(context.Background()), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if ClassifyError(err) != ErrorClassInvalidArgument {
+		t.Errorf("err = %v, want invalid argument", err)
+	}
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model called %d times, want 1", calls)
+	}
+}
+
+func TestPlanConfirmationUserTimeout(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g).Timeout()
+
+	fake.On(fakemodel.Prompt(g, "plan_confirmation"),
+		fakemodel.ToolCallWithJSON(askmetest.ChatTool, map[string]any{"message": "ご確認ください"}, map[string]any{}))
+
+	_, err := planConfirmationPhase(context.Background(), g, &ConfirmationState{CurrentPlan: "初期計画"}, "", toolRefs(user.Tools()), "日本語")
+	if err == nil {
+		t.Fatal("expected an error when the user never replies")
+	}
+	if !errors.Is(err, ErrUserTimeout) || !strings.Contains(err.Error(), askmetest.ErrReplyTimeout.Error()) {
+		t.Errorf("err = %v, want reply timeout", err)
+	}
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhasePlanConfirmation {
+		t.Errorf("err = %v, want a plan_confirmation PhaseError", err)
+	}
+}
+
+func TestReportDeliverySendsReport(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g).Reply("ありがとうございます")
+
+	report := fakemodel.Prompt(g, "report_delivery")
+	fake.On(fakemodel.All(report, fakemodel.HasToolResponse(askmetest.ChatTool)), fakemodel.JSON(map[string]any{"completed": true}))
+	fake.On(report, fakemodel.ToolCallWithJSON(askmetest.ChatTool, map[string]any{"message": "調査が完了しました: Go is simple."}, map[string]any{}))
+
+	err := reportDeliveryPhase(context.Background(), g, &DeepResearchResult{
+		Topic:          "Go",
+		DetailedReport: "Go is simple.",
+	}, toolRefs(user.Tools()), "日本語")
+	if err != nil {
+		t.Fatalf("reportDeliveryPhase failed: %v", err)
+	}
+	if !user.SentContaining("Go is simple.") {
+		t.Errorf("report was not sent to the user: %q", user.Sent())
+	}
+}
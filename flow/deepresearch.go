@@ -2,24 +2,45 @@ package flow
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"maps"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/firebase/genkit/go/ai"
 	"github.com/firebase/genkit/go/core"
 	"github.com/firebase/genkit/go/genkit"
-	"google.golang.org/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"research/search"
 )
 
 type DeepResearchInput struct {
 	Topic    string `json:"topic" jsonschema:"description=調査したいトピック"`
 	Language string `json:"language,omitempty" jsonschema:"description=出力言語,default=日本語"`
+	// ReportType selects a dedicated prompt set and required chapter skeleton
+	ReportType       ReportType `json:"reportType,omitempty" jsonschema:"description=レポート種別,enum=technical,enum=market,enum=academic,enum=policy,enum=competitive,enum=custom"`
+	CustomReportType string     `json:"customReportType,omitempty" jsonschema:"description=reportTypeがcustomの場合に使用する prompts/report_types 内の種別名"`
+	// Clarify asks the user about ambiguities in the topic before planning
+	Clarify bool `json:"clarify,omitempty" jsonschema:"description=計画の前にトピックの曖昧な点をユーザーに確認する"`
+	// Review shows the draft to the user for chapter-level feedback before delivery
+	Review bool `json:"review,omitempty" jsonschema:"description=最終版の前に草稿をユーザーにレビューしてもらう"`
+	// NoCache makes the run call the model and search afresh; their responses still refresh the cache
+	NoCache bool `json:"noCache,omitempty" jsonschema:"description=キャッシュされた応答を使わずに調査する"`
+	// Models overrides the server's model settings for this run, keyed by phase or "default"
+	Models ModelConfig `json:"models,omitempty" jsonschema:"description=フェーズ別のモデル設定の上書き (キーはフェーズ名またはdefault)"`
 }
 
 type ChapterInfo struct {
 	Title       string `json:"title"`
 	Description string `json:"description"`
 	Importance  string `json:"importance"`
+	// Questions are the 1-based numbers of the key questions the chapter answers
+	Questions []int `json:"questions,omitempty" yaml:"-"`
 }
 
 type PlanningResult struct {
@@ -30,9 +51,18 @@ type PlanningResult struct {
 	ChapterStructure []ChapterInfo `json:"chapterStructure"`
 }
 
+// PlanDecision is the model's reading of the user's reply to a proposed plan or draft
+type PlanDecision string
+
+const (
+	PlanApprove PlanDecision = "approve"
+	PlanRevise  PlanDecision = "revise"
+	PlanUnclear PlanDecision = "unclear"
+)
+
 type PlanConfirmationResult struct {
-	Approved    bool   `json:"approved"`
-	RevisedPlan string `json:"revisedPlan"`
+	Decision    PlanDecision `json:"decision"`
+	RevisedPlan string       `json:"revisedPlan,omitempty"`
 }
 
 type ResearchResult struct {
@@ -59,149 +89,170 @@ type SummaryResult struct {
 }
 
 type DeepResearchResult struct {
-	Topic           string   `json:"topic"`
-	ResearchPlan    string   `json:"research_plan"`
-	KeyQuestions    []string `json:"key_questions"`
-	DetailedReport  string   `json:"detailed_report"`
-	Sources         []string `json:"sources"`
-	Summary         string   `json:"summary"`
-	Recommendations string   `json:"recommendations"`
+	Topic string `json:"topic"`
+	// RunID identifies the run for resumeDeepResearchFlow
+	RunID  string    `json:"run_id,omitempty"`
+	Status RunStatus `json:"status,omitempty"`
+	// PendingQuestion is the question awaiting the user's reply while the run is paused
+	PendingQuestion string `json:"pending_question,omitempty"`
+	// ReportVersion numbers the report within its run; chapter regeneration adds versions
+	ReportVersion  int      `json:"report_version,omitempty"`
+	ResearchPlan   string   `json:"research_plan"`
+	KeyQuestions   []string `json:"key_questions"`
+	DetailedReport string   `json:"detailed_report"`
+	Sources        []string `json:"sources"`
+	// Coverage reports, per planned chapter, how well the research covered it
+	Coverage        []ChapterCoverage `json:"coverage,omitempty"`
+	Summary         string            `json:"summary"`
+	Recommendations string            `json:"recommendations"`
+	// OutputRepairs counts, per prompt, the responses that needed repair or a re-ask
+	OutputRepairs map[string]OutputRepairStats `json:"output_repairs,omitempty"`
+	// Usage is the token usage and estimated cost of every request of the run so far
+	Usage *RunUsage `json:"usage,omitempty"`
+	// Cache counts the cache hits and misses per phase, and of search under "search"
+	Cache map[string]CacheStats `json:"cache,omitempty"`
+	// BudgetTruncated is set when the run's budget ran out and the report was
+	// written from the research gathered up to then
+	BudgetTruncated bool `json:"budget_truncated,omitempty"`
 }
 
 // planningPhase performs initial research planning using MCP tools for user interaction
-func planningPhase(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, toolRefs []ai.ToolRef, language string) (*PlanningResult, error) {
+func planningPhase(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, constraints *ResearchConstraints, toolRefs []ai.ToolRef, language string, reportType *ReportTypeSpec) (*PlanningResult, error) {
 	planningPrompt := genkit.LookupPrompt(g, "planning")
 	if planningPrompt == nil {
-		return nil, fmt.Errorf("planning prompt not found")
+		return nil, promptNotFound(PhasePlanning, "planning")
 	}
 
-	resp, err := planningPrompt.Execute(ctx,
+	resp, err := executePrompt(ctx, planningPrompt, PhasePlanning,
 		ai.WithInput(map[string]any{
-			"topic":    input.Topic,
-			"language": language,
+			"topic":            input.Topic,
+			"language":         language,
+			"requiredChapters": formatSkeleton(reportType),
+			"constraints":      formatConstraints(constraints),
+			"reportGuidance":   reportType.guidance(PhasePlanning),
 		}),
 		ai.WithTools(toolRefs...))
 	if err != nil {
-		return nil, fmt.Errorf("planning phase failed: %w", err)
+		return nil, phaseError(PhasePlanning, err)
 	}
 
 	var result PlanningResult
 	if err := resp.Output(&result); err != nil {
-		return nil, fmt.Errorf("failed to parse planning result: %w", err)
+		return nil, invalidOutput(PhasePlanning, err)
 	}
+	result.ChapterStructure = applySkeleton(result.ChapterStructure, reportType)
 
 	return &result, nil
 }
 
-// planConfirmationPhase asks user to confirm the research plan using ask-me tool and iterates until approval
-func planConfirmationPhase(ctx context.Context, g *genkit.Genkit, initialPlan string, toolRefs []ai.ToolRef, language string) (string, error) {
+// planConfirmationPhase asks the user to confirm the research plan and
+// iterates until approval. When the question goes through an interrupt tool
+// the phase returns errPaused with the question recorded in state; calling it
+// again with the user's reply continues where it stopped.
+func planConfirmationPhase(ctx context.Context, g *genkit.Genkit, state *ConfirmationState, reply string, toolRefs []ai.ToolRef, language string) (string, error) {
 	confirmationPrompt := genkit.LookupPrompt(g, "plan_confirmation")
 	if confirmationPrompt == nil {
-		return "", fmt.Errorf("plan_confirmation prompt not found")
+		return "", promptNotFound(PhasePlanConfirmation, "plan_confirmation")
 	}
 
-	currentPlan := initialPlan
 	maxIterations := 10
 
-	for i := 0; i < maxIterations; i++ {
-		resp, err := confirmationPrompt.Execute(ctx,
-			ai.WithInput(map[string]any{
-				"currentPlan": currentPlan,
-				"isFirstTime": i == 0,
-				"language":    language,
-			}),
-			ai.WithTools(toolRefs...))
-		if err != nil {
-			// If API error, try with simpler prompt without tools
-			if strings.Contains(err.Error(), "INTERNAL") {
-				simplePrompt := fmt.Sprintf("調査計画を確認してください: %s", currentPlan)
-				resp, err = genkit.Generate(ctx, g,
-					ai.WithConfig(&genai.GenerateContentConfig{
-						Temperature: genai.Ptr[float32](0.3),
-					}),
-					ai.WithPrompt(simplePrompt))
-				if err != nil {
-					return "", fmt.Errorf("plan confirmation phase failed at iteration %d (even with simple prompt): %w", i+1, err)
-				}
-				// For simple prompt fallback, use text response
-				return resp.Text(), nil
-			} else {
-				return "", fmt.Errorf("plan confirmation phase failed at iteration %d: %w", i+1, err)
-			}
+	for ; state.Iteration < maxIterations; state.Iteration++ {
+		input := map[string]any{
+			"currentPlan":        state.CurrentPlan,
+			"isFirstTime":        state.Iteration == 0,
+			"needsClarification": state.NeedsClarification,
+			"language":           language,
 		}
 
-		var result PlanConfirmationResult
-		parseError := resp.Output(&result)
-
-		if parseError != nil {
-			// Fallback to text parsing if structured output fails
-			responseText := resp.Text()
-			fmt.Printf("Failed to parse JSON response, using text fallback. Error: %v\nResponse: %s\n", parseError, responseText)
-
-			// Check for approval indicators in the text
-			if strings.Contains(responseText, "承認") || strings.Contains(responseText, "APPROVED") ||
-				strings.Contains(responseText, "approved") || strings.Contains(responseText, "OK") ||
-				strings.Contains(strings.ToLower(responseText), "approved") {
-				return currentPlan, nil
+		var resp *ai.ModelResponse
+		var err error
+		if state.Question != "" {
+			if reply == "" {
+				return "", &PhaseError{Phase: PhasePlanConfirmation, Cause: ErrInvalidInput, Err: errors.New("a reply is required to resume plan confirmation")}
 			}
+			resp, err = resumePrompt(ctx, g, confirmationPrompt, PhasePlanConfirmation, input, state.History, reply, toolRefs)
+			reply = ""
+		} else {
+			resp, err = executePrompt(ctx, confirmationPrompt, PhasePlanConfirmation,
+				ai.WithInput(input),
+				ai.WithTools(toolRefs...))
+		}
+		if err != nil {
+			return "", phaseError(PhasePlanConfirmation, fmt.Errorf("iteration %d: %w", state.Iteration+1, err))
+		}
 
-			// If no clear approval, treat the response as a revised plan
-			if responseText != "" {
-				currentPlan = responseText
-			}
-			continue
+		if resp.FinishReason == ai.FinishReasonInterrupted {
+			state.Question = interruptQuestion(resp)
+			state.History = resp.History()
+			return "", errPaused
 		}
+		state.Question, state.History = "", nil
 
-		// Successfully parsed JSON response
-		if result.Approved {
-			return currentPlan, nil
-		} else if !result.Approved && result.RevisedPlan != "" {
-			currentPlan = result.RevisedPlan
-			continue
+		var result PlanConfirmationResult
+		if err := resp.Output(&result); err != nil {
+			return "", invalidOutput(PhasePlanConfirmation, err)
 		}
 
-		// If we reach here, try to use the text response as fallback
-		responseText := resp.Text()
-		if responseText != "" {
-			currentPlan = responseText
+		// Only an explicit decision moves the plan forward; anything else is put back to the user
+		state.NeedsClarification = false
+		switch {
+		case result.Decision == PlanApprove:
+			return state.CurrentPlan, nil
+		case result.Decision == PlanRevise && result.RevisedPlan != "":
+			state.CurrentPlan = result.RevisedPlan
+		default:
+			log.Printf("plan confirmation: no clear decision in reply (%q), asking the user again", result.Decision)
+			state.NeedsClarification = true
 		}
 	}
 
-	return currentPlan, fmt.Errorf("maximum iterations (%d) reached for plan confirmation, proceeding with last plan", maxIterations)
+	return state.CurrentPlan, &PhaseError{
+		Phase: PhasePlanConfirmation,
+		Cause: ErrNotApproved,
+		Err:   fmt.Errorf("maximum iterations (%d) reached for plan confirmation", maxIterations),
+	}
 }
 
-// researchPhase performs detailed web search for each research question
-func researchPhase(ctx context.Context, g *genkit.Genkit, keyQuestions []string, language string) ([]string, []string, error) {
+// researchPhase performs detailed web search for each research question.
+// Each question gets the effort of the most important chapter it serves, and
+// the coverage of every chapter is reported. Models without built-in search
+// are given results from searcher instead. When the run's budget runs out,
+// the findings so far are returned along with the error.
+func researchPhase(ctx context.Context, g *genkit.Genkit, keyQuestions []string, chapters []ChapterInfo, language string, searcher search.Provider) ([]string, []string, []ChapterCoverage, error) {
 	researchPrompt := genkit.LookupPrompt(g, "research")
 	if researchPrompt == nil {
-		return nil, nil, fmt.Errorf("research prompt not found")
+		return nil, nil, nil, promptNotFound(PhaseResearch, "research")
+	}
+
+	builtinSearch := hasBuiltinSearch(phaseModel(ctx, researchPrompt, PhaseResearch))
+	if !builtinSearch && searcher == nil {
+		log.Printf("research model %s has no built-in search and no search provider is configured; answering from model knowledge only", phaseModel(ctx, researchPrompt, PhaseResearch))
 	}
 
+	effort := runStateFrom(ctx).effort
+	levels := questionImportance(keyQuestions, chapters)
+	answered := make([]bool, len(keyQuestions))
+	questionSources := make([][]string, len(keyQuestions))
+
 	var allFindings []string
 	var sources []string
 
-	for _, question := range keyQuestions {
-		resp, err := researchPrompt.Execute(ctx,
-			ai.WithInput(map[string]any{
-				"question": question,
-				"language": language,
-			}))
-		if err != nil {
-			return nil, nil, fmt.Errorf("web search failed for question '%s': %w", question, err)
+	for i, question := range keyQuestions {
+		result, err := researchQuestion(ctx, researchPrompt, question, i+1, levels[i], chapters, language, builtinSearch, searcher)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return allFindings, sources, chapterCoverage(chapters, answered, questionSources, effort), err
 		}
-
-		var result ResearchResult
-		if err := resp.Output(&result); err != nil {
-			// Fallback to text if structured output fails
-			allFindings = append(allFindings, fmt.Sprintf("【%s】\n%s", question, resp.Text()))
-			sources = append(sources, fmt.Sprintf("Search results for: %s", question))
-			continue
+		if err != nil {
+			return nil, nil, nil, err
 		}
 
 		// Format the structured result
 		formattedResult := fmt.Sprintf("【%s】\n主要な発見事項: %s\n重要なデータ: %s\n専門家の意見: %s",
 			question, result.Findings, result.Data, result.ExpertOpinions)
 		allFindings = append(allFindings, formattedResult)
+		answered[i] = strings.TrimSpace(result.Findings) != ""
+		questionSources[i] = result.SourceUrls
 
 		// Add source URLs
 		for _, url := range result.SourceUrls {
@@ -209,93 +260,157 @@ func researchPhase(ctx context.Context, g *genkit.Genkit, keyQuestions []string,
 		}
 	}
 
-	return allFindings, sources, nil
+	return allFindings, sources, chapterCoverage(chapters, answered, questionSources, effort), nil
+}
+
+// researchQuestion researches one key question, numbered from 1, with the
+// effort of its importance
+func researchQuestion(ctx context.Context, researchPrompt ai.Prompt, question string, number int, importance string, chapters []ChapterInfo, language string, builtinSearch bool, searcher search.Provider) (result ResearchResult, err error) {
+	ctx, span := tracer.Start(ctx, "research_question", trace.WithAttributes(
+		attribute.Int("research.question_index", number),
+		attribute.String("research.importance", importance),
+	))
+	defer func() { endSpan(span, err) }()
+
+	e := runStateFrom(ctx).effort.For(importance)
+
+	var searchResults string
+	if !builtinSearch && searcher != nil {
+		var results []search.Result
+		seen := map[string]bool{}
+		for _, query := range researchQueries(question, number, chapters, e.Queries) {
+			found, err := cachedSearch(ctx, searcher, query, e.SearchResults)
+			if err != nil {
+				// The model can still answer from what it knows
+				log.Printf("research: search failed for %q, continuing without its results: %v", query, err)
+				continue
+			}
+			for _, r := range found {
+				if !seen[r.URL] {
+					seen[r.URL] = true
+					results = append(results, r)
+				}
+			}
+		}
+		searchResults = search.Format(results)
+	}
+
+	resp, err := executePrompt(withOutputLimit(ctx, PhaseResearch, e.MaxOutputTokens), researchPrompt, PhaseResearch,
+		ai.WithInput(map[string]any{
+			"question":      question,
+			"searchResults": searchResults,
+			"importance":    importance,
+			"queries":       e.Queries,
+			"language":      language,
+		}))
+	if err != nil {
+		return result, phaseError(PhaseResearch, fmt.Errorf("question '%s': %w", question, err))
+	}
+
+	if err := resp.Output(&result); err != nil {
+		return result, invalidOutput(PhaseResearch, err)
+	}
+	return result, nil
+}
+
+// synthesisPhase writes the report chapters from the findings and summarizes them
+func synthesisPhase(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, researchPlan string, allFindings []string, chapterStructure []ChapterInfo, language string, reportType *ReportTypeSpec) (*SynthesisResult, string, error) {
+	synthesize := singlePassSynthesis
+	if budget := runStateFrom(ctx).synthesis.withDefaults().TokenBudget; needsChapterSynthesis(allFindings, chapterStructure, budget) {
+		// Too many findings for one prompt; draft chapter by chapter instead
+		synthesize = chapterSynthesis
+	}
+	synthesis, err := synthesize(ctx, g, input, researchPlan, allFindings, chapterStructure, language, reportType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, end := startPhase(ctx, PhaseSummary)
+	summary, err := summaryPhase(ctx, g, formatReport(synthesis), language)
+	end(err)
+	if err != nil {
+		return nil, "", err
+	}
+	return synthesis, summary, nil
 }
 
-// synthesisPhase creates the final comprehensive report and summary
-func synthesisPhase(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, researchPlan string, allFindings []string, chapterStructure []ChapterInfo, language string) (string, string, error) {
+// singlePassSynthesis writes the whole report from all findings in one prompt
+func singlePassSynthesis(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, researchPlan string, allFindings []string, chapterStructure []ChapterInfo, language string, reportType *ReportTypeSpec) (*SynthesisResult, error) {
 	// Generate comprehensive report
 	synthesisPrompt := genkit.LookupPrompt(g, "synthesis")
 	if synthesisPrompt == nil {
-		return "", "", fmt.Errorf("synthesis prompt not found")
-	}
-
-	// Format chapter structure for prompt
-	chapterStructureText := ""
-	for i, chapter := range chapterStructure {
-		chapterStructureText += fmt.Sprintf("%d. %s (%s重要度)\n   %s\n\n",
-			i+1, chapter.Title, chapter.Importance, chapter.Description)
+		return nil, promptNotFound(PhaseSynthesis, "synthesis")
 	}
 
-	synthesisResp, err := synthesisPrompt.Execute(ctx,
+	synthesisResp, err := executePrompt(ctx, synthesisPrompt, PhaseSynthesis,
 		ai.WithInput(map[string]any{
 			"topic":             input.Topic,
 			"investigationPlan": researchPlan,
-			"chapterStructure":  chapterStructureText,
+			"chapterStructure":  formatChapterStructure(chapterStructure),
 			"allFindings":       strings.Join(allFindings, "\n\n"),
+			"requiredChapters":  formatSkeleton(reportType),
+			"reportGuidance":    reportType.guidance(PhaseSynthesis),
 			"language":          language,
 		}))
 	if err != nil {
-		return "", "", fmt.Errorf("synthesis failed: %w", err)
+		return nil, phaseError(PhaseSynthesis, err)
 	}
 
 	var synthesisResult SynthesisResult
-	var detailedReport string
 	if err := synthesisResp.Output(&synthesisResult); err != nil {
-		// Fallback to text if structured output fails
-		detailedReport = synthesisResp.Text()
-	} else {
-		// Format the structured result into a report
-		var reportBuilder strings.Builder
-		for i, chapter := range synthesisResult.Chapters {
-			reportBuilder.WriteString(fmt.Sprintf("%d. %s\n%s\n\n", i+1, chapter.Title, chapter.Content))
-		}
-		detailedReport = reportBuilder.String()
+		return nil, invalidOutput(PhaseSynthesis, err)
+	}
+	return &synthesisResult, nil
+}
 
-		// Add structure changes note if any
-		if synthesisResult.StructureChanges != "" {
-			detailedReport += fmt.Sprintf("\n--- 章構成の変更点 ---\n%s\n", synthesisResult.StructureChanges)
-		}
+// formatReport lays out the chapters as the detailed report text
+func formatReport(synthesis *SynthesisResult) string {
+	var reportBuilder strings.Builder
+	for i, chapter := range synthesis.Chapters {
+		reportBuilder.WriteString(fmt.Sprintf("%d. %s\n%s\n\n", i+1, chapter.Title, chapter.Content))
+	}
+
+	// Add structure changes note if any
+	if synthesis.StructureChanges != "" {
+		reportBuilder.WriteString(fmt.Sprintf("\n--- 章構成の変更点 ---\n%s\n", synthesis.StructureChanges))
 	}
+	return reportBuilder.String()
+}
 
-	// Generate summary and recommendations
+// summaryPhase extracts the key points and recommendations of a report
+func summaryPhase(ctx context.Context, g *genkit.Genkit, detailedReport, language string) (string, error) {
 	summaryPrompt := genkit.LookupPrompt(g, "summary")
 	if summaryPrompt == nil {
-		return "", "", fmt.Errorf("summary prompt not found")
+		return "", promptNotFound(PhaseSummary, "summary")
 	}
 
-	summaryResp, err := summaryPrompt.Execute(ctx,
+	summaryResp, err := executePrompt(ctx, summaryPrompt, PhaseSummary,
 		ai.WithInput(map[string]any{
 			"detailedReport": detailedReport,
 			"language":       language,
 		}))
 	if err != nil {
-		return "", "", fmt.Errorf("summary generation failed: %w", err)
+		return "", phaseError(PhaseSummary, err)
 	}
 
 	var summaryResult SummaryResult
-	var summaryText string
 	if err := summaryResp.Output(&summaryResult); err != nil {
-		// Fallback to text if structured output fails
-		summaryText = summaryResp.Text()
-	} else {
-		// Format the structured result
-		summaryText = fmt.Sprintf("重要なポイント:\n%s\n\n推奨事項:\n%s",
-			strings.Join(summaryResult.KeyPoints, "\n"),
-			strings.Join(summaryResult.Recommendations, "\n"))
+		return "", invalidOutput(PhaseSummary, err)
 	}
 
-	return detailedReport, summaryText, nil
+	return fmt.Sprintf("重要なポイント:\n%s\n\n推奨事項:\n%s",
+		strings.Join(summaryResult.KeyPoints, "\n"),
+		strings.Join(summaryResult.Recommendations, "\n")), nil
 }
 
 // reportDeliveryPhase delivers the final research report to user using ask-me tool
 func reportDeliveryPhase(ctx context.Context, g *genkit.Genkit, result *DeepResearchResult, toolRefs []ai.ToolRef, language string) error {
 	reportDeliveryPrompt := genkit.LookupPrompt(g, "report_delivery")
 	if reportDeliveryPrompt == nil {
-		return fmt.Errorf("report_delivery prompt not found")
+		return promptNotFound(PhaseReportDelivery, "report_delivery")
 	}
 
-	_, err := reportDeliveryPrompt.Execute(ctx,
+	_, err := executePrompt(ctx, reportDeliveryPrompt, PhaseReportDelivery,
 		ai.WithInput(map[string]any{
 			"topic":           result.Topic,
 			"detailedReport":  result.DetailedReport,
@@ -305,17 +420,61 @@ func reportDeliveryPhase(ctx context.Context, g *genkit.Genkit, result *DeepRese
 		}),
 		ai.WithTools(toolRefs...))
 	if err != nil {
-		return fmt.Errorf("report delivery phase failed: %w", err)
+		return phaseError(PhaseReportDelivery, err)
 	}
 
 	return nil
 }
 
-func DeepResearchFlow(g *genkit.Genkit, mcpTools []ai.Tool) *core.Flow[*DeepResearchInput, *DeepResearchResult, struct{}] {
-	return genkit.DefineFlow(g, "deepResearchFlow", func(ctx context.Context, input *DeepResearchInput) (*DeepResearchResult, error) {
-		language := input.Language
-		if language == "" {
-			language = "日本語" // Default to Japanese
+// DeepResearchConfig holds the server-side settings of deepResearchFlow
+type DeepResearchConfig struct {
+	// Models is the per-phase model configuration, overridable per run
+	Models ModelConfig
+	// DefaultModel is the model Genkit runs prompts on that name none, so
+	// that their usage is recorded and priced under it
+	DefaultModel string
+	// Search backs the research phase when its model has no built-in search
+	Search search.Provider
+	// Retry governs retries of failed model calls; the zero value uses DefaultRetryPolicy
+	Retry RetryPolicy
+	// Effort sets the research effort per chapter importance; unset fields use DefaultResearchEffort
+	Effort ResearchEffortConfig
+	// ClarifyingQuestions caps the questions of the clarification phase; zero uses DefaultClarifyingQuestions
+	ClarifyingQuestions int
+	// Synthesis decides when the report is drafted chapter by chapter; unset fields use DefaultSynthesisConfig
+	Synthesis SynthesisConfig
+	// Prices estimate the cost of model calls; nil uses DefaultPrices
+	Prices PriceTable
+	// Budget caps the tokens, model calls and time of each run; the zero value is unlimited
+	Budget RunBudget
+	// Cache answers repeated model and search requests; nil disables caching
+	Cache *ResponseCache
+	// RateLimiter is shared with the other flows of the process; nil leaves model calls unlimited
+	RateLimiter *RateLimiter
+	// ReportTypeDir holds the report type skeletons; empty uses DefaultReportTypeDir
+	ReportTypeDir string
+	// Tools limits the MCP tools of deepResearchFlow and of each of its phases
+	Tools ToolPolicy
+	// Runs persists runs. When set, plan confirmation pauses the run and
+	// returns its question instead of waiting for the user through ask-me.
+	Runs RunStore
+}
+
+func DeepResearchFlow(g *genkit.Genkit, mcpTools []ai.Tool, cfg DeepResearchConfig) *core.Flow[*DeepResearchInput, *DeepResearchResult, struct{}] {
+	return genkit.DefineFlow(g, "deepResearchFlow", func(ctx context.Context, input *DeepResearchInput) (result *DeepResearchResult, err error) {
+		defer func(start time.Time) { recordRun(ctx, "deepResearchFlow", start, result, err) }(time.Now())
+
+		now := time.Now()
+		run := &Run{
+			ID:        newRunID(),
+			Input:     *input,
+			CreatedAt: now,
+			UpdatedAt: now,
+			CreatedBy: Caller(ctx),
+		}
+		ctx, reportType, err := runContext(ctx, cfg, run)
+		if err != nil {
+			return nil, err
 		}
 
 		// Convert MCP tools to ToolRef
@@ -324,8 +483,112 @@ func DeepResearchFlow(g *genkit.Genkit, mcpTools []ai.Tool) *core.Flow[*DeepRese
 			toolRefs[i] = tool
 		}
 
-		// Phase 1: Research planning with user interaction
-		planningResult, err := planningPhase(ctx, g, input, toolRefs, language)
+		result, err = continueRun(ctx, g, toolRefs, cfg, run, "", reportType)
+		if err != nil {
+			failRun(ctx, cfg.Runs, run)
+		}
+		return result, err
+	})
+}
+
+// runLanguage returns the output language of a run
+func runLanguage(input *DeepResearchInput) string {
+	if input.Language == "" {
+		return "日本語" // Default to Japanese
+	}
+	return input.Language
+}
+
+// runContext validates the run's input and scopes its settings to ctx. The
+// output repair counts, token usage and cache stats the run recorded in
+// earlier requests carry over.
+func runContext(ctx context.Context, cfg DeepResearchConfig, stored *Run) (context.Context, *ReportTypeSpec, error) {
+	input := &stored.Input
+	reportType, err := resolveReportType(cfg.ReportTypeDir, input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidInput, err)
+	}
+
+	if err := input.Models.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidInput, err)
+	}
+	retry := cfg.Retry
+	if retry == (RetryPolicy{}) {
+		retry = DefaultRetryPolicy
+	}
+	prices := cfg.Prices
+	if prices == nil {
+		prices = DefaultPrices
+	}
+	run := &runState{
+		runID:        stored.ID,
+		models:       cfg.Models.Merge(input.Models),
+		defaultModel: cfg.DefaultModel,
+		retry:        retry,
+		effort:       cfg.Effort,
+		synthesis:    cfg.Synthesis.withDefaults(),
+		outputs:      &outputStats{prompts: maps.Clone(stored.OutputRepairs)},
+		usage:        newUsageStats(prices, stored.Usage),
+		cache:        cfg.Cache,
+		caching:      &cacheStats{stats: maps.Clone(stored.Cache)},
+		bypassCache:  input.NoCache,
+		limiter:      cfg.RateLimiter,
+	}
+	return withRunState(ctx, run), reportType, nil
+}
+
+// continueRun carries a run from clarification to report delivery,
+// returning early with the pending question when clarification, plan
+// confirmation or draft review pauses. Phases a resumed run already went
+// through are skipped.
+func continueRun(ctx context.Context, g *genkit.Genkit, toolRefs []ai.ToolRef, cfg DeepResearchConfig, run *Run, reply string, reportType *ReportTypeSpec) (*DeepResearchResult, error) {
+	input := &run.Input
+	language := runLanguage(input)
+	outputs := runStateFrom(ctx).outputs
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("research.run_id", run.ID))
+	ctx = withBudget(ctx, cfg.Budget, run.Elapsed)
+
+	tools := cfg.Tools.phaseTools(g)
+	// With a run store the user's answers come back through resumeDeepResearchFlow
+	if cfg.Runs != nil {
+		toolRefs = append(slices.Clone(toolRefs), askUserTool(g))
+		for _, phase := range questionPhases {
+			tools[phase] = func(name string) bool { return name == AskUserTool }
+		}
+	}
+	ctx = withPhaseTools(ctx, tools)
+
+	// Phase 0: Optional clarification of the topic
+	if input.Clarify && (run.Clarification == nil || !run.Clarification.Done) {
+		if run.Clarification == nil {
+			run.Clarification = &ClarificationState{}
+		}
+		maxQuestions := cfg.ClarifyingQuestions
+		if maxQuestions <= 0 {
+			maxQuestions = DefaultClarifyingQuestions
+		}
+		phaseCtx, end := startPhase(ctx, PhaseClarification)
+		err := clarificationPhase(phaseCtx, g, run.Clarification, input, reply, tools.refs(PhaseClarification, toolRefs), maxQuestions)
+		end(err)
+		if errors.Is(err, errPaused) {
+			return pauseRun(ctx, cfg, run, PhaseClarification)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply = ""
+	}
+
+	if run.Planning == nil {
+		var constraints *ResearchConstraints
+		if run.Clarification != nil {
+			constraints = run.Clarification.Constraints
+		}
+
+		// Phase 1: Research planning
+		phaseCtx, end := startPhase(ctx, PhasePlanning)
+		planningResult, err := planningPhase(phaseCtx, g, input, constraints, tools.refs(PhasePlanning, toolRefs), language, reportType)
+		end(err)
 		if err != nil {
 			return nil, err
 		}
@@ -336,15 +599,25 @@ func DeepResearchFlow(g *genkit.Genkit, mcpTools []ai.Tool) *core.Flow[*DeepRese
 			planningResult.Scope,
 			planningResult.ResearchApproach,
 			strings.Join(planningResult.KeyQuestions, ", "))
+		run.Planning = planningResult
+		run.Confirmation = &ConfirmationState{CurrentPlan: initialPlan}
+	}
 
+	if len(run.Reports) == 0 {
 		// Phase 2: Plan confirmation with user
-		researchPlan, err := planConfirmationPhase(ctx, g, initialPlan, toolRefs, language)
+		phaseCtx, end := startPhase(ctx, PhasePlanConfirmation)
+		researchPlan, err := planConfirmationPhase(phaseCtx, g, run.Confirmation, reply, tools.refs(PhasePlanConfirmation, toolRefs), language)
+		end(err)
+		if errors.Is(err, errPaused) {
+			return pauseRun(ctx, cfg, run, PhasePlanConfirmation)
+		}
 		if err != nil {
 			return nil, err
 		}
+		reply = ""
 
 		// Phase 3: Use key research questions from planning phase
-		keyQuestions := planningResult.KeyQuestions
+		keyQuestions := run.Planning.KeyQuestions
 		if len(keyQuestions) == 0 {
 			// Fallback to default questions if none provided
 			keyQuestions = []string{
@@ -355,34 +628,173 @@ func DeepResearchFlow(g *genkit.Genkit, mcpTools []ai.Tool) *core.Flow[*DeepRese
 		}
 
 		// Phase 4: Detailed web search research
-		allFindings, sources, err := researchPhase(ctx, g, keyQuestions, language)
-		if err != nil {
+		phaseCtx, end = startPhase(ctx, PhaseResearch)
+		allFindings, sources, coverage, err := researchPhase(phaseCtx, g, keyQuestions, run.Planning.ChapterStructure, language, cfg.Search)
+		end(err)
+		truncated := false
+		if errors.Is(err, ErrBudgetExceeded) && len(allFindings) > 0 {
+			// Stop researching and write the report from what was found so far
+			log.Printf("run %s: %v; writing the report from %d of %d questions", run.ID, err, len(allFindings), len(keyQuestions))
+			truncated = true
+		} else if err != nil {
 			return nil, err
 		}
 
 		// Phase 5: Synthesis and final report generation
-		detailedReport, summary, err := synthesisPhase(ctx, g, input, researchPlan, allFindings, planningResult.ChapterStructure, language)
+		phaseCtx, end = startPhase(withFinalAllowance(ctx), PhaseSynthesis)
+		synthesis, summary, err := synthesisPhase(phaseCtx, g, input, researchPlan, allFindings, run.Planning.ChapterStructure, language, reportType)
+		end(err)
 		if err != nil {
 			return nil, err
 		}
+		report := ReportVersion{
+			Version:          1,
+			Chapters:         synthesis.Chapters,
+			StructureChanges: synthesis.StructureChanges,
+			Summary:          summary,
+			CreatedAt:        time.Now(),
+			CreatedBy:        Caller(ctx),
+		}
+		run.Reports = append(run.Reports, report)
 
 		// Create the result object
-		result := &DeepResearchResult{
+		run.Result = &DeepResearchResult{
 			Topic:           input.Topic,
+			RunID:           run.ID,
+			ReportVersion:   report.Version,
 			ResearchPlan:    researchPlan,
 			KeyQuestions:    keyQuestions,
-			DetailedReport:  detailedReport,
+			DetailedReport:  formatReport(synthesis),
 			Sources:         sources,
+			Coverage:        coverage,
 			Summary:         summary,
 			Recommendations: summary, // In practice, you'd parse this separately
+			BudgetTruncated: truncated,
 		}
+	}
 
-		// Phase 6: Report delivery to user using ask-me tool
-		err = reportDeliveryPhase(ctx, g, result, toolRefs, language)
-		if err != nil {
+	// Phase 6: Optional draft review with chapter-level feedback
+	if input.Review {
+		phaseCtx, end := startPhase(ctx, PhaseDraftReview)
+		err := draftReviewPhase(phaseCtx, g, cfg, run, reply, tools.refs(PhaseDraftReview, toolRefs), reportType)
+		end(err)
+		if errors.Is(err, errPaused) {
+			return pauseRun(ctx, cfg, run, PhaseDraftReview)
+		}
+		if errors.Is(err, ErrBudgetExceeded) {
+			// Deliver the latest version instead of revising further
+			log.Printf("run %s: %v; delivering report version %d without further review", run.ID, err, run.Result.ReportVersion)
+			run.Result.BudgetTruncated = true
+		} else if err != nil {
 			return nil, err
 		}
+	}
 
-		return result, nil
-	})
+	result := run.Result
+	result.Status = RunCompleted
+	result.PendingQuestion = ""
+
+	// Phase 7: Report delivery to user using ask-me tool
+	phaseCtx, end := startPhase(withFinalAllowance(ctx), PhaseReportDelivery)
+	err := reportDeliveryPhase(phaseCtx, g, result, tools.refs(PhaseReportDelivery, toolRefs), language)
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+
+	result.OutputRepairs = outputs.snapshot()
+	result.Usage = runStateFrom(ctx).usage.snapshot()
+	result.Cache = runStateFrom(ctx).caching.snapshot()
+	logUsage(ctx, run, result.Usage)
+	if cfg.Runs != nil {
+		run.Status = RunCompleted
+		run.OutputRepairs = result.OutputRepairs
+		run.Usage = result.Usage
+		run.Cache = result.Cache
+		run.Elapsed = runStateFrom(ctx).budget.elapsed()
+		if err := saveRun(ctx, cfg.Runs, run); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// pauseRun saves a run stopped at a question and returns what is known so far
+// together with the question
+func pauseRun(ctx context.Context, cfg DeepResearchConfig, run *Run, phase string) (*DeepResearchResult, error) {
+	if cfg.Runs == nil {
+		return nil, phaseError(phase, errors.New("cannot pause a run without a run store"))
+	}
+	run.Status = RunPaused
+	recordProgress(ctx, run)
+	if err := saveRun(ctx, cfg.Runs, run); err != nil {
+		return nil, err
+	}
+
+	result := &DeepResearchResult{
+		Topic:        run.Input.Topic,
+		RunID:        run.ID,
+		KeyQuestions: []string{},
+		Sources:      []string{},
+	}
+	if run.Planning != nil {
+		result.KeyQuestions = append(result.KeyQuestions, run.Planning.KeyQuestions...)
+	}
+	// A draft under review is shown along with the question
+	if run.Result != nil {
+		draft := *run.Result
+		result = &draft
+	}
+	result.Status = RunPaused
+	result.PendingQuestion = run.pendingQuestion()
+	result.OutputRepairs = run.OutputRepairs
+	result.Usage = run.Usage
+	result.Cache = run.Cache
+	return result, nil
+}
+
+// recordProgress copies the repair counts, token usage, cache stats and
+// working time of the run's requests so far into run. Outside the run's
+// context there is nothing to copy.
+func recordProgress(ctx context.Context, run *Run) {
+	state := runStateFrom(ctx)
+	if state.usage == nil {
+		return
+	}
+	run.OutputRepairs = state.outputs.snapshot()
+	run.Usage = state.usage.snapshot()
+	run.Cache = state.caching.snapshot()
+	if state.budget != nil {
+		run.Elapsed = state.budget.elapsed()
+	}
+}
+
+// failRun records a run whose request failed. A run still waiting on a
+// question stays paused, since the reply can be sent again if it was never
+// processed.
+func failRun(ctx context.Context, runs RunStore, run *Run) {
+	if runs == nil {
+		return
+	}
+	recordProgress(ctx, run)
+	logUsage(ctx, run, run.Usage)
+	run.Status = RunFailed
+	if run.pendingQuestion() != "" {
+		run.Status = RunPaused
+	}
+	if err := saveRun(ctx, runs, run); err != nil {
+		log.Printf("failed to record the state of run %s: %v", run.ID, err)
+	}
+}
+
+// saveRun stores the run, ending the claim of the request that changed it
+func saveRun(ctx context.Context, runs RunStore, run *Run) error {
+	run.ClaimedUntil = time.Time{}
+	run.UpdatedAt = time.Now()
+	run.UpdatedBy = Caller(ctx)
+	if err := runs.Save(ctx, run); err != nil {
+		return fmt.Errorf("%w: failed to save run %s: %w", ErrInternal, run.ID, err)
+	}
+	return nil
 }
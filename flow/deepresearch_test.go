@@ -0,0 +1,110 @@
+package flow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+// scriptDeepResearch scripts every phase of a successful run with two key questions
+func scriptDeepResearch(g *genkit.Genkit, fake *fakemodel.Plugin) {
+	fake.On(fakemodel.Prompt(g, "planning"), fakemodel.JSON(PlanningResult{
+		KeyQuestions:     []string{"What is Go?", "Who uses Go?"},
+		ResearchApproach: "web search",
+		Scope:            "overview",
+		Objectives:       "understand Go",
+		ChapterStructure: []ChapterInfo{{Title: "概要", Description: "overview", Importance: "high", Questions: []int{1, 2}}},
+	}))
+	fake.On(fakemodel.Prompt(g, "plan_confirmation"), fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+	fake.On(fakemodel.Prompt(g, "research"), fakemodel.JSON(ResearchResult{
+		Findings:   "Go is a programming language",
+		SourceUrls: []string{"https://go.dev"},
+	}))
+	fake.On(fakemodel.Prompt(g, "synthesis"), fakemodel.JSON(SynthesisResult{
+		Chapters: []ChapterContent{{Title: "概要", Content: "Go is simple.", Importance: "high"}},
+	}))
+	fake.On(fakemodel.Prompt(g, "summary"), fakemodel.JSON(SummaryResult{
+		KeyPoints:       []string{"Go is simple"},
+		Recommendations: []string{"Try Go"},
+	}))
+	fake.On(fakemodel.Prompt(g, "report_delivery"), fakemodel.JSON(map[string]any{"completed": true}))
+}
+
+func TestDeepResearchFlow(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	got, err := DeepResearchFlow(g, user.Tools(), DeepResearchConfig{}).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	if len(got.KeyQuestions) != 2 {
+		t.Errorf("key questions = %v, want 2", got.KeyQuestions)
+	}
+	if len(got.Sources) != 2 || got.Sources[0] != "https://go.dev" {
+		t.Errorf("sources = %v", got.Sources)
+	}
+	if !strings.Contains(got.DetailedReport, "Go is simple.") {
+		t.Errorf("detailed report missing chapter content: %q", got.DetailedReport)
+	}
+	if !strings.Contains(got.Summary, "Try Go") {
+		t.Errorf("summary missing recommendation: %q", got.Summary)
+	}
+	if !strings.Contains(got.ResearchPlan, "understand Go") {
+		t.Errorf("research plan = %q", got.ResearchPlan)
+	}
+}
+
+func TestDeepResearchFlowReportType(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	fake.On(fakemodel.Prompt(g, "planning"), fakemodel.JSON(PlanningResult{
+		KeyQuestions:     []string{"How big is the market?"},
+		ChapterStructure: []ChapterInfo{{Title: "付録", Description: "extra", Importance: "low"}},
+	}))
+	fake.On(fakemodel.Prompt(g, "synthesis"), fakemodel.JSON(SynthesisResult{
+		Chapters: []ChapterContent{{Title: "市場概要", Content: "The EV market is growing.", Importance: "high"}},
+	}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{ReportTypeDir: testReportTypeDir}
+	_, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "EV", ReportType: ReportTypeMarket})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	planningRequest := fakemodel.RequestText(fake.Calls()[0])
+	if !strings.Contains(planningRequest, "市場規模・成長率・セグメント") || strings.Contains(planningRequest, "技術調査: 概要") {
+		t.Errorf("planning prompt did not use the market guidance:\n%s", planningRequest)
+	}
+
+	var synthesisRequest string
+	for _, req := range fake.Calls() {
+		if text := fakemodel.RequestText(req); strings.Contains(text, "推計値と実績値を区別") {
+			synthesisRequest = text
+		}
+	}
+	if synthesisRequest == "" {
+		t.Fatal("synthesis prompt did not use the market guidance")
+	}
+	// The required skeleton comes first and the planner's extra chapter is kept
+	if i, j := strings.Index(synthesisRequest, "1. 市場概要"), strings.Index(synthesisRequest, "付録"); i < 0 || j < i {
+		t.Errorf("chapter skeleton not applied:\n%s", synthesisRequest)
+	}
+}
+
+func TestDeepResearchFlowUnknownReportType(t *testing.T) {
+	g, _ := newTestGenkit(t)
+
+	_, err := DeepResearchFlow(g, nil, DeepResearchConfig{}).Run(context.Background(), &DeepResearchInput{Topic: "Go", ReportType: "poetry"})
+	if err == nil || !strings.Contains(err.Error(), "reportType") {
+		t.Fatalf("err = %v, want reportType validation error", err)
+	}
+}
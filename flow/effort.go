@@ -0,0 +1,203 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Chapter importance levels, as set by the planner
+const (
+	ImportanceHigh   = "high"
+	ImportanceMedium = "medium"
+	ImportanceLow    = "low"
+)
+
+var importances = []string{ImportanceHigh, ImportanceMedium, ImportanceLow}
+
+// ResearchEffort is how much research goes into a question
+type ResearchEffort struct {
+	// Queries is how many searches are run per question. Models with built-in
+	// search are asked for at least this many.
+	Queries int
+	// SearchResults caps the results fetched per query for models without built-in search
+	SearchResults int
+	// MaxOutputTokens limits the findings written per question, unless the
+	// research phase's model config sets a lower limit
+	MaxOutputTokens int
+	// MinSources is how many sources a chapter needs before it is not reported as thin
+	MinSources int
+}
+
+// ResearchEffortSettings overrides the fields of a ResearchEffort that are
+// set, so that an explicit zero such as "minSources: 0" is kept
+type ResearchEffortSettings struct {
+	Queries         *int `yaml:"queries"`
+	SearchResults   *int `yaml:"searchResults"`
+	MaxOutputTokens *int `yaml:"maxOutputTokens"`
+	MinSources      *int `yaml:"minSources"`
+}
+
+// ResearchEffortConfig holds the effort settings per chapter importance
+type ResearchEffortConfig map[string]ResearchEffortSettings
+
+// DefaultResearchEffort spends most on high-importance chapters. Questions
+// that no chapter claims are researched at medium effort.
+var DefaultResearchEffort = map[string]ResearchEffort{
+	ImportanceHigh:   {Queries: 3, SearchResults: 12, MaxOutputTokens: 8192, MinSources: 3},
+	ImportanceMedium: {Queries: 2, SearchResults: 8, MaxOutputTokens: 4096, MinSources: 1},
+	ImportanceLow:    {Queries: 1, SearchResults: 4, MaxOutputTokens: 2048, MinSources: 0},
+}
+
+// Validate rejects unknown importance levels and out-of-range settings
+func (c ResearchEffortConfig) Validate() error {
+	for importance, e := range c {
+		if !slices.Contains(importances, importance) {
+			return fmt.Errorf("unknown importance %q in researchEffort, want one of %v", importance, importances)
+		}
+		for key, v := range map[string]*int{"queries": e.Queries, "searchResults": e.SearchResults, "maxOutputTokens": e.MaxOutputTokens} {
+			if v != nil && *v < 1 {
+				return fmt.Errorf("researchEffort.%s.%s must be at least 1, got %d", importance, key, *v)
+			}
+		}
+		if e.MinSources != nil && *e.MinSources < 0 {
+			return fmt.Errorf("researchEffort.%s.minSources must not be negative, got %d", importance, *e.MinSources)
+		}
+	}
+	return nil
+}
+
+// For returns the effort for importance, taking the fields left unset from DefaultResearchEffort
+func (c ResearchEffortConfig) For(importance string) ResearchEffort {
+	if !slices.Contains(importances, importance) {
+		importance = ImportanceMedium
+	}
+	e, set := DefaultResearchEffort[importance], c[importance]
+	if set.Queries != nil {
+		e.Queries = *set.Queries
+	}
+	if set.SearchResults != nil {
+		e.SearchResults = *set.SearchResults
+	}
+	if set.MaxOutputTokens != nil {
+		e.MaxOutputTokens = *set.MaxOutputTokens
+	}
+	if set.MinSources != nil {
+		e.MinSources = *set.MinSources
+	}
+	return e
+}
+
+// ChapterCoverage tells how well the research covered a chapter
+type ChapterCoverage struct {
+	Title      string `json:"title"`
+	Importance string `json:"importance"`
+	// Questions counts the key questions mapped to the chapter
+	Questions int `json:"questions"`
+	// Answered counts the mapped questions that produced findings
+	Answered int `json:"answered"`
+	Sources  int `json:"sources"`
+	// Thin chapters have unanswered questions or fewer sources than their importance calls for
+	Thin bool `json:"thin"`
+	// Unmapped chapters have no key question mapped to them, so the research
+	// did not look for them in particular; they are not reported as thin
+	Unmapped bool `json:"unmapped,omitempty"`
+}
+
+// questionImportance returns, per key question, the highest importance of
+// the chapters that answer it; questions no chapter claims get medium
+func questionImportance(questions []string, chapters []ChapterInfo) []string {
+	levels := make([]string, len(questions))
+	for i := range levels {
+		levels[i] = ImportanceMedium
+	}
+	claimed := make([]bool, len(questions))
+	for _, chapter := range chapters {
+		for _, q := range chapter.Questions {
+			if q < 1 || q > len(questions) {
+				continue
+			}
+			i := q - 1
+			if !claimed[i] || higherImportance(chapter.Importance, levels[i]) {
+				levels[i] = chapter.Importance
+				claimed[i] = true
+			}
+		}
+	}
+	for i, level := range levels {
+		if !slices.Contains(importances, level) {
+			levels[i] = ImportanceMedium
+		}
+	}
+	return levels
+}
+
+// higherImportance reports whether a ranks above b
+func higherImportance(a, b string) bool {
+	ai, bi := slices.Index(importances, a), slices.Index(importances, b)
+	return ai >= 0 && (bi < 0 || ai < bi)
+}
+
+// researchQueries returns up to n search queries for a question: the
+// question itself, then the question narrowed to each chapter using it
+func researchQueries(question string, questionNumber int, chapters []ChapterInfo, n int) []string {
+	queries := []string{question}
+	for _, chapter := range chapters {
+		if len(queries) >= n {
+			break
+		}
+		if slices.Contains(chapter.Questions, questionNumber) {
+			queries = append(queries, question+" "+chapter.Title)
+		}
+	}
+	return queries
+}
+
+// chapterCoverage summarizes, per chapter, what the research found for its questions
+func chapterCoverage(chapters []ChapterInfo, answered []bool, questionSources [][]string, effort ResearchEffortConfig) []ChapterCoverage {
+	coverage := make([]ChapterCoverage, len(chapters))
+	for i, chapter := range chapters {
+		c := ChapterCoverage{Title: chapter.Title, Importance: chapter.Importance}
+		var sources []string
+		for _, q := range chapter.Questions {
+			if q < 1 || q > len(answered) {
+				continue
+			}
+			c.Questions++
+			if answered[q-1] {
+				c.Answered++
+			}
+			for _, source := range questionSources[q-1] {
+				if !slices.Contains(sources, source) {
+					sources = append(sources, source)
+				}
+			}
+		}
+		c.Sources = len(sources)
+		c.Unmapped = c.Questions == 0
+		c.Thin = !c.Unmapped && (c.Answered < c.Questions || c.Sources < effort.For(chapter.Importance).MinSources)
+		if c.Unmapped {
+			log.Printf("research coverage: no key question is mapped to chapter %q", c.Title)
+		}
+		if c.Thin && chapter.Importance == ImportanceHigh {
+			log.Printf("research coverage: high-importance chapter %q is thin (%d/%d questions answered, %d sources)", c.Title, c.Answered, c.Questions, c.Sources)
+		}
+		coverage[i] = c
+	}
+	return coverage
+}
+
+// withOutputLimit caps the output tokens of the phase's prompts to tokens,
+// unless the run's model config already sets a lower limit
+func withOutputLimit(ctx context.Context, phase string, tokens int) context.Context {
+	if tokens <= 0 {
+		return ctx
+	}
+	run := *runStateFrom(ctx)
+	if limit := run.models.For(phase).MaxOutputTokens; limit != nil && *limit <= tokens {
+		return ctx
+	}
+	run.models = run.models.Merge(ModelConfig{phase: {MaxOutputTokens: &tokens}})
+	return withRunState(ctx, &run)
+}
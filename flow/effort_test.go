@@ -0,0 +1,104 @@
+package flow
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+)
+
+func TestQuestionImportance(t *testing.T) {
+	chapters := []ChapterInfo{
+		{Title: "概要", Importance: ImportanceLow, Questions: []int{1, 2}},
+		{Title: "課題", Importance: ImportanceHigh, Questions: []int{2, 9}},
+	}
+
+	got := questionImportance([]string{"q1", "q2", "q3"}, chapters)
+	want := []string{ImportanceLow, ImportanceHigh, ImportanceMedium}
+	if !slices.Equal(got, want) {
+		t.Errorf("importance = %v, want %v", got, want)
+	}
+}
+
+func TestResearchPhaseAllocatesEffortByImportance(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	local := fakemodel.New("local", "llama3.1")
+	genkit.RegisterAction(g, local.Init(context.Background())[0])
+	local.On(fakemodel.Contains("q1"), fakemodel.JSON(ResearchResult{Findings: "deep", SourceUrls: []string{"https://a", "https://b", "https://c"}}))
+	local.On(fakemodel.Contains("q2"), fakemodel.JSON(ResearchResult{Findings: "", SourceUrls: []string{}}))
+
+	chapters := []ChapterInfo{
+		{Title: "市場", Importance: ImportanceHigh, Questions: []int{1}},
+		{Title: "将来", Importance: ImportanceHigh, Questions: []int{2}},
+		{Title: "付録", Importance: ImportanceLow},
+	}
+	searcher := &stubSearch{}
+	queries := 2
+	ctx := withRunState(context.Background(), &runState{
+		models: ModelConfig{PhaseResearch: {Model: "local/llama3.1"}},
+		retry:  testRetryPolicy,
+		effort: ResearchEffortConfig{ImportanceHigh: {Queries: &queries}},
+	})
+
+	_, _, coverage, err := researchPhase(ctx, g, []string{"q1", "q2"}, chapters, "日本語", searcher)
+	if err != nil {
+		t.Fatalf("researchPhase failed: %v", err)
+	}
+
+	wantQueries := []string{"q1", "q1 市場", "q2", "q2 将来"}
+	if !slices.Equal(searcher.queries, wantQueries) {
+		t.Errorf("queries = %q, want %q", searcher.queries, wantQueries)
+	}
+	if searcher.limits[0] != DefaultResearchEffort[ImportanceHigh].SearchResults {
+		t.Errorf("search limit = %d, want the high-importance default", searcher.limits[0])
+	}
+	config, _ := local.Calls()[0].Config.(map[string]any)
+	if config["max_tokens"] != DefaultResearchEffort[ImportanceHigh].MaxOutputTokens {
+		t.Errorf("research config = %v, want the high-importance token budget", config)
+	}
+
+	want := []ChapterCoverage{
+		{Title: "市場", Importance: ImportanceHigh, Questions: 1, Answered: 1, Sources: 3, Thin: false},
+		{Title: "将来", Importance: ImportanceHigh, Questions: 1, Answered: 0, Sources: 0, Thin: true},
+		{Title: "付録", Importance: ImportanceLow, Unmapped: true},
+	}
+	if !slices.Equal(coverage, want) {
+		t.Errorf("coverage = %+v, want %+v", coverage, want)
+	}
+}
+
+func TestWithOutputLimitKeepsLowerConfiguredLimit(t *testing.T) {
+	limit := 100
+	ctx := withRunState(context.Background(), &runState{models: ModelConfig{PhaseResearch: {MaxOutputTokens: &limit}}})
+
+	if got := *runStateFrom(withOutputLimit(ctx, PhaseResearch, 4096)).models.For(PhaseResearch).MaxOutputTokens; got != 100 {
+		t.Errorf("max output tokens = %d, want the configured 100", got)
+	}
+	if got := *runStateFrom(withOutputLimit(ctx, PhaseResearch, 50)).models.For(PhaseResearch).MaxOutputTokens; got != 50 {
+		t.Errorf("max output tokens = %d, want the effort's 50", got)
+	}
+}
+
+func TestResearchEffortConfigFor(t *testing.T) {
+	zero, queries := 0, 5
+	cfg := ResearchEffortConfig{ImportanceHigh: {Queries: &queries, MinSources: &zero}}
+
+	want := DefaultResearchEffort[ImportanceHigh]
+	want.Queries, want.MinSources = 5, 0
+	if got := cfg.For(ImportanceHigh); got != want {
+		t.Errorf("high = %+v, want %+v with the explicit zero kept", got, want)
+	}
+	if got := cfg.For("unknown"); got != DefaultResearchEffort[ImportanceMedium] {
+		t.Errorf("unknown importance = %+v, want the medium default", got)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate rejected %+v: %v", cfg, err)
+	}
+	if err := (ResearchEffortConfig{ImportanceLow: {Queries: &zero}}).Validate(); err == nil {
+		t.Error("Validate accepted zero queries")
+	}
+}
@@ -0,0 +1,86 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+
+	"research/internal/toolcall"
+	mcpconfig "research/mcp"
+)
+
+// Causes of a failed flow run. Match them with errors.Is; the failing phase
+// is available through errors.As with *PhaseError.
+var (
+	ErrInvalidInput     = errors.New("invalid input")
+	ErrPromptNotFound   = errors.New("prompt not found")
+	ErrUserTimeout      = errors.New("user did not reply in time")
+	ErrNotApproved      = errors.New("plan was not approved")
+	ErrModelRefused     = errors.New("model refused to respond")
+	ErrRateLimited      = errors.New("model rate limit exceeded")
+	ErrModelUnavailable = errors.New("model unavailable")
+	ErrModelRequest     = errors.New("model rejected the request")
+	ErrInvalidOutput    = errors.New("model output could not be parsed")
+	ErrToolFailed       = errors.New("tool call failed")
+	ErrCanceled         = errors.New("run canceled")
+	ErrInternal         = errors.New("internal error")
+)
+
+// PhaseError is a failure of one research phase with its classified cause
+type PhaseError struct {
+	Phase string
+	Cause error
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s phase failed: %v", e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() []error {
+	return []error{e.Cause, e.Err}
+}
+
+// phaseError wraps err with the cause derived from it
+func phaseError(phase string, err error) *PhaseError {
+	return &PhaseError{Phase: phase, Cause: causeOf(err), Err: err}
+}
+
+// promptNotFound reports a prompt file missing from the prompt directory
+func promptNotFound(phase, name string) *PhaseError {
+	return &PhaseError{Phase: phase, Cause: ErrPromptNotFound, Err: fmt.Errorf("%s prompt not found", name)}
+}
+
+// invalidOutput reports a model response that does not match the prompt's output schema
+func invalidOutput(phase string, err error) *PhaseError {
+	return &PhaseError{Phase: phase, Cause: ErrInvalidOutput, Err: fmt.Errorf("failed to parse %s result: %w", phase, err)}
+}
+
+// causeOf maps an error from a prompt execution onto one of the Err sentinels
+func causeOf(err error) error {
+	var toolErr *toolcall.Error
+	switch {
+	case errors.Is(err, ErrBudgetExceeded):
+		return ErrBudgetExceeded
+	case errors.Is(err, ErrInvalidOutput):
+		return ErrInvalidOutput
+	case errors.Is(err, mcpconfig.ErrReplyTimeout):
+		return ErrUserTimeout
+	case errors.As(err, &toolErr):
+		return ErrToolFailed
+	}
+
+	switch ClassifyError(err) {
+	case ErrorClassSafety:
+		return ErrModelRefused
+	case ErrorClassRateLimit:
+		return ErrRateLimited
+	case ErrorClassInternal:
+		return ErrModelUnavailable
+	case ErrorClassInvalidArgument:
+		return ErrModelRequest
+	case ErrorClassCanceled:
+		return ErrCanceled
+	default:
+		return ErrInternal
+	}
+}
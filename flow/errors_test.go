@@ -0,0 +1,53 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/firebase/genkit/go/core"
+	"google.golang.org/genai"
+
+	"research/internal/toolcall"
+	mcpconfig "research/mcp"
+)
+
+func TestCauseOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{&toolcall.Error{Tool: "ask-me_chat", Err: fmt.Errorf("failed to wait for reply: %w", mcpconfig.ErrReplyTimeout)}, ErrUserTimeout},
+		{&toolcall.Error{Tool: "ask-me_chat", Err: errors.New("slack: channel_not_found")}, ErrToolFailed},
+		{core.NewError(core.INTERNAL, "model failed to generate output matching expected schema: missing approved"), ErrModelUnavailable},
+		{&ModelError{Class: ErrorClassSafety, Attempts: 1, Err: errBlocked}, ErrModelRefused},
+		{&ModelError{Class: ErrorClassRateLimit, Attempts: 4, Err: genai.APIError{Code: 429}}, ErrRateLimited},
+		{&ModelError{Class: ErrorClassInternal, Attempts: 4, Err: genai.APIError{Code: 503}}, ErrModelUnavailable},
+		{genai.APIError{Code: 400, Status: "INVALID_ARGUMENT"}, ErrModelRequest},
+		{fmt.Errorf("iteration 1: %w", context.Canceled), ErrCanceled},
+		{errors.New("something else"), ErrInternal},
+	}
+	for _, tt := range tests {
+		if got := causeOf(tt.err); got != tt.want {
+			t.Errorf("causeOf(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPhaseErrorMatchesCauseAndUnderlyingError(t *testing.T) {
+	underlying := genai.APIError{Code: 429}
+	err := fmt.Errorf("wrapped: %w", phaseError(PhaseResearch, underlying))
+
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("err = %v, want ErrRateLimited", err)
+	}
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 429 {
+		t.Errorf("err = %v, want the underlying APIError", err)
+	}
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseResearch {
+		t.Errorf("err = %v, want a research PhaseError", err)
+	}
+}
@@ -0,0 +1,37 @@
+package flow
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+)
+
+// testReportTypeDir holds the repo's report types, seen from the package directory
+var testReportTypeDir = filepath.Join("..", "prompts", "report_types")
+
+// newTestGenkit initialises Genkit with the repo prompts and a fake model
+// standing in for the Gemini model the prompt files pin.
+func newTestGenkit(t *testing.T) (*genkit.Genkit, *fakemodel.Plugin) {
+	t.Helper()
+
+	fake := fakemodel.New("googleai", "gemini-2.5-flash-lite", "gemini-2.5-pro")
+	g := genkit.Init(context.Background(),
+		genkit.WithPlugins(fake),
+		genkit.WithDefaultModel("googleai/gemini-2.5-flash-lite"),
+		genkit.WithPromptDir(filepath.Join("..", "prompts")),
+	)
+	return g, fake
+}
+
+func toolRefs(tools []ai.Tool) []ai.ToolRef {
+	refs := make([]ai.ToolRef, len(tools))
+	for i, tool := range tools {
+		refs[i] = tool
+	}
+	return refs
+}
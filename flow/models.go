@@ -0,0 +1,263 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core/api"
+
+	"research/internal/toolcall"
+)
+
+// Research phases, named after the prompt each one executes
+const (
+	PhaseClarification    = "clarification"
+	PhasePlanning         = "planning"
+	PhasePlanConfirmation = "plan_confirmation"
+	PhaseResearch         = "research"
+	PhaseSynthesis        = "synthesis"
+	PhaseSummary          = "summary"
+	PhaseDraftReview      = "draft_review"
+	PhaseReportDelivery   = "report_delivery"
+)
+
+// PhaseDefault is the ModelConfig key applied to every phase without its own entry
+const PhaseDefault = "default"
+
+var phases = []string{
+	PhaseClarification,
+	PhasePlanning,
+	PhasePlanConfirmation,
+	PhaseResearch,
+	PhaseSynthesis,
+	PhaseSummary,
+	PhaseDraftReview,
+	PhaseReportDelivery,
+}
+
+// PhaseModel overrides the model and generation config a phase's prompt pins
+type PhaseModel struct {
+	Model           string   `json:"model,omitempty" yaml:"model" jsonschema:"description=モデル名 (例: googleai/gemini-2.5-pro)"`
+	Temperature     *float64 `json:"temperature,omitempty" yaml:"temperature"`
+	MaxOutputTokens *int     `json:"maxOutputTokens,omitempty" yaml:"maxOutputTokens"`
+}
+
+// ModelConfig maps a phase name, or "default", to its model settings
+type ModelConfig map[string]PhaseModel
+
+// Validate rejects unknown phases and out-of-range generation settings
+func (c ModelConfig) Validate() error {
+	for phase, m := range c {
+		if phase != PhaseDefault && !isPhase(phase) {
+			return fmt.Errorf("unknown phase %q in model config", phase)
+		}
+		if m.Temperature != nil && (*m.Temperature < 0 || *m.Temperature > 2) {
+			return fmt.Errorf("temperature for phase %q must be between 0 and 2, got %v", phase, *m.Temperature)
+		}
+		if m.MaxOutputTokens != nil && *m.MaxOutputTokens <= 0 {
+			return fmt.Errorf("maxOutputTokens for phase %q must be positive, got %d", phase, *m.MaxOutputTokens)
+		}
+	}
+	return nil
+}
+
+// Merge returns c with every field set in override taking precedence
+func (c ModelConfig) Merge(override ModelConfig) ModelConfig {
+	merged := maps.Clone(c)
+	if merged == nil {
+		merged = ModelConfig{}
+	}
+	for phase, o := range override {
+		m := merged[phase]
+		if o.Model != "" {
+			m.Model = o.Model
+		}
+		if o.Temperature != nil {
+			m.Temperature = o.Temperature
+		}
+		if o.MaxOutputTokens != nil {
+			m.MaxOutputTokens = o.MaxOutputTokens
+		}
+		merged[phase] = m
+	}
+	return merged
+}
+
+// For resolves the settings of a phase, falling back field by field to "default"
+func (c ModelConfig) For(phase string) PhaseModel {
+	return ModelConfig{PhaseDefault: c[PhaseDefault]}.Merge(ModelConfig{PhaseDefault: c[phase]})[PhaseDefault]
+}
+
+func isPhase(name string) bool {
+	for _, p := range phases {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// phaseOptions turns the phase's model settings into prompt options
+func phaseOptions(ctx context.Context, p ai.Prompt, phase string) []ai.PromptExecuteOption {
+	var opts []ai.PromptExecuteOption
+	if m := runStateFrom(ctx).models.For(phase).Model; m != "" {
+		opts = append(opts, ai.WithModelName(m))
+	}
+	if config := phaseConfig(ctx, p, phase); config != nil {
+		opts = append(opts, ai.WithConfig(config))
+	}
+	return opts
+}
+
+// phaseConfig returns the generation config for the phase, or nil to keep the
+// prompt's own. The prompt's config is kept and only overlaid, so settings
+// such as the research prompt's googleSearch tool survive a temperature
+// override. When the phase runs on a model without built-in search, those
+// Gemini-only tools are dropped instead.
+func phaseConfig(ctx context.Context, p ai.Prompt, phase string) map[string]any {
+	m := runStateFrom(ctx).models.For(phase)
+
+	base := promptConfig(p)
+	model := phaseModel(ctx, p, phase)
+	builtinSearch := hasBuiltinSearch(model)
+	_, hasTools := base["tools"]
+	if m.Temperature == nil && m.MaxOutputTokens == nil && (builtinSearch || !hasTools) {
+		return nil
+	}
+
+	config := maps.Clone(base)
+	if config == nil {
+		config = map[string]any{}
+	}
+	if !builtinSearch {
+		delete(config, "tools")
+	}
+	if m.Temperature == nil && m.MaxOutputTokens == nil {
+		return config
+	}
+	key, ok := outputLimitKey(model)
+	if !ok {
+		warnIgnoredConfig(phase, model)
+		return config
+	}
+	if m.Temperature != nil {
+		config["temperature"] = *m.Temperature
+	}
+	if m.MaxOutputTokens != nil {
+		config[key] = *m.MaxOutputTokens
+	}
+	return config
+}
+
+// outputLimitKey returns the config key the model's provider reads the output
+// token limit from, or false for providers that ignore the request config
+func outputLimitKey(model string) (string, bool) {
+	provider, _, _ := strings.Cut(model, "/")
+	switch provider {
+	case "googleai", "vertexai":
+		return "maxOutputTokens", true
+	case "ollama":
+		// The Ollama plugin sends no generation options at all
+		return "", false
+	default:
+		// OpenAI-compatible servers, local ones included, name the limit max_tokens
+		return "max_tokens", true
+	}
+}
+
+// ignoredConfig records the phases and models already warned about
+var ignoredConfig sync.Map
+
+// warnIgnoredConfig logs once per phase and model that the configured
+// temperature and output limit cannot be applied
+func warnIgnoredConfig(phase, model string) {
+	if _, warned := ignoredConfig.LoadOrStore(phase+" "+model, true); !warned {
+		log.Printf("%s: model %s ignores generation config; temperature and maxOutputTokens are not applied", phase, model)
+	}
+}
+
+// promptConfig returns the generation config pinned in the prompt file
+func promptConfig(p ai.Prompt) map[string]any {
+	if meta := promptMetadata(p); meta != nil {
+		config, _ := meta["config"].(map[string]any)
+		return config
+	}
+	return nil
+}
+
+func promptMetadata(p ai.Prompt) map[string]any {
+	action, ok := p.(api.Action)
+	if !ok {
+		return nil
+	}
+	meta, _ := action.Desc().Metadata["prompt"].(map[string]any)
+	return meta
+}
+
+// phaseModel returns the model a phase's prompt will run on: the one
+// configured for the phase, else the prompt's own, else Genkit's default
+func phaseModel(ctx context.Context, p ai.Prompt, phase string) string {
+	run := runStateFrom(ctx)
+	if m := run.models.For(phase).Model; m != "" {
+		return m
+	}
+	if m := promptModel(p); m != "" {
+		return m
+	}
+	return run.defaultModel
+}
+
+// hasBuiltinSearch reports whether the model can ground answers with the googleSearch tool
+func hasBuiltinSearch(model string) bool {
+	return strings.HasPrefix(model, "googleai/") || strings.HasPrefix(model, "vertexai/")
+}
+
+// executePrompt runs a phase's prompt with the run's model settings, retry
+// policy and structured output validation applied, traced in its own span
+func executePrompt(ctx context.Context, p ai.Prompt, phase string, opts ...ai.PromptExecuteOption) (*ai.ModelResponse, error) {
+	ctx, span := startPrompt(ctx, p, phase)
+	ctx, toolFailure := toolcall.Record(ctx)
+	ctx, outputFailure := recordOutput(ctx, promptName(p))
+	opts = append(phaseOptions(ctx, p, phase), opts...)
+	resp, err := p.Execute(ctx, append(opts, ai.WithMiddleware(promptMiddleware(ctx, p, phase)...))...)
+	err = outputFailure(toolFailure(err))
+	endPrompt(span, resp, err)
+	return resp, err
+}
+
+// promptMiddleware returns the model middleware every prompt execution runs with
+func promptMiddleware(ctx context.Context, p ai.Prompt, phase string) []ai.ModelMiddleware {
+	run := runStateFrom(ctx)
+	middleware := []ai.ModelMiddleware{
+		run.tools.middleware(phase),
+		keepRequest,
+		cacheResponses(phase, promptName(p), phaseModel(ctx, p, phase), run),
+		run.retry.middleware(phase),
+		run.budget.middleware(),
+		run.limiter.middleware(phaseModel(ctx, p, phase), run.runID),
+		countUsage(phase, phaseModel(ctx, p, phase), run.usage),
+		providerErrors(phaseModel(ctx, p, phase)),
+	}
+	if schema := outputSchema(p); schema != nil {
+		// Ahead of retries, so that re-asks are retried like any other model call
+		middleware = append([]ai.ModelMiddleware{structuredOutput(promptName(p), schema, run.outputs)}, middleware...)
+	}
+	return middleware
+}
+
+// keepRequest attaches the request to responses of plugins that leave it
+// unset, so ModelResponse.History is complete for every model
+func keepRequest(next ai.ModelFunc) ai.ModelFunc {
+	return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+		resp, err := next(ctx, req, cb)
+		if err == nil && (resp.Request == nil || len(resp.Request.Messages) == 0) {
+			resp.Request = req
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,189 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+	"research/search"
+)
+
+func TestModelConfigFor(t *testing.T) {
+	low, high := 0.1, 0.9
+	tokens := 4096
+	cfg := ModelConfig{
+		PhaseDefault:   {Model: "googleai/gemini-2.5-flash-lite", Temperature: &low},
+		PhaseSynthesis: {Model: "googleai/gemini-2.5-pro", MaxOutputTokens: &tokens},
+	}.Merge(ModelConfig{
+		PhaseSynthesis: {Temperature: &high},
+	})
+
+	synthesis := cfg.For(PhaseSynthesis)
+	if synthesis.Model != "googleai/gemini-2.5-pro" || *synthesis.Temperature != high || *synthesis.MaxOutputTokens != tokens {
+		t.Errorf("synthesis = %+v", synthesis)
+	}
+	research := cfg.For(PhaseResearch)
+	if research.Model != "googleai/gemini-2.5-flash-lite" || *research.Temperature != low || research.MaxOutputTokens != nil {
+		t.Errorf("research = %+v", research)
+	}
+}
+
+func TestModelConfigValidate(t *testing.T) {
+	hot := 3.0
+	if err := (ModelConfig{"reserch": {}}).Validate(); err == nil {
+		t.Error("expected unknown phase to be rejected")
+	}
+	if err := (ModelConfig{PhaseResearch: {Temperature: &hot}}).Validate(); err == nil {
+		t.Error("expected out-of-range temperature to be rejected")
+	}
+}
+
+func TestDeepResearchFlowPerPhaseModels(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	cold := 0.0
+	flow := DeepResearchFlow(g, user.Tools(), DeepResearchConfig{Models: ModelConfig{
+		PhaseSynthesis: {Model: "googleai/gemini-2.5-pro"},
+	}})
+	_, err := flow.Run(context.Background(), &DeepResearchInput{
+		Topic:  "Go",
+		Models: ModelConfig{PhaseResearch: {Temperature: &cold}},
+	})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	pro := fake.CallsTo("googleai/gemini-2.5-pro")
+	if len(pro) != 1 || !fakemodel.Prompt(g, "synthesis")(pro[0]) {
+		t.Fatalf("synthesis should be the only call to the pro model, got %d calls", len(pro))
+	}
+
+	isResearch := fakemodel.Prompt(g, "research")
+	researched := 0
+	for _, req := range fake.Calls() {
+		if !isResearch(req) {
+			continue
+		}
+		researched++
+		config, _ := req.Config.(map[string]any)
+		if config["temperature"] != cold {
+			t.Errorf("research temperature = %v, want %v", config["temperature"], cold)
+		}
+		// The prompt's googleSearch tool must survive the override
+		if _, ok := config["tools"]; !ok {
+			t.Errorf("research config lost the prompt's tools: %v", config)
+		}
+	}
+	if researched != 2 {
+		t.Errorf("research calls = %d, want 2", researched)
+	}
+}
+
+type stubSearch struct {
+	key     string
+	queries []string
+	limits  []int
+}
+
+func (s *stubSearch) CacheKey() string { return "stub " + s.key }
+
+func (s *stubSearch) Search(ctx context.Context, query string, limit int) ([]search.Result, error) {
+	s.queries = append(s.queries, query)
+	s.limits = append(s.limits, limit)
+	return []search.Result{{Title: "Local result", URL: "https://example.com/local", Snippet: "found offline"}}, nil
+}
+
+func TestResearchPhaseFallsBackToSearchProvider(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	local := fakemodel.New("ollama", "llama3.1")
+	genkit.RegisterAction(g, local.Init(context.Background())[0])
+	local.On(fakemodel.Prompt(g, "research"), fakemodel.JSON(ResearchResult{
+		Findings:   "from search results",
+		SourceUrls: []string{"https://example.com/local"},
+	}))
+
+	searcher := &stubSearch{}
+	ctx := withRunState(context.Background(), &runState{models: ModelConfig{PhaseResearch: {Model: "ollama/llama3.1"}}, retry: testRetryPolicy})
+	findings, sources, _, err := researchPhase(ctx, g, []string{"What is Go?"}, nil, "日本語", searcher)
+	if err != nil {
+		t.Fatalf("researchPhase failed: %v", err)
+	}
+
+	if len(fake.Calls()) != 0 {
+		t.Errorf("Gemini was called %d times, want 0", len(fake.Calls()))
+	}
+	if len(searcher.queries) != 1 || searcher.queries[0] != "What is Go?" {
+		t.Errorf("search queries = %q", searcher.queries)
+	}
+	calls := local.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("local model calls = %d, want 1", len(calls))
+	}
+	if !strings.Contains(fakemodel.RequestText(calls[0]), "found offline") {
+		t.Error("search results were not passed to the local model")
+	}
+	if config, _ := calls[0].Config.(map[string]any); config["tools"] != nil {
+		t.Errorf("Gemini-only tools leaked into local model config: %v", config)
+	}
+	if len(findings) != 1 || len(sources) != 1 || sources[0] != "https://example.com/local" {
+		t.Errorf("findings = %q, sources = %q", findings, sources)
+	}
+}
+
+func TestPhaseConfigFollowsProvider(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	p := genkit.LookupPrompt(g, "research")
+	warm, tokens := 0.5, 1024
+
+	for model, want := range map[string]map[string]any{
+		"googleai/gemini-2.5-pro": {"temperature": warm, "maxOutputTokens": tokens},
+		"local/llama3.1":          {"temperature": warm, "max_tokens": tokens},
+		"ollama/llama3.1":         {"temperature": promptConfig(p)["temperature"]},
+	} {
+		ctx := withRunState(context.Background(), &runState{models: ModelConfig{
+			PhaseResearch: {Model: model, Temperature: &warm, MaxOutputTokens: &tokens},
+		}})
+		config := phaseConfig(ctx, p, PhaseResearch)
+		for _, key := range []string{"temperature", "maxOutputTokens", "max_tokens"} {
+			if config[key] != want[key] {
+				t.Errorf("%s: config[%q] = %v, want %v", model, key, config[key], want[key])
+			}
+		}
+	}
+}
+
+type failingSearch struct{ calls int }
+
+func (s *failingSearch) CacheKey() string { return "failing" }
+
+func (s *failingSearch) Search(ctx context.Context, query string, limit int) ([]search.Result, error) {
+	s.calls++
+	return nil, errors.New("connection refused")
+}
+
+func TestResearchPhaseAnswersWithoutSearchWhenSearchFails(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	local := fakemodel.New("local", "llama3.1")
+	genkit.RegisterAction(g, local.Init(context.Background())[0])
+	local.On(fakemodel.Prompt(g, "research"), fakemodel.JSON(ResearchResult{Findings: "from model knowledge", SourceUrls: []string{}}))
+
+	searcher := &failingSearch{}
+	ctx := withRunState(context.Background(), &runState{models: ModelConfig{PhaseResearch: {Model: "local/llama3.1"}}, retry: testRetryPolicy})
+	findings, _, _, err := researchPhase(ctx, g, []string{"What is Go?"}, nil, "日本語", searcher)
+	if err != nil {
+		t.Fatalf("researchPhase failed: %v", err)
+	}
+	if searcher.calls == 0 {
+		t.Error("search was never tried")
+	}
+	if len(findings) != 1 || !strings.Contains(findings[0], "from model knowledge") {
+		t.Errorf("findings = %q, want the model-only answer", findings)
+	}
+}
@@ -0,0 +1,342 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/core/api"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// outputReasks is how often a model is asked again after its output could not be repaired
+const outputReasks = 2
+
+// OutputRepairStats counts how often a prompt's structured output needed fixing
+type OutputRepairStats struct {
+	// Repaired responses were fixed locally, e.g. by stripping code fences
+	Repaired int `json:"repaired"`
+	// Reasked responses were sent back to the model with the validation error
+	Reasked int `json:"reasked"`
+	// Failed responses were still invalid after every re-ask
+	Failed int `json:"failed"`
+}
+
+// outputStats collects OutputRepairStats per prompt over a run
+type outputStats struct {
+	mu      sync.Mutex
+	prompts map[string]OutputRepairStats
+}
+
+func (s *outputStats) record(prompt string, update func(*OutputRepairStats)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prompts == nil {
+		s.prompts = map[string]OutputRepairStats{}
+	}
+	stats := s.prompts[prompt]
+	update(&stats)
+	s.prompts[prompt] = stats
+}
+
+// snapshot returns the collected stats, or nil when no prompt needed repair
+func (s *outputStats) snapshot() map[string]OutputRepairStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.prompts) == 0 {
+		return nil
+	}
+	snapshot := make(map[string]OutputRepairStats, len(s.prompts))
+	for prompt, stats := range s.prompts {
+		snapshot[prompt] = stats
+	}
+	return snapshot
+}
+
+// promptName returns the registered name of a prompt, including its variant
+func promptName(p ai.Prompt) string {
+	if action, ok := p.(api.Action); ok {
+		return action.Desc().Name
+	}
+	return p.Name()
+}
+
+// outputSchema returns the output schema declared in the prompt file, if any
+func outputSchema(p ai.Prompt) map[string]any {
+	output, _ := promptMetadata(p)["output"].(map[string]any)
+	schema, _ := output["schema"].(map[string]any)
+	return schema
+}
+
+// structuredOutput validates each model turn against the prompt's output
+// schema before Genkit parses it. Invalid text, including output cut off at
+// the token limit, is repaired locally where possible; otherwise the model is
+// shown the validation error and asked again.
+func structuredOutput(prompt string, schema map[string]any, stats *outputStats) ai.ModelMiddleware {
+	loader := gojsonschema.NewGoLoader(schema)
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			resp, err := next(ctx, req, cb)
+			for reask := 0; ; reask++ {
+				if err != nil {
+					return nil, err
+				}
+
+				text := resp.Text()
+				toolCall := len(resp.ToolRequests()) > 0
+				// A pure tool call carries no output yet, but Genkit parses every
+				// turn; an empty object gets it through when the schema allows one
+				if text == "" && toolCall {
+					if validateOutput(loader, "{}") == nil {
+						replaceText(resp.Message, "{}")
+					}
+					return resp, nil
+				}
+
+				verr := validateOutput(loader, text)
+				if verr == nil {
+					return resp, nil
+				}
+
+				cutOff := resp.FinishReason == ai.FinishReasonLength
+				if repaired, ok := repairJSON(text); ok && validateOutput(loader, repaired) == nil {
+					if cutOff {
+						log.Printf("%s: closed structured output cut off at the output token limit", prompt)
+					} else {
+						log.Printf("%s: repaired structured output: %v", prompt, verr)
+					}
+					stats.record(prompt, func(s *OutputRepairStats) { s.Repaired++ })
+					replaceText(resp.Message, repaired)
+					return resp, nil
+				}
+				if cutOff {
+					verr = fmt.Errorf("output was cut off at the output token limit, answer more briefly: %w", verr)
+				}
+
+				// Asking again would discard the tool call, so leave the turn as
+				// it is; Genkit then fails to parse it, see recordOutput
+				if toolCall {
+					if f, ok := ctx.Value(outputFailureKey{}).(*outputFailure); ok {
+						f.set(verr)
+					}
+					return resp, nil
+				}
+				if reask >= outputReasks {
+					stats.record(prompt, func(s *OutputRepairStats) { s.Failed++ })
+					return nil, fmt.Errorf("%w: %s: %v", ErrInvalidOutput, prompt, verr)
+				}
+
+				log.Printf("%s: asking the model again for valid structured output: %v", prompt, verr)
+				stats.record(prompt, func(s *OutputRepairStats) { s.Reasked++ })
+				resp, err = next(ctx, reaskRequest(req, resp.Message, verr), cb)
+			}
+		}
+	}
+}
+
+type outputFailureKey struct{}
+
+// outputFailure holds why structuredOutput let a turn through invalid
+type outputFailure struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (f *outputFailure) set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// recordOutput returns a context in which structuredOutput keeps the turns it
+// lets through invalid. Genkit fails to parse such a turn with an internal
+// error; the returned function makes that error wrap ErrInvalidOutput.
+func recordOutput(ctx context.Context, prompt string) (context.Context, func(error) error) {
+	f := &outputFailure{}
+	return context.WithValue(ctx, outputFailureKey{}, f), func(err error) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var genkitErr *core.GenkitError
+		if f.err == nil || !errors.As(err, &genkitErr) || genkitErr.Status != core.INTERNAL {
+			return err
+		}
+		return fmt.Errorf("%w: %s: %v: %w", ErrInvalidOutput, prompt, f.err, err)
+	}
+}
+
+// validateOutput checks text, after stripping any Markdown fence, against the schema
+func validateOutput(schema gojsonschema.JSONLoader, text string) error {
+	text = strings.TrimSpace(stripFence(text))
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return fmt.Errorf("output is not valid JSON: %w", err)
+	}
+
+	result, err := gojsonschema.Validate(schema, gojsonschema.NewGoLoader(v))
+	if err != nil {
+		return fmt.Errorf("failed to validate output: %w", err)
+	}
+	if !result.Valid() {
+		var errs []string
+		for _, e := range result.Errors() {
+			errs = append(errs, e.String())
+		}
+		return errors.New("output does not match the schema: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reaskRequest appends the invalid response and the validation error to the conversation
+func reaskRequest(req *ai.ModelRequest, invalid *ai.Message, verr error) *ai.ModelRequest {
+	retry := *req
+	retry.Messages = append(append([]*ai.Message(nil), req.Messages...),
+		invalid,
+		ai.NewUserTextMessage(fmt.Sprintf(
+			"The previous response could not be used: %v\nReply again with only a JSON value that conforms to the requested schema, without any other text.", verr)),
+	)
+	return &retry
+}
+
+// replaceText swaps the text parts of msg for a single part holding text
+func replaceText(msg *ai.Message, text string) {
+	parts := []*ai.Part{ai.NewTextPart(text)}
+	for _, part := range msg.Content {
+		if !part.IsText() {
+			parts = append(parts, part)
+		}
+	}
+	msg.Content = parts
+}
+
+// stripFence returns the body of the first Markdown code fence, or text unchanged
+func stripFence(text string) string {
+	start := strings.Index(text, "```")
+	if start < 0 {
+		return text
+	}
+	body := text[start+3:]
+	// Drop the info string, e.g. "json"
+	if nl := strings.IndexByte(body, '\n'); nl >= 0 {
+		body = body[nl+1:]
+	}
+	if end := strings.Index(body, "```"); end >= 0 {
+		body = body[:end]
+	}
+	return body
+}
+
+// repairJSON fixes the usual ways models break JSON: Markdown fences, prose
+// around the value and trailing commas. Output truncated mid-value is closed,
+// dropping a key left without its value; what the closed value lacks is left
+// to the schema to catch.
+func repairJSON(text string) (string, bool) {
+	text = stripFence(text)
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return text, false
+	}
+	text = text[start:]
+
+	var b strings.Builder
+	var stack []byte
+	inString, escaped := false, false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if inString {
+			b.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case ',':
+			rest := strings.TrimLeft(text[i+1:], " \t\r\n")
+			if rest == "" || rest[0] == '}' || rest[0] == ']' {
+				continue
+			}
+		}
+		b.WriteByte(c)
+		// Anything after the outermost value is prose
+		if len(stack) == 0 {
+			return b.String(), true
+		}
+	}
+	if len(stack) == 0 {
+		return text, false
+	}
+	return closeJSON(b.String(), stack, inString, escaped), true
+}
+
+// closeJSON ends truncated JSON: it closes an open string, drops a dangling
+// key or comma and closes the open arrays and objects in stack
+func closeJSON(text string, stack []byte, inString, escaped bool) string {
+	if inString {
+		if escaped {
+			text = text[:len(text)-1]
+		}
+		text += `"`
+	}
+	text = strings.TrimRight(text, " \t\r\n")
+	if strings.HasSuffix(text, ":") {
+		// Drop the key, whose value was lost
+		text = strings.TrimRight(strings.TrimSuffix(text, ":"), " \t\r\n")
+		if key := lastString(text); key >= 0 {
+			text = text[:key]
+		}
+	}
+	text = strings.TrimRight(text, " \t\r\n,")
+	for i := len(stack) - 1; i >= 0; i-- {
+		text += string(stack[i])
+	}
+	return text
+}
+
+// lastString returns where the string text ends with starts, or -1
+func lastString(text string) int {
+	if !strings.HasSuffix(text, `"`) {
+		return -1
+	}
+	for i := len(text) - 2; i >= 0; i-- {
+		if text[i] != '"' {
+			continue
+		}
+		// A quote is escaped by an odd number of backslashes
+		backslashes := 0
+		for j := i - 1; j >= 0 && text[j] == '\\'; j-- {
+			backslashes++
+		}
+		if backslashes%2 == 0 {
+			return i
+		}
+	}
+	return -1
+}
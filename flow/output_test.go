@@ -0,0 +1,176 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+)
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"fence", "```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"prose", "Here is the result: {\"a\": 1} Hope this helps.", `{"a": 1}`},
+		{"trailing commas", `{"a": [1, 2,], "b": "x",}`, `{"a": [1, 2], "b": "x"}`},
+		{"comma in string", `{"a": "1,}"}`, `{"a": "1,}"}`},
+		{"truncated string", `{"a": ["x", "y`, `{"a": ["x", "y"]}`},
+		{"truncated escape", `{"a": "x\`, `{"a": "x"}`},
+		{"truncated key", `{"a": 1, "b":`, `{"a": 1}`},
+		{"truncated escaped key", `{"a": 1, "b\"c": `, `{"a": 1}`},
+		{"truncated array", `{"a": [1, 2,`, `{"a": [1, 2]}`},
+		{"truncated fence", "```json\n{\"a\": {\"b\": true", `{"a": {"b": true}}`},
+	}
+	for _, tt := range tests {
+		if got, ok := repairJSON(tt.in); !ok || got != tt.want {
+			t.Errorf("%s: repairJSON(%q) = %q, %v, want %q", tt.name, tt.in, got, ok, tt.want)
+		}
+	}
+
+	if got, ok := repairJSON("no JSON here"); ok {
+		t.Errorf("repairJSON = %q, want it left unrepaired", got)
+	}
+}
+
+func TestStructuredOutputRepairsLocally(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Prompt(g, "summary"),
+		fakemodel.Text("```json\n{\"keyPoints\": [\"a\",], \"recommendations\": [\"b\"],}\n```"))
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	resp, err := executePrompt(withRunState(context.Background(), run), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"detailedReport": "Go is simple.", "language": "日本語"}))
+	if err != nil {
+		t.Fatalf("executePrompt failed: %v", err)
+	}
+
+	var result SummaryResult
+	if err := resp.Output(&result); err != nil || len(result.KeyPoints) != 1 {
+		t.Fatalf("Output = %+v, %v", result, err)
+	}
+	if got := run.outputs.snapshot()["summary"]; got != (OutputRepairStats{Repaired: 1}) {
+		t.Errorf("stats = %+v", got)
+	}
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model called %d times, want 1", calls)
+	}
+}
+
+func TestStructuredOutputReasksWithValidationError(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Prompt(g, "summary"),
+		fakemodel.Text("重要なポイントは以下の通りです。"),
+		fakemodel.JSON(SummaryResult{KeyPoints: []string{"a"}, Recommendations: []string{"b"}}))
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	_, err := executePrompt(withRunState(context.Background(), run), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"detailedReport": "Go is simple.", "language": "日本語"}))
+	if err != nil {
+		t.Fatalf("executePrompt failed: %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("model called %d times, want 2", len(calls))
+	}
+	if !fakemodel.Contains("could not be used", "not valid JSON")(calls[1]) {
+		t.Errorf("re-ask does not carry the validation error: %q", fakemodel.RequestText(calls[1]))
+	}
+	if got := run.outputs.snapshot()["summary"]; got != (OutputRepairStats{Reasked: 1}) {
+		t.Errorf("stats = %+v", got)
+	}
+}
+
+func TestStructuredOutputFailsAfterReasks(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Prompt(g, "summary"), fakemodel.Text("JSONでは答えられません。"))
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	_, err := executePrompt(withRunState(context.Background(), run), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"detailedReport": "Go is simple.", "language": "日本語"}))
+	if !errors.Is(err, ErrInvalidOutput) {
+		t.Fatalf("err = %v, want ErrInvalidOutput", err)
+	}
+	if calls := len(fake.Calls()); calls != 1+outputReasks {
+		t.Errorf("model called %d times, want %d", calls, 1+outputReasks)
+	}
+	if got := run.outputs.snapshot()["summary"]; got != (OutputRepairStats{Reasked: outputReasks, Failed: 1}) {
+		t.Errorf("stats = %+v", got)
+	}
+}
+
+func TestStructuredOutputClosesCutOffOutput(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Prompt(g, "summary"),
+		fakemodel.Truncated(`{"keyPoints": ["a", "b"], "recommendations": ["c", "d`))
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	resp, err := executePrompt(withRunState(context.Background(), run), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"detailedReport": "Go is simple.", "language": "日本語"}))
+	if err != nil {
+		t.Fatalf("executePrompt failed: %v", err)
+	}
+
+	var result SummaryResult
+	if err := resp.Output(&result); err != nil || len(result.Recommendations) != 2 || result.Recommendations[1] != "d" {
+		t.Errorf("Output = %+v, %v, want the cut-off answer closed", result, err)
+	}
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model called %d times, want 1", calls)
+	}
+	if got := run.outputs.snapshot()["summary"]; got != (OutputRepairStats{Repaired: 1}) {
+		t.Errorf("stats = %+v", got)
+	}
+}
+
+func TestStructuredOutputReasksCutOffOutput(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Prompt(g, "summary"),
+		// Closed, this still lacks the required recommendations
+		fakemodel.Truncated(`{"keyPoints": ["a", "b"], "recomm`),
+		fakemodel.JSON(SummaryResult{KeyPoints: []string{"a", "b", "d"}, Recommendations: []string{"c", "e"}}))
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	resp, err := executePrompt(withRunState(context.Background(), run), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"detailedReport": "Go is simple.", "language": "日本語"}))
+	if err != nil {
+		t.Fatalf("executePrompt failed: %v", err)
+	}
+
+	var result SummaryResult
+	if err := resp.Output(&result); err != nil || len(result.Recommendations) != 2 {
+		t.Errorf("Output = %+v, %v, want the complete second answer", result, err)
+	}
+	calls := fake.Calls()
+	if len(calls) != 2 || !fakemodel.Contains("cut off")(calls[1]) {
+		t.Errorf("model called %d times, want a re-ask naming the cut-off", len(calls))
+	}
+	if got := run.outputs.snapshot()["summary"]; got != (OutputRepairStats{Reasked: 1}) {
+		t.Errorf("stats = %+v", got)
+	}
+}
+
+func TestStructuredOutputInvalidToolCallTurnIsInvalidOutput(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Prompt(g, "summary"), func(*ai.ModelRequest) (*ai.ModelResponse, error) {
+		return &ai.ModelResponse{Message: ai.NewModelMessage(
+			ai.NewTextPart("まず確認します。"),
+			ai.NewToolRequestPart(&ai.ToolRequest{Name: "lookup", Input: map[string]any{}}),
+		)}, nil
+	})
+
+	run := &runState{retry: testRetryPolicy, outputs: &outputStats{}}
+	_, err := executePrompt(withRunState(context.Background(), run), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"detailedReport": "Go is simple.", "language": "日本語"}))
+	if !errors.Is(err, ErrInvalidOutput) || causeOf(err) != ErrInvalidOutput {
+		t.Errorf("err = %v, want Genkit's parse failure reported as ErrInvalidOutput", err)
+	}
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model called %d times, want the tool call turn left as it is", calls)
+	}
+}
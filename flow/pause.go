@@ -0,0 +1,167 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/toolcall"
+)
+
+// AskUserTool is the interrupt tool a phase uses to put a question to the
+// user without waiting for the answer
+const AskUserTool = "ask_user"
+
+// errPaused signals that a phase stopped at an interrupt and waits for a reply
+var errPaused = errors.New("waiting for a reply from the user")
+
+type AskUserInput struct {
+	Question string `json:"question" jsonschema:"description=ユーザーへの質問"`
+}
+
+// askUserTool returns the interrupt tool, defining it on first use
+func askUserTool(g *genkit.Genkit) ai.Tool {
+	if t := genkit.LookupTool(g, AskUserTool); t != nil {
+		return t
+	}
+	return genkit.DefineTool(g, AskUserTool,
+		"ユーザーに質問を送ります。回答は後で届くため、このツールの呼び出しで処理は一旦中断されます。",
+		func(ctx *ai.ToolContext, input AskUserInput) (string, error) {
+			return "", ctx.Interrupt(&ai.InterruptOptions{
+				Metadata: map[string]any{"question": input.Question},
+			})
+		})
+}
+
+// interruptQuestion collects the questions of every interrupt in resp
+func interruptQuestion(resp *ai.ModelResponse) string {
+	var questions []string
+	for _, part := range resp.Interrupts() {
+		if meta, ok := part.Metadata["interrupt"].(map[string]any); ok {
+			if q, ok := meta["question"].(string); ok && q != "" {
+				questions = append(questions, q)
+				continue
+			}
+		}
+		if input, ok := part.ToolRequest.Input.(map[string]any); ok {
+			if q, ok := input["question"].(string); ok {
+				questions = append(questions, q)
+			}
+		}
+	}
+	return strings.Join(questions, "\n\n")
+}
+
+// resumePrompt continues an interrupted prompt execution. Every interrupt in
+// the last message of history is answered with reply, and the prompt's
+// output schema, model settings and middleware apply as in executePrompt.
+func resumePrompt(ctx context.Context, g *genkit.Genkit, p ai.Prompt, phase string, input any, history []*ai.Message, reply any, toolRefs []ai.ToolRef) (*ai.ModelResponse, error) {
+	if len(history) == 0 {
+		return nil, errors.New("no interrupted conversation to resume")
+	}
+
+	var responses []*ai.Part
+	for _, part := range history[len(history)-1].Content {
+		if part.IsInterrupt() {
+			responses = append(responses, ai.NewToolResponsePart(&ai.ToolResponse{
+				Name:   part.ToolRequest.Name,
+				Ref:    part.ToolRequest.Ref,
+				Output: reply,
+			}))
+		}
+	}
+	if len(responses) == 0 {
+		return nil, errors.New("the conversation has no pending interrupt")
+	}
+
+	opts, err := p.Render(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render %s prompt: %w", promptName(p), err)
+	}
+	opts.Messages = append(slices.Clone(history), ai.NewMessage(ai.RoleTool, nil, responses...))
+	if m := runStateFrom(ctx).models.For(phase).Model; m != "" {
+		opts.Model = m
+	}
+	if config := phaseConfig(ctx, p, phase); config != nil {
+		opts.Config = config
+	}
+	opts.Tools = make([]string, 0, len(toolRefs))
+	for _, t := range toolRefs {
+		opts.Tools = append(opts.Tools, t.Name())
+	}
+
+	ctx, span := startPrompt(ctx, p, phase)
+	ctx, toolFailure := toolcall.Record(ctx)
+	ctx, outputFailure := recordOutput(ctx, promptName(p))
+	resp, err := genkit.GenerateWithRequest(ctx, g, opts, promptMiddleware(ctx, p, phase), nil)
+	err = outputFailure(toolFailure(err))
+	endPrompt(span, resp, err)
+	return resp, err
+}
+
+type ResumeInput struct {
+	RunID string `json:"runId" jsonschema:"description=deepResearchFlowが返したrun_id"`
+	Reply string `json:"reply" jsonschema:"description=保留中の質問へのユーザーの回答"`
+}
+
+// resumeLease is how long a resumed run stays claimed without being renewed
+const resumeLease = 2 * time.Minute
+
+// ResumeDeepResearchFlow continues a run that deepResearchFlow paused with a
+// pending question, using the user's reply
+func ResumeDeepResearchFlow(g *genkit.Genkit, mcpTools []ai.Tool, cfg DeepResearchConfig) *core.Flow[*ResumeInput, *DeepResearchResult, struct{}] {
+	return genkit.DefineFlow(g, "resumeDeepResearchFlow", func(ctx context.Context, input *ResumeInput) (result *DeepResearchResult, err error) {
+		defer func(start time.Time) { recordRun(ctx, "resumeDeepResearchFlow", start, result, err) }(time.Now())
+
+		if cfg.Runs == nil {
+			return nil, fmt.Errorf("%w: runs cannot be resumed without a run store", ErrInternal)
+		}
+		if input.Reply == "" {
+			return nil, fmt.Errorf("%w: reply is required", ErrInvalidInput)
+		}
+
+		stored, err := cfg.Runs.Load(ctx, input.RunID)
+		if err != nil {
+			return nil, err
+		}
+		if err := authorizeRun(ctx, stored); err != nil {
+			return nil, err
+		}
+		// Claim the run so that a second reply does not resume it twice. The
+		// lease is renewed while the run works; should the process crash,
+		// it lapses and the reply can be sent again.
+		run, err := cfg.Runs.Claim(ctx, input.RunID, RunPaused, RunRunning, resumeLease)
+		if err != nil {
+			return nil, err
+		}
+		defer holdClaim(ctx, cfg.Runs, run, resumeLease)()
+		if run.pendingQuestion() == "" {
+			failRun(ctx, cfg.Runs, run)
+			return nil, fmt.Errorf("%w: run %s has no pending question", ErrRunNotPaused, run.ID)
+		}
+
+		runCtx, reportType, err := runContext(ctx, cfg, run)
+		if err != nil {
+			failRun(ctx, cfg.Runs, run)
+			return nil, err
+		}
+		ctx = runCtx
+
+		toolRefs := make([]ai.ToolRef, len(mcpTools))
+		for i, tool := range mcpTools {
+			toolRefs[i] = tool
+		}
+		result, err = continueRun(ctx, g, toolRefs, cfg, run, input.Reply, reportType)
+		if err != nil {
+			failRun(ctx, cfg.Runs, run)
+		}
+		return result, err
+	})
+}
@@ -0,0 +1,153 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"google.golang.org/genai"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+// toolResponseOutput returns the output of the named tool's response in req, if any
+func toolResponseOutput(req *ai.ModelRequest, name string) any {
+	for _, msg := range req.Messages {
+		for _, part := range msg.Content {
+			if part.IsToolResponse() && part.ToolResponse.Name == name {
+				return part.ToolResponse.Output
+			}
+		}
+	}
+	return nil
+}
+
+func TestDeepResearchFlowPausesAndResumes(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+
+	confirm := fakemodel.Prompt(g, "plan_confirmation")
+	fake.On(fakemodel.All(confirm, fakemodel.HasToolResponse(AskUserTool)),
+		fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+	fake.On(confirm, fakemodel.ToolCall(AskUserTool, map[string]any{"question": "この計画でよろしいですか？"}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewMemoryRunStore()}
+	start := DeepResearchFlow(g, user.Tools(), cfg)
+	resume := ResumeDeepResearchFlow(g, user.Tools(), cfg)
+
+	paused, err := start.Run(WithCaller(context.Background(), "scheduler"), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	if paused.Status != RunPaused || paused.RunID == "" || paused.PendingQuestion != "この計画でよろしいですか？" {
+		t.Fatalf("got %+v, want a paused run with the pending question", paused)
+	}
+	for _, req := range fake.Calls() {
+		if fakemodel.Prompt(g, "research")(req) {
+			t.Fatal("research started before the plan was confirmed")
+		}
+	}
+	if len(user.Sent()) != 0 {
+		t.Errorf("the question was sent through ask-me: %q", user.Sent())
+	}
+
+	_, err = resume.Run(WithCaller(context.Background(), "newsletter"), &ResumeInput{RunID: paused.RunID, Reply: "はい"})
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("resume by another caller err = %v, want ErrForbidden", err)
+	}
+	if run, _ := cfg.Runs.Load(context.Background(), paused.RunID); run.Status != RunPaused {
+		t.Errorf("status after the forbidden resume = %s, want the run left paused", run.Status)
+	}
+
+	// A resume that crashed leaves the run claimed until its lease lapses
+	crashed, err := cfg.Runs.Claim(context.Background(), paused.RunID, RunPaused, RunRunning, resumeLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = resume.Run(WithAdmin(context.Background()), &ResumeInput{RunID: paused.RunID, Reply: "はい"})
+	if !errors.Is(err, ErrRunBusy) {
+		t.Errorf("resume during the crashed resume's lease err = %v, want ErrRunBusy", err)
+	}
+	crashed.ClaimedUntil = time.Now().Add(-time.Second)
+	if err := cfg.Runs.Save(context.Background(), crashed); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := resume.Run(WithAdmin(WithCaller(context.Background(), "analyst")), &ResumeInput{RunID: paused.RunID, Reply: "はい、進めてください"})
+	if err != nil {
+		t.Fatalf("resumeDeepResearchFlow failed: %v", err)
+	}
+	if done.Status != RunCompleted || done.RunID != paused.RunID || !strings.Contains(done.DetailedReport, "Go is simple.") {
+		t.Errorf("got %+v, want the completed report", done)
+	}
+
+	replied := false
+	for _, req := range fake.Calls() {
+		if toolResponseOutput(req, AskUserTool) == "はい、進めてください" {
+			replied = true
+		}
+	}
+	if !replied {
+		t.Error("the reply never reached the model")
+	}
+
+	run, err := cfg.Runs.Load(context.Background(), paused.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != RunCompleted || run.Result == nil {
+		t.Errorf("stored run = %+v, want completed with its result", run)
+	}
+	if run.CreatedBy != "scheduler" || run.UpdatedBy != "analyst" || run.Reports[0].CreatedBy != "analyst" {
+		t.Errorf("stored run created by %q, updated by %q, report by %q; want scheduler, analyst, analyst",
+			run.CreatedBy, run.UpdatedBy, run.Reports[0].CreatedBy)
+	}
+
+	if _, err := resume.Run(context.Background(), &ResumeInput{RunID: paused.RunID, Reply: "もう一度"}); !errors.Is(err, ErrRunNotPaused) {
+		t.Errorf("second resume err = %v, want ErrRunNotPaused", err)
+	}
+}
+
+func TestResumeUnknownRun(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	resume := ResumeDeepResearchFlow(g, nil, DeepResearchConfig{Runs: NewMemoryRunStore()})
+
+	_, err := resume.Run(context.Background(), &ResumeInput{RunID: "missing", Reply: "はい"})
+	if !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("err = %v, want ErrRunNotFound", err)
+	}
+}
+
+func TestDeepResearchFlowSavesFailedRun(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	fake.On(fakemodel.Prompt(g, "research"), fakemodel.Error(genai.APIError{Code: 400, Status: "INVALID_ARGUMENT"}))
+	scriptDeepResearch(g, fake)
+
+	dir := t.TempDir()
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewFileRunStore(dir)}
+	if _, err := DeepResearchFlow(g, user.Tools(), cfg).Run(WithCaller(context.Background(), "scheduler"), &DeepResearchInput{Topic: "Go"}); err == nil {
+		t.Fatal("DeepResearchFlow succeeded, want the research error")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("run files = %v, %v; want the failed run", files, err)
+	}
+	run, err := cfg.Runs.Load(context.Background(), strings.TrimSuffix(filepath.Base(files[0]), ".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != RunFailed || run.CreatedBy != "scheduler" || run.Input.Topic != "Go" {
+		t.Errorf("stored run = %+v, want the failed run", run)
+	}
+	if run.Usage == nil || run.Usage.ByPhase[PhasePlanning].Calls != 1 {
+		t.Errorf("stored usage = %+v, want the planning call before the failure", run.Usage)
+	}
+}
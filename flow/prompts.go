@@ -0,0 +1,64 @@
+package flow
+
+import (
+	"slices"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// phasePrompts are the prompts each phase of deepResearchFlow runs
+var phasePrompts = map[string][]string{
+	PhaseClarification:    {"clarification"},
+	PhasePlanning:         {"planning"},
+	PhasePlanConfirmation: {"plan_confirmation"},
+	PhaseResearch:         {"research"},
+	PhaseSynthesis:        {"synthesis", "chapter_assignment", "chapter_draft", "synthesis_consolidation"},
+	PhaseSummary:          {"summary"},
+	PhaseDraftReview:      {"draft_review"},
+	PhaseReportDelivery:   {"report_delivery"},
+}
+
+// MissingPrompts returns the prompts the flows need that g has not loaded,
+// and the number it has
+func MissingPrompts(g *genkit.Genkit) (missing []string, loaded int) {
+	for _, phase := range phases {
+		for _, name := range phasePrompts[phase] {
+			if genkit.LookupPrompt(g, name) == nil {
+				missing = append(missing, name)
+			} else {
+				loaded++
+			}
+		}
+	}
+	return missing, loaded
+}
+
+// PhaseModels returns the models the phases of deepResearchFlow call: the
+// model configured for the phase, or else the one its prompts pin
+func PhaseModels(g *genkit.Genkit, models ModelConfig) []string {
+	var names []string
+	add := func(name string) {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, phase := range phases {
+		if m := models.For(phase).Model; m != "" {
+			add(m)
+			continue
+		}
+		for _, name := range phasePrompts[phase] {
+			if p := genkit.LookupPrompt(g, name); p != nil {
+				add(promptModel(p))
+			}
+		}
+	}
+	return names
+}
+
+// promptModel is the model a prompt file pins, if any
+func promptModel(p ai.Prompt) string {
+	model, _ := promptMetadata(p)["model"].(string)
+	return model
+}
@@ -0,0 +1,253 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// rateWindow is the period the rate limits apply to
+var rateWindow = time.Minute
+
+// RateLimit caps the calls to one model, across all runs. Zero fields are unlimited.
+type RateLimit struct {
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	// TokensPerMinute counts input and output tokens; a call reserves its
+	// estimated input until the response reports the actual usage
+	TokensPerMinute int `yaml:"tokensPerMinute"`
+}
+
+// RateLimitConfig maps model names, or "default" for every other model, to their limits
+type RateLimitConfig map[string]RateLimit
+
+// Validate rejects negative limits
+func (c RateLimitConfig) Validate() error {
+	for model, l := range c {
+		if l.RequestsPerMinute < 0 || l.TokensPerMinute < 0 {
+			return fmt.Errorf("rate limits for model %q must not be negative", model)
+		}
+	}
+	return nil
+}
+
+// RateLimiter queues model calls so that every model stays within its
+// limits. One limiter is shared by all flows of the process. Waiting calls
+// are served round-robin between runs, so a run with many queued calls does
+// not hold up the others.
+type RateLimiter struct {
+	cfg RateLimitConfig
+	// defaultModel is the model of calls that name none
+	defaultModel string
+
+	mu     sync.Mutex
+	models map[string]*modelLimiter
+}
+
+// NewRateLimiter returns a limiter for cfg, or nil when cfg sets no limits
+func NewRateLimiter(cfg RateLimitConfig, defaultModel string) *RateLimiter {
+	if len(cfg) == 0 {
+		return nil
+	}
+	return &RateLimiter{cfg: cfg, defaultModel: defaultModel, models: map[string]*modelLimiter{}}
+}
+
+// modelLimiter tracks the calls granted to one model within the last rateWindow
+type modelLimiter struct {
+	limit   RateLimit
+	granted []*rateGrant
+	// queues holds the waiting calls per run; runs lists those runs in the order they are served
+	queues map[string][]*rateWaiter
+	runs   []string
+	timer  *time.Timer
+}
+
+type rateGrant struct {
+	at     time.Time
+	tokens int
+}
+
+type rateWaiter struct {
+	tokens int
+	ready  chan *rateGrant
+}
+
+func (l *RateLimiter) model(name string) *modelLimiter {
+	m, ok := l.models[name]
+	if !ok {
+		limit, ok := l.cfg[name]
+		if !ok {
+			limit = l.cfg[PhaseDefault]
+		}
+		m = &modelLimiter{limit: limit, queues: map[string][]*rateWaiter{}}
+		l.models[name] = m
+	}
+	return m
+}
+
+// acquire waits until a call of run with the given estimated tokens fits
+// within the model's limits. The returned grant is nil for unlimited models.
+func (l *RateLimiter) acquire(ctx context.Context, model, run string, tokens int) (*rateGrant, error) {
+	l.mu.Lock()
+	m := l.model(model)
+	if m.limit == (RateLimit{}) {
+		l.mu.Unlock()
+		return nil, nil
+	}
+	w := &rateWaiter{tokens: tokens, ready: make(chan *rateGrant, 1)}
+	if len(m.queues[run]) == 0 {
+		m.runs = append(m.runs, run)
+	}
+	m.queues[run] = append(m.queues[run], w)
+	l.dispatch(m)
+	l.mu.Unlock()
+
+	select {
+	case g := <-w.ready:
+		return g, nil
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case g := <-w.ready:
+		log.Printf("rate limit: call to %s waited %s", model, time.Since(start).Round(time.Millisecond))
+		return g, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Granted while giving up; the reservation lapses with the window
+		default:
+			l.remove(m, run, w)
+			l.dispatch(m)
+		}
+		return nil, fmt.Errorf("waiting for the rate limit of %s: %w", model, ctx.Err())
+	}
+}
+
+// settle replaces the estimate of a granted call with its actual token usage
+func (l *RateLimiter) settle(model string, g *rateGrant, tokens int) {
+	if g == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g.tokens = tokens
+	l.dispatch(l.models[model])
+}
+
+func (l *RateLimiter) remove(m *modelLimiter, run string, w *rateWaiter) {
+	queue := slices.DeleteFunc(m.queues[run], func(q *rateWaiter) bool { return q == w })
+	if len(queue) == 0 {
+		delete(m.queues, run)
+		m.runs = slices.DeleteFunc(m.runs, func(r string) bool { return r == run })
+		return
+	}
+	m.queues[run] = queue
+}
+
+// dispatch grants waiting calls while the limits allow, taking one call per
+// run in turn, and otherwise schedules itself for when capacity frees up.
+// l.mu must be held.
+func (l *RateLimiter) dispatch(m *modelLimiter) {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+
+	for len(m.runs) > 0 {
+		now := time.Now()
+		m.granted = slices.DeleteFunc(m.granted, func(g *rateGrant) bool { return now.Sub(g.at) >= rateWindow })
+
+		run := m.runs[0]
+		w := m.queues[run][0]
+		if !m.fits(w.tokens) {
+			// The oldest grant is the first to leave the window
+			m.timer = time.AfterFunc(rateWindow-now.Sub(m.granted[0].at), func() {
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				l.dispatch(m)
+			})
+			return
+		}
+
+		g := &rateGrant{at: now, tokens: w.tokens}
+		m.granted = append(m.granted, g)
+		w.ready <- g
+
+		// Move the run to the back of the line
+		m.runs = m.runs[1:]
+		if queue := m.queues[run][1:]; len(queue) > 0 {
+			m.queues[run] = queue
+			m.runs = append(m.runs, run)
+		} else {
+			delete(m.queues, run)
+		}
+	}
+}
+
+// fits reports whether a call with the given tokens stays within the limits.
+// A call larger than the whole token limit is let through once the window is empty.
+func (m *modelLimiter) fits(tokens int) bool {
+	if len(m.granted) == 0 {
+		return true
+	}
+	if m.limit.RequestsPerMinute > 0 && len(m.granted) >= m.limit.RequestsPerMinute {
+		return false
+	}
+	if m.limit.TokensPerMinute > 0 {
+		used := 0
+		for _, g := range m.granted {
+			used += g.tokens
+		}
+		if used+tokens > m.limit.TokensPerMinute {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware holds the model calls of a request made outside the flows, such
+// as a health probe, until model's limits allow them
+func (l *RateLimiter) Middleware(model string) ai.ModelMiddleware {
+	return l.middleware(model, newRunID())
+}
+
+// middleware holds each model call of run until the model's limits allow it
+func (l *RateLimiter) middleware(model, run string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		if l == nil {
+			return next
+		}
+		if model == "" {
+			model = l.defaultModel
+		}
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			estimate := requestTokens(req)
+			g, err := l.acquire(ctx, model, run, estimate)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := next(ctx, req, cb)
+			if err == nil && resp.Usage != nil {
+				l.settle(model, g, resp.Usage.InputTokens+resp.Usage.OutputTokens)
+			}
+			return resp, err
+		}
+	}
+}
+
+// requestTokens estimates the input tokens of a request
+func requestTokens(req *ai.ModelRequest) int {
+	tokens := 0
+	for _, m := range req.Messages {
+		tokens += estimateTokens(m.Text())
+	}
+	return tokens
+}
@@ -0,0 +1,105 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n calls to model are waiting
+func waitQueued(t *testing.T, l *RateLimiter, model string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		queued := 0
+		for _, q := range l.model(model).queues {
+			queued += len(q)
+		}
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d calls never queued", n)
+}
+
+func TestRateLimiterServesRunsInTurn(t *testing.T) {
+	window := rateWindow
+	rateWindow = 50 * time.Millisecond
+	t.Cleanup(func() { rateWindow = window })
+
+	l := NewRateLimiter(RateLimitConfig{PhaseDefault: {RequestsPerMinute: 1}}, "m")
+	ctx := context.Background()
+	if _, err := l.acquire(ctx, "m", "a", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 3)
+	call := func(run string) {
+		if _, err := l.acquire(ctx, "m", run, 0); err != nil {
+			t.Error(err)
+		}
+		order <- run
+	}
+	go call("a")
+	waitQueued(t, l, "m", 1)
+	go call("a")
+	waitQueued(t, l, "m", 2)
+	go call("b")
+	waitQueued(t, l, "m", 3)
+
+	var got []string
+	for range 3 {
+		got = append(got, <-order)
+	}
+	if got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Errorf("served %v, want run b served before the second queued call of run a", got)
+	}
+}
+
+func TestRateLimiterReleasesTokensOnSettle(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{"m": {TokensPerMinute: 100}}, "")
+	ctx := context.Background()
+	g, err := l.acquire(ctx, "m", "a", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan struct{})
+	go func() {
+		if _, err := l.acquire(ctx, "m", "b", 30); err != nil {
+			t.Error(err)
+		}
+		close(granted)
+	}()
+	waitQueued(t, l, "m", 1)
+
+	// The first call used less than estimated
+	l.settle("m", g, 10)
+	select {
+	case <-granted:
+	case <-time.After(time.Second):
+		t.Fatal("call still waiting after tokens were released")
+	}
+}
+
+func TestRateLimiterGivesUpWithContext(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{"m": {RequestsPerMinute: 1}}, "")
+	if _, err := l.acquire(context.Background(), "m", "a", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, "m", "b", 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context's error", err)
+	}
+	l.mu.Lock()
+	m := l.model("m")
+	queued := len(m.runs) + len(m.queues)
+	l.mu.Unlock()
+	if queued != 0 {
+		t.Error("abandoned call is still queued")
+	}
+}
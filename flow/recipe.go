@@ -27,7 +27,7 @@ type Recipe struct {
 	Tips         []string `json:"tips,omitempty"`
 }
 
-func RecipeGeneratorFlow(g *genkit.Genkit) *core.Flow[*RecipeInput, *Recipe, struct{}] {
+func RecipeGeneratorFlow(g *genkit.Genkit, limiter *RateLimiter) *core.Flow[*RecipeInput, *Recipe, struct{}] {
 	// Define a recipe generator flow
 	recipeGeneratorFlow := genkit.DefineFlow(g, "recipeGeneratorFlow", func(ctx context.Context, input *RecipeInput) (*Recipe, error) {
 		// Create a prompt based on the input
@@ -43,6 +43,7 @@ func RecipeGeneratorFlow(g *genkit.Genkit) *core.Flow[*RecipeInput, *Recipe, str
 		// Generate structured recipe data using the same schema
 		recipe, _, err := genkit.GenerateData[Recipe](ctx, g,
 			ai.WithPrompt(prompt),
+			ai.WithMiddleware(limiter.middleware("", newRunID())),
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate recipe: %w", err)
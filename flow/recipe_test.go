@@ -0,0 +1,27 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"research/internal/fakemodel"
+)
+
+func TestRecipeGeneratorFlow(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	want := Recipe{
+		Title:        "Tomato Soup",
+		Servings:     2,
+		Ingredients:  []string{"tomato", "salt"},
+		Instructions: []string{"simmer", "blend"},
+	}
+	fake.On(fakemodel.Contains("Main ingredient: tomato", "Dietary restrictions: none"), fakemodel.JSON(want))
+
+	got, err := RecipeGeneratorFlow(g, nil).Run(context.Background(), &RecipeInput{Ingredient: "tomato"})
+	if err != nil {
+		t.Fatalf("RecipeGeneratorFlow failed: %v", err)
+	}
+	if got.Title != want.Title || got.Servings != want.Servings || len(got.Instructions) != 2 {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,226 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+type RegenerateChapterInput struct {
+	RunID string `json:"runId"`
+	// Chapter is the 1-based index of the chapter in the latest report version
+	Chapter  int    `json:"chapter" jsonschema:"description=再生成する章の番号 (1から)"`
+	Guidance string `json:"guidance,omitempty" jsonschema:"description=章の書き直しに関する指示"`
+}
+
+// ChapterFeedback asks for one chapter of a report to be redrafted
+type ChapterFeedback struct {
+	// Chapter is 1-based
+	Chapter     int    `json:"chapter"`
+	Instruction string `json:"instruction,omitempty"`
+}
+
+// regenerateLease is how long a regeneration may hold its run, well beyond the
+// time one chapter takes; the claim of a crashed request lapses after it
+const regenerateLease = 30 * time.Minute
+
+// RegenerateChapterFlow researches and redrafts one chapter of a completed run.
+// The other chapters are kept as they are and the result is stored as a new
+// report version.
+func RegenerateChapterFlow(g *genkit.Genkit, cfg DeepResearchConfig) *core.Flow[*RegenerateChapterInput, *DeepResearchResult, struct{}] {
+	return genkit.DefineFlow(g, "regenerateChapterFlow", func(ctx context.Context, input *RegenerateChapterInput) (result *DeepResearchResult, err error) {
+		defer func(start time.Time) { recordRun(ctx, "regenerateChapterFlow", start, result, err) }(time.Now())
+
+		if cfg.Runs == nil {
+			return nil, fmt.Errorf("%w: chapters cannot be regenerated without a run store", ErrInternal)
+		}
+
+		stored, err := cfg.Runs.Load(ctx, input.RunID)
+		if err != nil {
+			return nil, err
+		}
+		if err := authorizeRun(ctx, stored); err != nil {
+			return nil, err
+		}
+		// Claim the run so that concurrent regenerations do not overwrite each
+		// other's version. It stays completed, since its latest version does
+		// not change until the new one is saved.
+		run, err := cfg.Runs.Claim(ctx, input.RunID, RunCompleted, RunCompleted, regenerateLease)
+		if err != nil {
+			return nil, err
+		}
+		runCtx, reportType, err := runContext(ctx, cfg, run)
+		if err == nil {
+			runCtx = withBudget(runCtx, cfg.Budget, run.Elapsed)
+			result, err = regenerateChapter(runCtx, g, cfg, run, ChapterFeedback{Chapter: input.Chapter, Instruction: input.Guidance}, reportType)
+		}
+		if err != nil {
+			// Release the claim, keeping what the failed attempt spent; the
+			// latest version is untouched
+			if runCtx != nil {
+				recordProgress(runCtx, run)
+				logUsage(runCtx, run, run.Usage)
+			}
+			if serr := saveRun(ctx, cfg.Runs, run); serr != nil {
+				log.Printf("failed to record the state of run %s: %v", run.ID, serr)
+			}
+			return nil, err
+		}
+		return result, nil
+	})
+}
+
+// regenerateChapter produces and stores the report version with the chapter
+// redrafted. ctx carries the run's state, see runContext.
+func regenerateChapter(ctx context.Context, g *genkit.Genkit, cfg DeepResearchConfig, run *Run, feedback ChapterFeedback, reportType *ReportTypeSpec) (*DeepResearchResult, error) {
+	if run.Result == nil || len(run.Reports) == 0 {
+		return nil, fmt.Errorf("%w: run %s has no report", ErrRunNotCompleted, run.ID)
+	}
+	latest := run.Reports[len(run.Reports)-1]
+	if feedback.Chapter < 1 || feedback.Chapter > len(latest.Chapters) {
+		return nil, fmt.Errorf("%w: chapter must be between 1 and %d, got %d", ErrInvalidInput, len(latest.Chapters), feedback.Chapter)
+	}
+
+	if err := reviseChapters(ctx, g, cfg, run, []ChapterFeedback{feedback}, reportType); err != nil {
+		return nil, err
+	}
+
+	run.Status = RunCompleted
+	run.Result.Status = RunCompleted
+	recordProgress(ctx, run)
+	run.Result.OutputRepairs = run.OutputRepairs
+	run.Result.Usage = run.Usage
+	run.Result.Cache = run.Cache
+	logUsage(ctx, run, run.Result.Usage)
+	if err := saveRun(ctx, cfg.Runs, run); err != nil {
+		return nil, err
+	}
+	result := *run.Result
+	return &result, nil
+}
+
+// reviseChapters researches and redrafts each chapter named in feedback,
+// keeping the others, and makes the result the run's latest report version
+func reviseChapters(ctx context.Context, g *genkit.Genkit, cfg DeepResearchConfig, run *Run, feedback []ChapterFeedback, reportType *ReportTypeSpec) error {
+	p := genkit.LookupPrompt(g, "chapter_draft")
+	if p == nil {
+		return promptNotFound(PhaseSynthesis, "chapter_draft")
+	}
+
+	language := runLanguage(&run.Input)
+	latest := run.Reports[len(run.Reports)-1]
+	chapters := reportChapters(latest, run.Planning)
+	synthesis := &SynthesisResult{
+		Chapters:         slices.Clone(latest.Chapters),
+		StructureChanges: latest.StructureChanges,
+	}
+
+	var sources []string
+	for _, f := range feedback {
+		chapter := chapters[f.Chapter-1]
+		// The chapter's single question gets the chapter's research effort
+		chapter.Questions = []int{1}
+		findings, found, _, err := researchPhase(ctx, g, []string{chapterQuestion(run.Input.Topic, chapter, f.Instruction)}, []ChapterInfo{chapter}, language, cfg.Search)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, found...)
+
+		draft, err := draftChapter(ctx, p, f.Chapter, chapter.Title, map[string]any{
+			"topic":              run.Input.Topic,
+			"investigationPlan":  run.Result.ResearchPlan,
+			"chapterStructure":   formatChapterStructure(chapters),
+			"chapterDescription": chapter.Description,
+			"findings":           strings.Join(fitTexts(findings, runStateFrom(ctx).synthesis.TokenBudget), "\n\n"),
+			"currentContent":     synthesis.Chapters[f.Chapter-1].Content,
+			"guidance":           f.Instruction,
+			"reportGuidance":     reportType.guidance(PhaseSynthesis),
+			"language":           language,
+		})
+		if err != nil {
+			return err
+		}
+		synthesis.Chapters[f.Chapter-1] = ChapterContent{
+			Title:      draft.Title,
+			Content:    draft.Content,
+			Importance: chapter.Importance,
+		}
+	}
+
+	detailedReport := formatReport(synthesis)
+	summary, err := summaryPhase(ctx, g, detailedReport, language)
+	if err != nil {
+		return err
+	}
+
+	version := ReportVersion{
+		Version:          latest.Version + 1,
+		Chapters:         synthesis.Chapters,
+		StructureChanges: synthesis.StructureChanges,
+		Summary:          summary,
+		Revisions:        feedback,
+		CreatedAt:        time.Now(),
+		CreatedBy:        Caller(ctx),
+	}
+	run.Reports = append(run.Reports, version)
+
+	result := *run.Result
+	result.ReportVersion = version.Version
+	result.DetailedReport = detailedReport
+	result.Summary = summary
+	result.Recommendations = summary
+	result.Sources = mergeSources(result.Sources, sources)
+	run.Result = &result
+	return nil
+}
+
+// reportChapters describes the chapters of a report version, taking the
+// descriptions from the plan for chapters the synthesis kept
+func reportChapters(report ReportVersion, planning *PlanningResult) []ChapterInfo {
+	chapters := make([]ChapterInfo, len(report.Chapters))
+	for i, c := range report.Chapters {
+		chapters[i] = ChapterInfo{Title: c.Title, Importance: c.Importance}
+		if planning == nil {
+			continue
+		}
+		for _, planned := range planning.ChapterStructure {
+			if planned.Title == c.Title {
+				chapters[i].Description = planned.Description
+				break
+			}
+		}
+	}
+	return chapters
+}
+
+// chapterQuestion is the research question for redrafting a chapter
+func chapterQuestion(topic string, chapter ChapterInfo, instruction string) string {
+	question := fmt.Sprintf("%s: %s", topic, chapter.Title)
+	if chapter.Description != "" {
+		question += fmt.Sprintf(" (%s)", chapter.Description)
+	}
+	if instruction != "" {
+		question += "\n" + instruction
+	}
+	return question
+}
+
+// mergeSources appends the sources not yet listed
+func mergeSources(sources, more []string) []string {
+	merged := slices.Clone(sources)
+	for _, source := range more {
+		if !slices.Contains(merged, source) {
+			merged = append(merged, source)
+		}
+	}
+	if merged == nil {
+		merged = []string{}
+	}
+	return merged
+}
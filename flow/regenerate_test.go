@@ -0,0 +1,145 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestRegenerateChapterKeepsOtherChapters(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	fake.On(fakemodel.Prompt(g, "synthesis"), fakemodel.JSON(SynthesisResult{
+		Chapters: []ChapterContent{
+			{Title: "概要", Content: "Go is simple.", Importance: "high"},
+			{Title: "利用者", Content: "Some people use Go.", Importance: "medium"},
+		},
+	}))
+	fake.On(fakemodel.Contains("担当する章: 2. 利用者"), fakemodel.JSON(ChapterDraft{Title: "利用者", Content: "Google and Uber use Go."}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewMemoryRunStore()}
+	first, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	if first.ReportVersion != 1 {
+		t.Fatalf("report version = %d, want 1", first.ReportVersion)
+	}
+
+	regenerate := RegenerateChapterFlow(g, cfg)
+	got, err := regenerate.Run(context.Background(), &RegenerateChapterInput{RunID: first.RunID, Chapter: 2, Guidance: "name companies"})
+	if err != nil {
+		t.Fatalf("regenerateChapterFlow failed: %v", err)
+	}
+
+	want := "1. 概要\nGo is simple.\n\n2. 利用者\nGoogle and Uber use Go.\n\n"
+	if got.ReportVersion != 2 || got.DetailedReport != want {
+		t.Errorf("got version %d report %q, want version 2 report %q", got.ReportVersion, got.DetailedReport, want)
+	}
+
+	var draftRequest string
+	for _, req := range fake.Calls() {
+		if text := fakemodel.RequestText(req); strings.Contains(text, "担当する章: 2. 利用者") {
+			draftRequest = text
+		}
+	}
+	if !strings.Contains(draftRequest, "name companies") || !strings.Contains(draftRequest, "Some people use Go.") {
+		t.Errorf("draft request lacks the guidance or current content:\n%s", draftRequest)
+	}
+
+	run, err := cfg.Runs.Load(context.Background(), first.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Reports) != 2 || run.Reports[0].Chapters[1].Content != "Some people use Go." || run.Reports[1].Revisions[0].Chapter != 2 {
+		t.Errorf("stored reports = %+v, want the original and the regenerated version", run.Reports)
+	}
+	if run.Status != RunCompleted || run.Result.ReportVersion != 2 {
+		t.Errorf("stored run = %s version %d, want completed version 2", run.Status, run.Result.ReportVersion)
+	}
+
+	if _, err := regenerate.Run(context.Background(), &RegenerateChapterInput{RunID: first.RunID, Chapter: 3}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("chapter out of range: err = %v, want ErrInvalidInput", err)
+	}
+}
+
+func TestRegenerateChapterRequiresCompletedRun(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	runs := NewMemoryRunStore()
+	if err := runs.Save(context.Background(), &Run{ID: "paused", Status: RunPaused}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := RegenerateChapterFlow(g, DeepResearchConfig{Runs: runs}).Run(context.Background(), &RegenerateChapterInput{RunID: "paused", Chapter: 1})
+	if !errors.Is(err, ErrRunNotCompleted) {
+		t.Errorf("err = %v, want ErrRunNotCompleted", err)
+	}
+}
+
+func TestRegenerateChapterWhileClaimed(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	runs := NewMemoryRunStore()
+	run := &Run{ID: "busy", Status: RunCompleted, ClaimedUntil: time.Now().Add(time.Minute)}
+	if err := runs.Save(context.Background(), run); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := RegenerateChapterFlow(g, DeepResearchConfig{Runs: runs}).Run(context.Background(), &RegenerateChapterInput{RunID: "busy", Chapter: 1})
+	if !errors.Is(err, ErrRunBusy) {
+		t.Errorf("err = %v, want ErrRunBusy", err)
+	}
+	if got, _ := runs.Load(context.Background(), "busy"); got.Status != RunCompleted {
+		t.Errorf("status = %s, want the run left completed", got.Status)
+	}
+}
+
+func TestRegenerateChapterFailureKeepsUsage(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	fake.On(fakemodel.Contains("担当する章: 1. "), fakemodel.Error(genai.APIError{Code: 400, Status: "INVALID_ARGUMENT"}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewMemoryRunStore()}
+	first, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	if _, err := RegenerateChapterFlow(g, cfg).Run(context.Background(), &RegenerateChapterInput{RunID: first.RunID, Chapter: 1}); err == nil {
+		t.Fatal("regenerateChapterFlow succeeded, want the drafting error")
+	}
+
+	run, err := cfg.Runs.Load(context.Background(), first.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Usage == nil || run.Usage.Total.Calls <= first.Usage.Total.Calls {
+		t.Errorf("stored usage = %+v, want the calls of the failed regeneration added to %+v", run.Usage, first.Usage.Total)
+	}
+	if run.Status != RunCompleted || !run.ClaimedUntil.IsZero() || len(run.Reports) != 1 {
+		t.Errorf("stored run = %s claimed until %v with %d reports, want the completed run released", run.Status, run.ClaimedUntil, len(run.Reports))
+	}
+}
+
+func TestRegenerateChapterOfAnotherCaller(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	runs := NewMemoryRunStore()
+	if err := runs.Save(context.Background(), &Run{ID: "done", Status: RunCompleted, CreatedBy: "scheduler"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := RegenerateChapterFlow(g, DeepResearchConfig{Runs: runs}).Run(WithCaller(context.Background(), "newsletter"), &RegenerateChapterInput{RunID: "done", Chapter: 1})
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("err = %v, want ErrForbidden", err)
+	}
+	if got, _ := runs.Load(context.Background(), "done"); !got.ClaimedUntil.IsZero() {
+		t.Errorf("claimed until %v, want the run left unclaimed", got.ClaimedUntil)
+	}
+}
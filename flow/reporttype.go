@@ -0,0 +1,140 @@
+package flow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReportType selects the prompt guidance and chapter skeleton used by DeepResearchFlow
+type ReportType string
+
+const (
+	ReportTypeTechnical   ReportType = "technical"
+	ReportTypeMarket      ReportType = "market"
+	ReportTypeAcademic    ReportType = "academic"
+	ReportTypePolicy      ReportType = "policy"
+	ReportTypeCompetitive ReportType = "competitive"
+	ReportTypeCustom      ReportType = "custom"
+)
+
+// DefaultReportTypeDir holds one <name>.yaml skeleton per report type
+var DefaultReportTypeDir = filepath.Join("prompts", "report_types")
+
+// ReportTypeSpec is the chapter skeleton a report type requires
+type ReportTypeSpec struct {
+	Name        string        `yaml:"name"`
+	Description string        `yaml:"description"`
+	Chapters    []ChapterInfo `yaml:"chapters"`
+	// PlanningGuidance and SynthesisGuidance replace the general guidance of
+	// the planning and synthesis prompts
+	PlanningGuidance  string `yaml:"planningGuidance"`
+	SynthesisGuidance string `yaml:"synthesisGuidance"`
+}
+
+// guidance returns the report type's guidance for the prompt of phase, if any
+func (s *ReportTypeSpec) guidance(phase string) string {
+	switch {
+	case s == nil:
+		return ""
+	case phase == PhasePlanning:
+		return s.PlanningGuidance
+	case phase == PhaseSynthesis:
+		return s.SynthesisGuidance
+	}
+	return ""
+}
+
+// resolveReportType returns the skeleton for the input from dir, or nil when
+// no report type was requested
+func resolveReportType(dir string, input *DeepResearchInput) (*ReportTypeSpec, error) {
+	name := string(input.ReportType)
+	switch input.ReportType {
+	case "":
+		return nil, nil
+	case ReportTypeTechnical, ReportTypeMarket, ReportTypeAcademic, ReportTypePolicy, ReportTypeCompetitive:
+	case ReportTypeCustom:
+		name = input.CustomReportType
+		if name == "" {
+			return nil, fmt.Errorf("customReportType is required when reportType is %q", ReportTypeCustom)
+		}
+		if strings.ContainsAny(name, `./\`) {
+			return nil, fmt.Errorf("invalid customReportType %q", name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown report type %q", input.ReportType)
+	}
+
+	return loadReportType(dir, name)
+}
+
+// loadReportType reads the skeleton from dir so custom types need no Go changes
+func loadReportType(dir, name string) (*ReportTypeSpec, error) {
+	if dir == "" {
+		dir = DefaultReportTypeDir
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load report type %q: %w", name, err)
+	}
+
+	var spec ReportTypeSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse report type %q: %w", name, err)
+	}
+	if spec.Name == "" {
+		spec.Name = name
+	}
+	if len(spec.Chapters) == 0 {
+		return nil, fmt.Errorf("report type %q defines no chapters", name)
+	}
+
+	return &spec, nil
+}
+
+// applySkeleton puts the required chapters first, in order, and keeps any extra chapters the planner proposed
+func applySkeleton(planned []ChapterInfo, spec *ReportTypeSpec) []ChapterInfo {
+	if spec == nil {
+		return planned
+	}
+
+	required := make(map[string]bool, len(spec.Chapters))
+	chapters := make([]ChapterInfo, 0, len(spec.Chapters)+len(planned))
+	for _, chapter := range spec.Chapters {
+		required[chapter.Title] = true
+		// Keep the planner's description and questions when it planned the same chapter
+		for _, p := range planned {
+			if p.Title == chapter.Title {
+				if p.Description != "" {
+					chapter.Description = p.Description
+				}
+				chapter.Questions = p.Questions
+				break
+			}
+		}
+		chapters = append(chapters, chapter)
+	}
+	for _, chapter := range planned {
+		if !required[chapter.Title] {
+			chapters = append(chapters, chapter)
+		}
+	}
+
+	return chapters
+}
+
+// formatSkeleton renders the required chapters for prompt input
+func formatSkeleton(spec *ReportTypeSpec) string {
+	if spec == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for i, chapter := range spec.Chapters {
+		b.WriteString(fmt.Sprintf("%d. %s (%s重要度)\n   %s\n", i+1, chapter.Title, chapter.Importance, chapter.Description))
+	}
+	return b.String()
+}
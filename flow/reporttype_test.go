@@ -0,0 +1,87 @@
+package flow
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveReportType(t *testing.T) {
+	spec, err := resolveReportType(testReportTypeDir, &DeepResearchInput{ReportType: ReportTypeMarket})
+	if err != nil {
+		t.Fatalf("market: %v", err)
+	}
+	if spec.Name != "market" || len(spec.Chapters) == 0 || spec.PlanningGuidance == "" || spec.SynthesisGuidance == "" {
+		t.Errorf("market spec = %+v", spec)
+	}
+
+	if spec, err := resolveReportType(testReportTypeDir, &DeepResearchInput{}); spec != nil || err != nil {
+		t.Errorf("no report type: got %v, %v", spec, err)
+	}
+
+	dir := t.TempDir()
+	custom := "chapters:\n  - title: 背景\n    importance: high\n"
+	if err := os.WriteFile(filepath.Join(dir, "brief.yaml"), []byte(custom), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spec, err = resolveReportType(dir, &DeepResearchInput{ReportType: ReportTypeCustom, CustomReportType: "brief"})
+	if err != nil {
+		t.Fatalf("custom: %v", err)
+	}
+	if spec.Name != "brief" || spec.guidance(PhasePlanning) != "" {
+		t.Errorf("custom spec = %+v, want the file name and no guidance", spec)
+	}
+
+	for name, input := range map[string]*DeepResearchInput{
+		"unknown type":        {ReportType: "poetry"},
+		"custom without name": {ReportType: ReportTypeCustom},
+		"custom path":         {ReportType: ReportTypeCustom, CustomReportType: "../secrets"},
+		"missing file":        {ReportType: ReportTypeCustom, CustomReportType: "nope"},
+	} {
+		if _, err := resolveReportType(dir, input); err == nil {
+			t.Errorf("%s: resolveReportType accepted %+v", name, input)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "empty.yaml"), []byte("name: empty\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveReportType(dir, &DeepResearchInput{ReportType: ReportTypeCustom, CustomReportType: "empty"}); err == nil || !strings.Contains(err.Error(), "no chapters") {
+		t.Errorf("a type without chapters: err = %v", err)
+	}
+}
+
+func TestApplySkeleton(t *testing.T) {
+	spec := &ReportTypeSpec{Chapters: []ChapterInfo{
+		{Title: "概要", Description: "skeleton overview", Importance: "high"},
+		{Title: "結論", Description: "skeleton conclusion", Importance: "high"},
+	}}
+	planned := []ChapterInfo{
+		{Title: "付録", Description: "extra", Importance: "low", Questions: []int{3}},
+		{Title: "結論", Description: "planned conclusion", Importance: "low", Questions: []int{2}},
+		{Title: "概要", Importance: "medium", Questions: []int{1}},
+	}
+
+	got := applySkeleton(planned, spec)
+	var titles []string
+	for _, c := range got {
+		titles = append(titles, c.Title)
+	}
+	if want := []string{"概要", "結論", "付録"}; !slices.Equal(titles, want) {
+		t.Fatalf("titles = %v, want %v", titles, want)
+	}
+	// The skeleton keeps its importance and takes the planner's description and questions
+	if got[0].Description != "skeleton overview" || !slices.Equal(got[0].Questions, []int{1}) || got[0].Importance != "high" {
+		t.Errorf("overview = %+v", got[0])
+	}
+	if got[1].Description != "planned conclusion" || !slices.Equal(got[1].Questions, []int{2}) || got[1].Importance != "high" {
+		t.Errorf("conclusion = %+v", got[1])
+	}
+
+	if got := applySkeleton(planned, nil); !reflect.DeepEqual(got, planned) {
+		t.Errorf("without a report type the plan changed: %v", got)
+	}
+}
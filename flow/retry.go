@@ -0,0 +1,256 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+	"github.com/openai/openai-go"
+	"google.golang.org/genai"
+)
+
+// ErrorClass groups model call failures by how the flow should react to them
+type ErrorClass string
+
+const (
+	ErrorClassRateLimit       ErrorClass = "rate_limit"
+	ErrorClassInternal        ErrorClass = "internal"
+	ErrorClassInvalidArgument ErrorClass = "invalid_argument"
+	ErrorClassSafety          ErrorClass = "safety"
+	ErrorClassCanceled        ErrorClass = "canceled"
+	ErrorClassUnknown         ErrorClass = "unknown"
+)
+
+// Retryable reports whether a failure of this class may succeed when repeated
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorClassRateLimit || c == ErrorClassInternal
+}
+
+// ModelError is a model call failure after the retry policy gave up
+type ModelError struct {
+	Class    ErrorClass
+	Attempts int
+	Err      error
+}
+
+func (e *ModelError) Error() string {
+	return fmt.Sprintf("model call failed (%s) after %d attempt(s): %v", e.Class, e.Attempts, e.Err)
+}
+
+func (e *ModelError) Unwrap() error {
+	return e.Err
+}
+
+// errBlocked marks a response the model refused to produce
+var errBlocked = errors.New("response blocked by safety filters")
+
+// ClassifyError maps provider and Genkit errors onto an ErrorClass
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassCanceled
+	}
+	if errors.Is(err, errBlocked) {
+		return ErrorClassSafety
+	}
+
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		if c := classifyHTTPStatus(apiErr.Code); c != ErrorClassUnknown {
+			return c
+		}
+		return classifyStatusName(apiErr.Status)
+	}
+	var apiErrPtr *genai.APIError
+	if errors.As(err, &apiErrPtr) {
+		if c := classifyHTTPStatus(apiErrPtr.Code); c != ErrorClassUnknown {
+			return c
+		}
+		return classifyStatusName(apiErrPtr.Status)
+	}
+
+	var genkitErr *core.GenkitError
+	if errors.As(err, &genkitErr) {
+		return classifyStatusName(string(genkitErr.Status))
+	}
+
+	var openaiErr *openai.Error
+	if errors.As(err, &openaiErr) {
+		return classifyHTTPStatus(openaiErr.StatusCode)
+	}
+
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		if providerErr.StatusCode == 0 {
+			return ErrorClassInternal
+		}
+		return classifyHTTPStatus(providerErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorClassInternal
+	}
+
+	return ErrorClassUnknown
+}
+
+// ProviderError is a model call failure that a plugin reports only as text,
+// typed where it leaves the plugin, see providerErrors
+type ProviderError struct {
+	Provider string
+	// StatusCode is the HTTP status the server answered with, or 0 when it
+	// could not be reached
+	StatusCode int
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// The Ollama plugin's HTTP failures start with these
+const (
+	ollamaStatusPrefix      = "server returned non-200 status: "
+	ollamaUnreachablePrefix = "failed to send request: "
+)
+
+// providerErrors types the errors of plugins that flatten them to text, so
+// that ClassifyError needs no message matching. It runs next to the model.
+func providerErrors(model string) ai.ModelMiddleware {
+	provider, _, _ := strings.Cut(model, "/")
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			resp, err := next(ctx, req, cb)
+			if err == nil || provider != "ollama" {
+				return resp, err
+			}
+			msg := err.Error()
+			if rest, ok := strings.CutPrefix(msg, ollamaStatusPrefix); ok {
+				var code int
+				if _, serr := fmt.Sscanf(rest, "%d", &code); serr == nil {
+					return nil, &ProviderError{Provider: provider, StatusCode: code, Err: err}
+				}
+			}
+			if strings.HasPrefix(msg, ollamaUnreachablePrefix) {
+				return nil, &ProviderError{Provider: provider, Err: err}
+			}
+			return nil, err
+		}
+	}
+}
+
+func classifyHTTPStatus(code int) ErrorClass {
+	switch {
+	case code == 429:
+		return ErrorClassRateLimit
+	case code == 500 || code == 502 || code == 503 || code == 504:
+		return ErrorClassInternal
+	case code == 400 || code == 404 || code == 422:
+		return ErrorClassInvalidArgument
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+func classifyStatusName(status string) ErrorClass {
+	switch core.StatusName(status) {
+	case core.RESOURCE_EXHAUSTED:
+		return ErrorClassRateLimit
+	case core.INTERNAL, "INTERNAL", core.UNAVAILABLE, core.DEADLINE_EXCEEDED:
+		return ErrorClassInternal
+	case core.INVALID_ARGUMENT, core.FAILED_PRECONDITION, core.OUT_OF_RANGE, core.NOT_FOUND:
+		return ErrorClassInvalidArgument
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+// RetryPolicy retries transient model failures with exponential backoff and jitter
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+	// Jitter randomises each backoff by up to this fraction in either direction
+	Jitter float64 `yaml:"jitter"`
+}
+
+// DefaultRetryPolicy is used when no policy is configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// Validate rejects policies that would never call the model or never back off
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("retry maxAttempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("retry backoff must satisfy 0 <= initialBackoff <= maxBackoff")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("retry multiplier must be at least 1, got %v", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// backoff returns the wait before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(retry-1))
+	d = math.Min(d, float64(p.MaxBackoff))
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// middleware retries a single model request, so tool calls that already ran
+// within the same prompt execution are not repeated
+func (p RetryPolicy) middleware(phase string) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			for attempt := 1; ; attempt++ {
+				resp, err := next(ctx, req, cb)
+				if err == nil && resp.FinishReason == ai.FinishReasonBlocked {
+					err = fmt.Errorf("%w: %s", errBlocked, resp.FinishMessage)
+				}
+				if err == nil {
+					return resp, nil
+				}
+
+				class := ClassifyError(err)
+				if !class.Retryable() || attempt >= p.MaxAttempts {
+					return nil, &ModelError{Class: class, Attempts: attempt, Err: err}
+				}
+
+				wait := p.backoff(attempt)
+				log.Printf("%s: model call failed (%s), retrying in %s (attempt %d/%d): %v", phase, class, wait, attempt+1, p.MaxAttempts, err)
+				select {
+				case <-ctx.Done():
+					return nil, &ModelError{Class: ErrorClassCanceled, Attempts: attempt, Err: ctx.Err()}
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+}
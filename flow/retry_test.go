@@ -0,0 +1,128 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/openai/openai-go"
+	"google.golang.org/genai"
+
+	"research/internal/fakemodel"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+	Multiplier:     2,
+}
+
+// withTestRetry runs phases with a retry policy that does not slow tests down
+func withTestRetry(ctx context.Context) context.Context {
+	return withRunState(ctx, &runState{retry: testRetryPolicy})
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"}, ErrorClassRateLimit},
+		{fmt.Errorf("wrapped: %w", genai.APIError{Code: 500, Status: "INTERNAL"}), ErrorClassInternal},
+		{genai.APIError{Code: 503, Status: "UNAVAILABLE"}, ErrorClassInternal},
+		{genai.APIError{Code: 400, Status: "INVALID_ARGUMENT"}, ErrorClassInvalidArgument},
+		{core.NewError(core.RESOURCE_EXHAUSTED, "quota"), ErrorClassRateLimit},
+		{core.NewError(core.INVALID_ARGUMENT, "bad schema"), ErrorClassInvalidArgument},
+		{fmt.Errorf("failed to create completion: %w", openaiError(429)), ErrorClassRateLimit},
+		{fmt.Errorf("failed to create completion: %w", openaiError(503)), ErrorClassInternal},
+		{&ProviderError{Provider: "ollama", StatusCode: 400, Err: errors.New("bad request")}, ErrorClassInvalidArgument},
+		{&ProviderError{Provider: "ollama", Err: errors.New("connection refused")}, ErrorClassInternal},
+		// Messages alone are not classified
+		{errors.New("Error 500, Message: Internal error encountered., Status: INTERNAL"), ErrorClassUnknown},
+		{fmt.Errorf("%w: SAFETY", errBlocked), ErrorClassSafety},
+		{context.Canceled, ErrorClassCanceled},
+		{errors.New("something else"), ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		if got := ClassifyError(tt.err); got != tt.want {
+			t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// openaiError is the error the OpenAI client returns for an HTTP status
+func openaiError(status int) *openai.Error {
+	return &openai.Error{
+		StatusCode: status,
+		Request:    httptest.NewRequest(http.MethodPost, "http://localhost/v1/chat/completions", nil),
+		Response:   &http.Response{StatusCode: status},
+	}
+}
+
+func TestProviderErrorsTypesOllamaFailures(t *testing.T) {
+	tests := []struct {
+		model string
+		err   error
+		want  ErrorClass
+	}{
+		{"ollama/llama3.1", errors.New("server returned non-200 status: 503, body: busy"), ErrorClassInternal},
+		{"ollama/llama3.1", errors.New("server returned non-200 status: 404, body: model not found"), ErrorClassInvalidArgument},
+		{"ollama/llama3.1", errors.New("failed to send request: dial tcp: connection refused"), ErrorClassInternal},
+		{"ollama/llama3.1", errors.New("failed to parse response: EOF"), ErrorClassUnknown},
+		// Other providers keep their errors as they are
+		{"local/llama3.1", errors.New("server returned non-200 status: 503, body: busy"), ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		model := providerErrors(tt.model)(func(context.Context, *ai.ModelRequest, ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			return nil, tt.err
+		})
+		_, err := model(context.Background(), &ai.ModelRequest{}, nil)
+		if got := ClassifyError(err); got != tt.want {
+			t.Errorf("%s %q: class = %q, want %q", tt.model, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Multiplier: 2, Jitter: 0.1}
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second, 4: 3 * time.Second} {
+		got := p.backoff(retry)
+		if got < want*9/10 || got > want*11/10 {
+			t.Errorf("backoff(%d) = %v, want %v ±10%%", retry, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	if err := DefaultRetryPolicy.Validate(); err != nil {
+		t.Errorf("default policy is invalid: %v", err)
+	}
+	if err := (RetryPolicy{MaxAttempts: 0, Multiplier: 2}).Validate(); err == nil {
+		t.Error("expected an error for zero attempts")
+	}
+}
+
+func TestSafetyBlockIsNotRetried(t *testing.T) {
+	g, fake := newTestGenkit(t)
+
+	fake.On(fakemodel.Prompt(g, "summary"), func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		return &ai.ModelResponse{FinishReason: ai.FinishReasonBlocked, FinishMessage: "SAFETY"}, nil
+	})
+
+	_, err := executePrompt(withTestRetry(context.Background()), genkit.LookupPrompt(g, "summary"), PhaseSummary,
+		ai.WithInput(map[string]any{"topic": "Go", "detailedReport": "Go is simple.", "language": "日本語"}))
+	if ClassifyError(err) != ErrorClassSafety {
+		t.Errorf("err = %v, want safety block", err)
+	}
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model called %d times, want 1", calls)
+	}
+}
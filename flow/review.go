@@ -0,0 +1,114 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+type DraftReviewResult struct {
+	Decision PlanDecision      `json:"decision"`
+	Feedback []ChapterFeedback `json:"feedback,omitempty"`
+}
+
+// maxReviewIterations bounds the rounds of draft review, as for plan confirmation
+const maxReviewIterations = 10
+
+// draftReviewPhase shows the latest report version to the user and revises
+// the chapters they comment on until they approve. Like planConfirmationPhase
+// it returns errPaused with the question recorded in the run's review state
+// when asking through an interrupt tool.
+func draftReviewPhase(ctx context.Context, g *genkit.Genkit, cfg DeepResearchConfig, run *Run, reply string, toolRefs []ai.ToolRef, reportType *ReportTypeSpec) error {
+	reviewPrompt := genkit.LookupPrompt(g, "draft_review")
+	if reviewPrompt == nil {
+		return promptNotFound(PhaseDraftReview, "draft_review")
+	}
+
+	if run.Review == nil {
+		run.Review = &ReviewState{}
+	}
+	state := run.Review
+
+	for ; state.Iteration < maxReviewIterations; state.Iteration++ {
+		latest := run.Reports[len(run.Reports)-1]
+		input := map[string]any{
+			"draft":              formatReport(&SynthesisResult{Chapters: latest.Chapters, StructureChanges: latest.StructureChanges}),
+			"isFirstTime":        state.Iteration == 0,
+			"needsClarification": state.NeedsClarification,
+			"language":           runLanguage(&run.Input),
+		}
+
+		var resp *ai.ModelResponse
+		var err error
+		if state.Question != "" {
+			if reply == "" {
+				return &PhaseError{Phase: PhaseDraftReview, Cause: ErrInvalidInput, Err: errors.New("a reply is required to resume the draft review")}
+			}
+			resp, err = resumePrompt(ctx, g, reviewPrompt, PhaseDraftReview, input, state.History, reply, toolRefs)
+			reply = ""
+		} else {
+			resp, err = executePrompt(ctx, reviewPrompt, PhaseDraftReview,
+				ai.WithInput(input),
+				ai.WithTools(toolRefs...))
+		}
+		if err != nil {
+			return phaseError(PhaseDraftReview, fmt.Errorf("iteration %d: %w", state.Iteration+1, err))
+		}
+
+		if resp.FinishReason == ai.FinishReasonInterrupted {
+			state.Question = interruptQuestion(resp)
+			state.History = resp.History()
+			return errPaused
+		}
+		state.Question, state.History = "", nil
+
+		var result DraftReviewResult
+		if err := resp.Output(&result); err != nil {
+			return invalidOutput(PhaseDraftReview, err)
+		}
+
+		state.NeedsClarification = false
+		feedback := validFeedback(result.Feedback, len(latest.Chapters))
+		switch {
+		case result.Decision == PlanApprove:
+			return nil
+		case result.Decision == PlanRevise && len(feedback) > 0:
+			if err := reviseChapters(ctx, g, cfg, run, feedback, reportType); err != nil {
+				return err
+			}
+		default:
+			log.Printf("draft review: no clear decision in reply (%q), asking the user again", result.Decision)
+			state.NeedsClarification = true
+		}
+	}
+
+	return &PhaseError{
+		Phase: PhaseDraftReview,
+		Cause: ErrNotApproved,
+		Err:   fmt.Errorf("maximum iterations (%d) reached for draft review", maxReviewIterations),
+	}
+}
+
+// validFeedback drops feedback for chapters the report does not have and
+// merges feedback given twice for the same chapter
+func validFeedback(feedback []ChapterFeedback, chapters int) []ChapterFeedback {
+	var valid []ChapterFeedback
+	index := map[int]int{}
+	for _, f := range feedback {
+		if f.Chapter < 1 || f.Chapter > chapters {
+			log.Printf("draft review: ignoring feedback for unknown chapter %d", f.Chapter)
+			continue
+		}
+		if i, ok := index[f.Chapter]; ok {
+			valid[i].Instruction += "\n" + f.Instruction
+			continue
+		}
+		index[f.Chapter] = len(valid)
+		valid = append(valid, f)
+	}
+	return valid
+}
@@ -0,0 +1,97 @@
+package flow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+// scriptTwoChapters makes synthesis return two chapters
+func scriptTwoChapters(g *genkit.Genkit, fake *fakemodel.Plugin) {
+	fake.On(fakemodel.Prompt(g, "synthesis"), fakemodel.JSON(SynthesisResult{
+		Chapters: []ChapterContent{
+			{Title: "概要", Content: "Go is simple.", Importance: "high"},
+			{Title: "コスト", Content: "Go is cheap to run.", Importance: "medium"},
+		},
+	}))
+}
+
+func TestDraftReviewRevisesChaptersUntilApproved(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptTwoChapters(g, fake)
+	fake.On(fakemodel.Prompt(g, "draft_review"),
+		fakemodel.JSON(DraftReviewResult{Decision: PlanRevise, Feedback: []ChapterFeedback{
+			{Chapter: 2, Instruction: "add cost comparison"},
+			{Chapter: 5, Instruction: "no such chapter"},
+		}}),
+		fakemodel.JSON(DraftReviewResult{Decision: PlanApprove}),
+	)
+	fake.On(fakemodel.Contains("担当する章: 2. コスト"), fakemodel.JSON(ChapterDraft{Title: "コスト", Content: "Go costs less than Java to run."}))
+	scriptDeepResearch(g, fake)
+
+	got, err := DeepResearchFlow(g, user.Tools(), DeepResearchConfig{}).Run(context.Background(), &DeepResearchInput{Topic: "Go", Review: true})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	want := "1. 概要\nGo is simple.\n\n2. コスト\nGo costs less than Java to run.\n\n"
+	if got.ReportVersion != 2 || got.DetailedReport != want {
+		t.Errorf("got version %d report %q, want version 2 report %q", got.ReportVersion, got.DetailedReport, want)
+	}
+
+	var reviews []string
+	delivered := false
+	for _, req := range fake.Calls() {
+		text := fakemodel.RequestText(req)
+		if fakemodel.Prompt(g, "draft_review")(req) {
+			reviews = append(reviews, text)
+		}
+		if fakemodel.Prompt(g, "report_delivery")(req) && strings.Contains(text, "Go costs less than Java") {
+			delivered = true
+		}
+	}
+	if len(reviews) != 2 || !strings.Contains(reviews[1], "Go costs less than Java to run.") {
+		t.Errorf("want a second review showing the revised chapter, got %d reviews", len(reviews))
+	}
+	if !delivered {
+		t.Error("the revised report was not delivered")
+	}
+}
+
+func TestDraftReviewPausesAndResumes(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptTwoChapters(g, fake)
+	review := fakemodel.Prompt(g, "draft_review")
+	fake.On(fakemodel.All(review, fakemodel.HasToolResponse(AskUserTool)), fakemodel.JSON(DraftReviewResult{Decision: PlanApprove}))
+	fake.On(review, fakemodel.ToolCall(AskUserTool, map[string]any{"question": "この草稿でよろしいですか？"}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Retry: testRetryPolicy, Runs: NewMemoryRunStore()}
+	paused, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go", Review: true})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	if paused.Status != RunPaused || paused.PendingQuestion != "この草稿でよろしいですか？" || !strings.Contains(paused.DetailedReport, "Go is simple.") {
+		t.Fatalf("got %+v, want a paused run showing the draft", paused)
+	}
+
+	done, err := ResumeDeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &ResumeInput{RunID: paused.RunID, Reply: "これで完成です"})
+	if err != nil {
+		t.Fatalf("resumeDeepResearchFlow failed: %v", err)
+	}
+	if done.Status != RunCompleted || done.PendingQuestion != "" || done.ReportVersion != 1 {
+		t.Errorf("got %+v, want the completed first version", done)
+	}
+	for _, req := range fake.Calls() {
+		if fakemodel.Prompt(g, "plan_confirmation")(req) && toolResponseOutput(req, AskUserTool) != nil {
+			t.Error("the reply was sent to plan confirmation")
+		}
+	}
+}
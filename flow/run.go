@@ -0,0 +1,79 @@
+package flow
+
+import "context"
+
+// runState carries the settings resolved for a single flow run
+type runState struct {
+	runID  string
+	models ModelConfig
+	// defaultModel is the model of prompts that name none
+	defaultModel string
+	retry        RetryPolicy
+	effort       ResearchEffortConfig
+	synthesis    SynthesisConfig
+	outputs      *outputStats
+	usage        *usageStats
+	cache        *ResponseCache
+	caching      *cacheStats
+	// bypassCache skips cache lookups; fresh responses are still stored
+	bypassCache bool
+	// budget is only enforced within deepResearchFlow, its resumption and
+	// chapter regeneration
+	budget  *budgetGuard
+	limiter *RateLimiter
+	// tools limits the tools of each phase of deepResearchFlow
+	tools phaseTools
+}
+
+type runStateKey struct{}
+
+// withRunState scopes the resolved settings to a single flow run
+func withRunState(ctx context.Context, s *runState) context.Context {
+	return context.WithValue(ctx, runStateKey{}, s)
+}
+
+// runStateFrom returns the run's settings, or defaults outside a run
+func runStateFrom(ctx context.Context) *runState {
+	if s, ok := ctx.Value(runStateKey{}).(*runState); ok {
+		return s
+	}
+	return &runState{retry: DefaultRetryPolicy}
+}
+
+type callerKey struct{}
+
+// WithCaller attributes the runs started or changed with ctx to caller, such
+// as the name of the API key a request was made with
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Caller returns who ctx is attributed to, or "" for unauthenticated requests
+func Caller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+type adminKey struct{}
+
+// WithAdmin lets the caller of ctx resume and regenerate runs that other
+// callers started
+func WithAdmin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, adminKey{}, true)
+}
+
+// IsAdmin reports whether ctx was marked with WithAdmin
+func IsAdmin(ctx context.Context) bool {
+	admin, _ := ctx.Value(adminKey{}).(bool)
+	return admin
+}
+
+// FlowNames are the flows this package defines, for configuration that
+// refers to them by name
+var FlowNames = []string{
+	"deepResearchFlow",
+	"resumeDeepResearchFlow",
+	"regenerateChapterFlow",
+	"recipeGeneratorFlow",
+	"simpleFlow",
+}
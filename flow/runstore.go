@@ -0,0 +1,407 @@
+package flow
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+var (
+	ErrRunNotFound  = errors.New("run not found")
+	ErrRunNotPaused = errors.New("run is not waiting for a reply")
+	// ErrRunNotCompleted is returned for changes to a report that does not exist yet
+	ErrRunNotCompleted = errors.New("run has no completed report")
+	// ErrRunBusy is returned while another request holds the claim on a run
+	ErrRunBusy = errors.New("run is being changed by another request")
+	// ErrForbidden is returned for changes to a run another caller started
+	ErrForbidden = errors.New("run belongs to another caller")
+)
+
+// RunStatus is the lifecycle state of a deep research run
+type RunStatus string
+
+const (
+	RunRunning   RunStatus = "running"
+	RunPaused    RunStatus = "paused"
+	RunCompleted RunStatus = "completed"
+	RunFailed    RunStatus = "failed"
+)
+
+// Run is the persisted state of a deep research run, enough to resume it
+// after the process that started it has gone away
+type Run struct {
+	ID            string              `json:"id"`
+	Status        RunStatus           `json:"status"`
+	Input         DeepResearchInput   `json:"input"`
+	Clarification *ClarificationState `json:"clarification,omitempty"`
+	Planning      *PlanningResult     `json:"planning,omitempty"`
+	Confirmation  *ConfirmationState  `json:"confirmation,omitempty"`
+	Review        *ReviewState        `json:"review,omitempty"`
+	Result        *DeepResearchResult `json:"result,omitempty"`
+	// Reports holds every version of the report, oldest first; Result shows the latest
+	Reports []ReportVersion `json:"reports,omitempty"`
+	// OutputRepairs carries the repair counts of earlier requests across pauses
+	OutputRepairs map[string]OutputRepairStats `json:"outputRepairs,omitempty"`
+	// Usage carries the token usage of earlier requests across pauses and report versions
+	Usage *RunUsage `json:"usage,omitempty"`
+	// Cache carries the cache stats of earlier requests
+	Cache map[string]CacheStats `json:"cache,omitempty"`
+	// ClaimedUntil is when the claim of the request changing the run lapses,
+	// so that a claim left behind by a crashed process does not block the run
+	ClaimedUntil time.Time `json:"claimedUntil,omitzero"`
+	// Elapsed is the time spent working on the run, not counting pauses
+	Elapsed   time.Duration `json:"elapsed,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+	// CreatedBy and UpdatedBy are the callers that started the run and last
+	// changed it, empty when the server does not authenticate requests
+	CreatedBy string `json:"createdBy,omitempty"`
+	UpdatedBy string `json:"updatedBy,omitempty"`
+}
+
+// ConfirmationState is where plan confirmation stands between user replies
+type ConfirmationState struct {
+	CurrentPlan        string `json:"currentPlan"`
+	Iteration          int    `json:"iteration"`
+	NeedsClarification bool   `json:"needsClarification,omitempty"`
+	// Question is the pending question while the run is paused
+	Question string `json:"question,omitempty"`
+	// History is the conversation up to the interrupted tool call
+	History []*ai.Message `json:"history,omitempty"`
+}
+
+// ReportVersion is one version of a run's report
+type ReportVersion struct {
+	Version          int              `json:"version"`
+	Chapters         []ChapterContent `json:"chapters"`
+	StructureChanges string           `json:"structureChanges,omitempty"`
+	Summary          string           `json:"summary"`
+	// Revisions lists the chapters redrafted for this version; empty for a full synthesis
+	Revisions []ChapterFeedback `json:"revisions,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	// CreatedBy is the caller whose request produced this version
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+// ReviewState is where the draft review stands between user replies
+type ReviewState struct {
+	Iteration          int  `json:"iteration"`
+	NeedsClarification bool `json:"needsClarification,omitempty"`
+	// Question is the pending question while the run is paused
+	Question string `json:"question,omitempty"`
+	// History is the conversation up to the interrupted tool call
+	History []*ai.Message `json:"history,omitempty"`
+}
+
+// pendingQuestion returns the question a paused run waits on
+func (r *Run) pendingQuestion() string {
+	if r.Review != nil && r.Review.Question != "" {
+		return r.Review.Question
+	}
+	if r.Confirmation != nil && r.Confirmation.Question != "" {
+		return r.Confirmation.Question
+	}
+	if r.Clarification != nil {
+		return r.Clarification.Question
+	}
+	return ""
+}
+
+// RunStore persists runs so that a paused run can be resumed by a later request
+type RunStore interface {
+	Save(ctx context.Context, run *Run) error
+	// Load returns ErrRunNotFound for unknown ids
+	Load(ctx context.Context, id string) (*Run, error)
+	// Claim atomically moves a run from status from to status to and returns
+	// it, so that two requests cannot both act on the same run. A run in
+	// another status is left alone: claiming from paused then fails with
+	// ErrRunNotPaused, from completed with ErrRunNotCompleted. With a lease
+	// the run stays claimed for that long, or until it is saved, and claims
+	// in the meantime fail with ErrRunBusy. Once the lease has lapsed, a run
+	// left in status to, e.g. by a process that crashed, can be claimed again.
+	Claim(ctx context.Context, id string, from, to RunStatus, lease time.Duration) (*Run, error)
+	// Renew extends the lease of a claim still held, identified by held, when
+	// it lapses, and returns when the renewed lease lapses. It fails with
+	// ErrRunBusy once the run was saved or claimed again.
+	Renew(ctx context.Context, id string, held time.Time, lease time.Duration) (time.Time, error)
+}
+
+// claimErrors are what Claim wraps when a run is not in the status claimed from
+var claimErrors = map[RunStatus]error{
+	RunPaused:    ErrRunNotPaused,
+	RunCompleted: ErrRunNotCompleted,
+}
+
+// claim moves run from status from to status to, see RunStore.Claim
+func claim(run *Run, from, to RunStatus, lease time.Duration) error {
+	now := time.Now()
+	abandoned := run.Status == to && !run.ClaimedUntil.IsZero()
+	if run.Status != from && !abandoned {
+		if err, ok := claimErrors[from]; ok {
+			return fmt.Errorf("%w: run %s is %s", err, run.ID, run.Status)
+		}
+		return fmt.Errorf("run %s is %s, not %s", run.ID, run.Status, from)
+	}
+	if now.Before(run.ClaimedUntil) {
+		return fmt.Errorf("%w: run %s is claimed until %s", ErrRunBusy, run.ID, run.ClaimedUntil.Format(time.RFC3339))
+	}
+	run.Status = to
+	run.ClaimedUntil = time.Time{}
+	if lease > 0 {
+		run.ClaimedUntil = now.Add(lease)
+	}
+	return nil
+}
+
+// renew extends the lease on run, see RunStore.Renew
+func renew(run *Run, held time.Time, lease time.Duration) error {
+	if held.IsZero() || !run.ClaimedUntil.Equal(held) {
+		return fmt.Errorf("%w: run %s is no longer claimed by this request", ErrRunBusy, run.ID)
+	}
+	run.ClaimedUntil = time.Now().Add(lease)
+	return nil
+}
+
+// holdClaim renews the lease on run every third of lease until the returned
+// function is called, so that a long request keeps its claim while the claim
+// of a crashed one lapses soon. Renewing ends once the run is saved.
+func holdClaim(ctx context.Context, runs RunStore, run *Run, lease time.Duration) func() {
+	id, held := run.ID, run.ClaimedUntil
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			until, err := runs.Renew(ctx, id, held, lease)
+			if errors.Is(err, ErrRunBusy) {
+				return
+			}
+			if err != nil {
+				log.Printf("failed to renew the claim on run %s: %v", id, err)
+				continue
+			}
+			held = until
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// authorizeRun returns an error wrapping ErrForbidden unless the caller of
+// ctx started run or is an admin. Unauthenticated requests are let through,
+// since without API keys runs have no owner to check against.
+func authorizeRun(ctx context.Context, run *Run) error {
+	caller := Caller(ctx)
+	if caller == "" || caller == run.CreatedBy || IsAdmin(ctx) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s may not change run %s", ErrForbidden, caller, run.ID)
+}
+
+// newRunID returns a random, URL-safe run id
+func newRunID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type memoryRunStore struct {
+	mu   sync.Mutex
+	runs map[string][]byte
+}
+
+// NewMemoryRunStore keeps runs in memory; paused runs are lost on restart
+func NewMemoryRunStore() RunStore {
+	return &memoryRunStore{runs: map[string][]byte{}}
+}
+
+func (s *memoryRunStore) Save(ctx context.Context, run *Run) error {
+	// Store a copy so callers can keep mutating their run
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("failed to encode run %s: %w", run.ID, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.ID] = data
+	return nil
+}
+
+func (s *memoryRunStore) Load(ctx context.Context, id string) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+// load decodes the stored run; s.mu must be held
+func (s *memoryRunStore) load(id string) (*Run, error) {
+	data, ok := s.runs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to decode run %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+func (s *memoryRunStore) Claim(ctx context.Context, id string, from, to RunStatus, lease time.Duration) (*Run, error) {
+	return s.update(id, func(run *Run) error { return claim(run, from, to, lease) })
+}
+
+func (s *memoryRunStore) Renew(ctx context.Context, id string, held time.Time, lease time.Duration) (time.Time, error) {
+	run, err := s.update(id, func(run *Run) error { return renew(run, held, lease) })
+	if err != nil {
+		return time.Time{}, err
+	}
+	return run.ClaimedUntil, nil
+}
+
+// update applies change to the stored run atomically, storing it unless
+// change fails
+func (s *memoryRunStore) update(id string, change func(*Run) error) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := change(run); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode run %s: %w", run.ID, err)
+	}
+	s.runs[id] = data
+	return run, nil
+}
+
+type fileRunStore struct {
+	dir string
+	// locks holds a *sync.Mutex per run id, serializing the writes and
+	// claims of one run within the process
+	locks sync.Map
+}
+
+// NewFileRunStore keeps one <id>.json file per run in dir. Claims are atomic
+// among the requests of one process, which must be the only one using dir.
+func NewFileRunStore(dir string) RunStore {
+	return &fileRunStore{dir: dir}
+}
+
+func (s *fileRunStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `./\`) {
+		return "", fmt.Errorf("%w: invalid id %q", ErrRunNotFound, id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// lock takes the lock of run id and returns its unlock function
+func (s *fileRunStore) lock(id string) func() {
+	mu, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (s *fileRunStore) Save(ctx context.Context, run *Run) error {
+	defer s.lock(run.ID)()
+	return s.save(run)
+}
+
+// save writes the run; its lock must be held
+func (s *fileRunStore) save(run *Run) error {
+	path, err := s.path(run.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run %s: %w", run.ID, err)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create run directory: %w", err)
+	}
+	// Write to a temporary file first so a crash never leaves a truncated run
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write run %s: %w", run.ID, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write run %s: %w", run.ID, err)
+	}
+	return nil
+}
+
+func (s *fileRunStore) Load(ctx context.Context, id string) (*Run, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run %s: %w", id, err)
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to decode run %s: %w", id, err)
+	}
+	return &run, nil
+}
+
+func (s *fileRunStore) Claim(ctx context.Context, id string, from, to RunStatus, lease time.Duration) (*Run, error) {
+	return s.update(ctx, id, func(run *Run) error { return claim(run, from, to, lease) })
+}
+
+func (s *fileRunStore) Renew(ctx context.Context, id string, held time.Time, lease time.Duration) (time.Time, error) {
+	run, err := s.update(ctx, id, func(run *Run) error { return renew(run, held, lease) })
+	if err != nil {
+		return time.Time{}, err
+	}
+	return run.ClaimedUntil, nil
+}
+
+// update applies change to the stored run under its lock, storing it unless
+// change fails
+func (s *fileRunStore) update(ctx context.Context, id string, change func(*Run) error) (*Run, error) {
+	if _, err := s.path(id); err != nil {
+		return nil, err
+	}
+	defer s.lock(id)()
+	run, err := s.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := change(run); err != nil {
+		return nil, err
+	}
+	if err := s.save(run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
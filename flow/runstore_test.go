@@ -0,0 +1,201 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+func TestFileRunStoreRoundTrip(t *testing.T) {
+	store := NewFileRunStore(t.TempDir())
+	ctx := context.Background()
+
+	interrupt := ai.NewToolRequestPart(&ai.ToolRequest{Name: AskUserTool, Input: map[string]any{"question": "OK?"}})
+	interrupt.Metadata = map[string]any{"interrupt": map[string]any{"question": "OK?"}}
+	run := &Run{
+		ID:     newRunID(),
+		Status: RunPaused,
+		Input:  DeepResearchInput{Topic: "Go"},
+		Confirmation: &ConfirmationState{
+			CurrentPlan: "plan",
+			Question:    "OK?",
+			History:     []*ai.Message{ai.NewUserTextMessage("confirm"), ai.NewModelMessage(interrupt)},
+		},
+	}
+	if err := store.Save(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Load(ctx, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != RunPaused || got.Input.Topic != "Go" || len(got.Confirmation.History) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	if !got.Confirmation.History[1].Content[0].IsInterrupt() {
+		t.Error("interrupt metadata was lost")
+	}
+
+	if _, err := store.Load(ctx, "../escape"); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("err = %v, want ErrRunNotFound", err)
+	}
+}
+
+func TestRunStoreClaim(t *testing.T) {
+	for name, store := range map[string]RunStore{
+		"memory": NewMemoryRunStore(),
+		"file":   NewFileRunStore(t.TempDir()),
+	} {
+		ctx := context.Background()
+		run := &Run{ID: newRunID(), Status: RunPaused, Input: DeepResearchInput{Topic: "Go"}}
+		if err := store.Save(ctx, run); err != nil {
+			t.Fatal(err)
+		}
+
+		// Of the requests racing for the run, exactly one gets it
+		const racers = 8
+		claimed := make(chan error, racers)
+		var wg sync.WaitGroup
+		for range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.Claim(ctx, run.ID, RunPaused, RunRunning, 0)
+				claimed <- err
+			}()
+		}
+		wg.Wait()
+		close(claimed)
+		won := 0
+		for err := range claimed {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrRunNotPaused):
+				t.Errorf("%s: losing claim err = %v, want ErrRunNotPaused", name, err)
+			}
+		}
+		if won != 1 {
+			t.Errorf("%s: %d claims succeeded, want 1", name, won)
+		}
+
+		got, err := store.Load(ctx, run.ID)
+		if err != nil || got.Status != RunRunning || got.Input.Topic != "Go" {
+			t.Errorf("%s: stored run = %+v, %v; want it running", name, got, err)
+		}
+		if _, err := store.Claim(ctx, run.ID, RunCompleted, RunRunning, 0); !errors.Is(err, ErrRunNotCompleted) {
+			t.Errorf("%s: claim of a running run err = %v, want ErrRunNotCompleted", name, err)
+		}
+		if _, err := store.Claim(ctx, "missing", RunPaused, RunRunning, 0); !errors.Is(err, ErrRunNotFound) {
+			t.Errorf("%s: claim of an unknown run err = %v, want ErrRunNotFound", name, err)
+		}
+	}
+}
+
+func TestRunStoreClaimLease(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRunStore()
+	if err := store.Save(ctx, &Run{ID: "done", Status: RunCompleted}); err != nil {
+		t.Fatal(err)
+	}
+
+	run, err := store.Claim(ctx, "done", RunCompleted, RunCompleted, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Claim(ctx, "done", RunCompleted, RunCompleted, time.Hour); !errors.Is(err, ErrRunBusy) {
+		t.Errorf("claim during the lease err = %v, want ErrRunBusy", err)
+	}
+
+	// Saving ends the claim
+	if err := saveRun(ctx, store, run); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Claim(ctx, "done", RunCompleted, RunCompleted, time.Hour); err != nil {
+		t.Errorf("claim after the save err = %v", err)
+	}
+
+	// A claim left behind by a crashed request lapses
+	stale := &Run{ID: "stale", Status: RunCompleted, ClaimedUntil: time.Now().Add(-time.Minute)}
+	if err := store.Save(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Claim(ctx, "stale", RunCompleted, RunCompleted, time.Hour); err != nil {
+		t.Errorf("claim after the lease lapsed err = %v", err)
+	}
+	// So does the claim of a resume that crashed, which left the run running
+	abandoned := &Run{ID: "abandoned", Status: RunRunning, ClaimedUntil: time.Now().Add(time.Minute)}
+	if err := store.Save(ctx, abandoned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Claim(ctx, "abandoned", RunPaused, RunRunning, time.Hour); !errors.Is(err, ErrRunBusy) {
+		t.Errorf("claim of a running run during its lease err = %v, want ErrRunBusy", err)
+	}
+	abandoned.ClaimedUntil = time.Now().Add(-time.Minute)
+	if err := store.Save(ctx, abandoned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Claim(ctx, "abandoned", RunPaused, RunRunning, time.Hour); err != nil {
+		t.Errorf("claim of a running run after its lease lapsed err = %v", err)
+	}
+}
+
+func TestRunStoreRenew(t *testing.T) {
+	for name, store := range map[string]RunStore{
+		"memory": NewMemoryRunStore(),
+		"file":   NewFileRunStore(t.TempDir()),
+	} {
+		ctx := context.Background()
+		if err := store.Save(ctx, &Run{ID: "paused", Status: RunPaused}); err != nil {
+			t.Fatal(err)
+		}
+		run, err := store.Claim(ctx, "paused", RunPaused, RunRunning, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		until, err := store.Renew(ctx, "paused", run.ClaimedUntil, time.Hour)
+		if err != nil || !until.After(run.ClaimedUntil) {
+			t.Errorf("%s: Renew = %v, %v; want the lease extended past %v", name, until, err, run.ClaimedUntil)
+		}
+		if _, err := store.Renew(ctx, "paused", run.ClaimedUntil, time.Hour); !errors.Is(err, ErrRunBusy) {
+			t.Errorf("%s: renewal of a superseded lease err = %v, want ErrRunBusy", name, err)
+		}
+		if err := saveRun(ctx, store, run); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Renew(ctx, "paused", until, time.Hour); !errors.Is(err, ErrRunBusy) {
+			t.Errorf("%s: renewal after the save err = %v, want ErrRunBusy", name, err)
+		}
+	}
+}
+
+func TestHoldClaimKeepsLease(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRunStore()
+	if err := store.Save(ctx, &Run{ID: "paused", Status: RunPaused}); err != nil {
+		t.Fatal(err)
+	}
+	const lease = 30 * time.Millisecond
+	run, err := store.Claim(ctx, "paused", RunPaused, RunRunning, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := holdClaim(ctx, store, run, lease)
+	time.Sleep(5 * lease)
+	if _, err := store.Claim(ctx, "paused", RunPaused, RunRunning, lease); !errors.Is(err, ErrRunBusy) {
+		t.Errorf("claim while the lease is held err = %v, want ErrRunBusy", err)
+	}
+	stop()
+
+	time.Sleep(2 * lease)
+	if _, err := store.Claim(ctx, "paused", RunPaused, RunRunning, lease); err != nil {
+		t.Errorf("claim after the holder stopped err = %v, want the lease lapsed", err)
+	}
+}
@@ -32,7 +32,7 @@ type SimpleInput struct {
 	Input string `json:"input" jsonschema:"description=User input text"`
 }
 
-func SimpleFlow(g *genkit.Genkit, mcpTools []ai.Tool) *core.Flow[*SimpleInput, string, struct{}] {
+func SimpleFlow(g *genkit.Genkit, mcpTools []ai.Tool, limiter *RateLimiter) *core.Flow[*SimpleInput, string, struct{}] {
 	// Define a simple flow that sends input to AI and returns response
 
 	ToolRef := make([]ai.ToolRef, 0, len(mcpTools))
@@ -46,6 +46,7 @@ func SimpleFlow(g *genkit.Genkit, mcpTools []ai.Tool) *core.Flow[*SimpleInput, s
 		response, err := genkit.GenerateText(ctx, g,
 			ai.WithPrompt(input.Input),
 			ai.WithTools(ToolRef...),
+			ai.WithMiddleware(limiter.middleware("", newRunID())),
 		)
 		if err != nil {
 			return "", fmt.Errorf("failed to generate response: %w", err)
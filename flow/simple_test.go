@@ -0,0 +1,50 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+)
+
+func TestSimpleFlow(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	fake.On(fakemodel.Contains("hello"), fakemodel.Text("hi there"))
+
+	got, err := SimpleFlow(g, nil, nil).Run(context.Background(), &SimpleInput{Input: "hello"})
+	if err != nil {
+		t.Fatalf("SimpleFlow failed: %v", err)
+	}
+	if got != "hi there" {
+		t.Errorf("got %q, want %q", got, "hi there")
+	}
+}
+
+func TestSimpleFlowToolCall(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	var asked string
+	chat := genkit.DefineTool(g, "ask-me_chat", "stub ask-me chat",
+		func(ctx *ai.ToolContext, req map[string]any) (map[string]any, error) {
+			asked, _ = req["message"].(string)
+			return map[string]any{"message": "blue", "thread_id": "t1"}, nil
+		})
+	fake.On(fakemodel.HasToolResponse("ask-me_chat"), fakemodel.Text("your favourite colour is blue"))
+	fake.On(fakemodel.Any(), fakemodel.ToolCall("ask-me_chat", map[string]any{"message": "favourite colour?"}))
+
+	got, err := SimpleFlow(g, []ai.Tool{chat}, nil).Run(context.Background(), &SimpleInput{Input: "guess my colour"})
+	if err != nil {
+		t.Fatalf("SimpleFlow failed: %v", err)
+	}
+	if asked != "favourite colour?" {
+		t.Errorf("tool received %q", asked)
+	}
+	if got != "your favourite colour is blue" {
+		t.Errorf("got %q", got)
+	}
+	if n := len(fake.Calls()); n != 2 {
+		t.Errorf("model calls = %d, want 2", n)
+	}
+}
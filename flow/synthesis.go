@@ -0,0 +1,483 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// SynthesisConfig decides when and how the synthesis phase splits its work by chapter
+type SynthesisConfig struct {
+	// TokenBudget is the most findings tokens sent in a single prompt. Runs whose
+	// findings exceed it are drafted chapter by chapter.
+	TokenBudget int `yaml:"tokenBudget"`
+	// Parallelism caps the chapters drafted at the same time
+	Parallelism int `yaml:"parallelism"`
+}
+
+// DefaultSynthesisConfig fits comfortably into the context of the Gemini models
+var DefaultSynthesisConfig = SynthesisConfig{
+	TokenBudget: 100000,
+	Parallelism: 4,
+}
+
+// Validate reports settings that cannot be used
+func (c SynthesisConfig) Validate() error {
+	if c.TokenBudget < 0 {
+		return fmt.Errorf("synthesis.tokenBudget must not be negative, got %d", c.TokenBudget)
+	}
+	if c.Parallelism < 0 {
+		return fmt.Errorf("synthesis.parallelism must not be negative, got %d", c.Parallelism)
+	}
+	return nil
+}
+
+// withDefaults fills unset fields from DefaultSynthesisConfig
+func (c SynthesisConfig) withDefaults() SynthesisConfig {
+	if c.TokenBudget == 0 {
+		c.TokenBudget = DefaultSynthesisConfig.TokenBudget
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = DefaultSynthesisConfig.Parallelism
+	}
+	return c
+}
+
+type ChapterAssignment struct {
+	Finding  int   `json:"finding"`
+	Chapters []int `json:"chapters"`
+}
+
+type ChapterAssignmentResult struct {
+	Assignments []ChapterAssignment `json:"assignments"`
+}
+
+type ChapterDraft struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+type ChapterTransition struct {
+	Chapter int    `json:"chapter"`
+	Text    string `json:"text"`
+}
+
+type TermReplacement struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ConsolidationResult struct {
+	Transitions      []ChapterTransition `json:"transitions"`
+	Replacements     []TermReplacement   `json:"replacements"`
+	StructureChanges string              `json:"structureChanges"`
+}
+
+// minExcerptBytes keeps shortened findings long enough to tell what they are about
+const minExcerptBytes = 200
+
+// estimateTokens approximates the tokens of s without a tokenizer. A UTF-8
+// byte count over three is about one token per Japanese character and
+// overestimates English text, which is the safe side for a budget.
+func estimateTokens(s string) int {
+	return (len(s) + 2) / 3
+}
+
+// fitTexts shortens texts so that together they stay within budget tokens.
+// Texts already within an equal share are kept whole and leave their unused
+// share to the others.
+func fitTexts(texts []string, budget int) []string {
+	total := 0
+	for _, text := range texts {
+		total += estimateTokens(text)
+	}
+	if total <= budget || len(texts) == 0 {
+		return texts
+	}
+
+	// Hand out the budget from the shortest text up
+	order := make([]int, len(texts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return len(texts[order[a]]) < len(texts[order[b]]) })
+
+	fitted := make([]string, len(texts))
+	remaining := budget
+	for n, i := range order {
+		share := remaining / (len(texts) - n)
+		fitted[i] = truncateTokens(texts[i], share)
+		remaining -= estimateTokens(fitted[i])
+	}
+	return fitted
+}
+
+// truncateTokens cuts s to roughly tokens tokens on a rune boundary, marking the cut
+func truncateTokens(s string, tokens int) string {
+	if estimateTokens(s) <= tokens {
+		return s
+	}
+	limit := max(tokens*3, minExcerptBytes)
+	if limit >= len(s) {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit] + "…(省略)"
+}
+
+// formatChapterStructure numbers the chapters for prompt input
+func formatChapterStructure(chapters []ChapterInfo) string {
+	var b strings.Builder
+	for i, chapter := range chapters {
+		b.WriteString(fmt.Sprintf("%d. %s (%s重要度)\n   %s\n\n", i+1, chapter.Title, chapter.Importance, chapter.Description))
+	}
+	return b.String()
+}
+
+// formatFindings numbers the findings so the assignment can refer to them
+func formatFindings(findings []string) string {
+	var b strings.Builder
+	for i, finding := range findings {
+		b.WriteString(fmt.Sprintf("[%d]\n%s\n\n", i+1, finding))
+	}
+	return b.String()
+}
+
+// needsChapterSynthesis reports whether the findings are too large for a single synthesis prompt
+func needsChapterSynthesis(findings []string, chapters []ChapterInfo, budget int) bool {
+	if len(chapters) < 2 {
+		return false
+	}
+	total := 0
+	for _, finding := range findings {
+		total += estimateTokens(finding)
+	}
+	return total > budget
+}
+
+// chapterSynthesis drafts the report chapter by chapter: findings are assigned
+// to chapters, every chapter is drafted in parallel from its own findings and a
+// final pass adds transitions and unifies terminology
+func chapterSynthesis(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, researchPlan string, allFindings []string, chapters []ChapterInfo, language string, reportType *ReportTypeSpec) (*SynthesisResult, error) {
+	cfg := runStateFrom(ctx).synthesis.withDefaults()
+	chapterStructure := formatChapterStructure(chapters)
+
+	assigned, err := assignFindings(ctx, g, input.Topic, chapterStructure, allFindings, len(chapters), cfg.TokenBudget)
+	if err != nil {
+		return nil, err
+	}
+
+	drafts, err := draftChapters(ctx, g, input, researchPlan, chapterStructure, chapters, assigned, language, reportType, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	consolidation, err := consolidateChapters(ctx, g, input.Topic, drafts, language, cfg.TokenBudget)
+	if err != nil {
+		return nil, err
+	}
+
+	return consolidatedResult(chapters, drafts, consolidation), nil
+}
+
+// assignFindings returns the findings of every chapter. The model sees excerpts
+// so that the assignment itself stays within budget; findings it leaves out go
+// to every chapter rather than being dropped.
+func assignFindings(ctx context.Context, g *genkit.Genkit, topic, chapterStructure string, findings []string, chapterCount, budget int) ([][]string, error) {
+	p := genkit.LookupPrompt(g, "chapter_assignment")
+	if p == nil {
+		return nil, promptNotFound(PhaseSynthesis, "chapter_assignment")
+	}
+
+	resp, err := executePrompt(ctx, p, PhaseSynthesis,
+		ai.WithInput(map[string]any{
+			"topic":            topic,
+			"chapterStructure": chapterStructure,
+			"findings":         formatFindings(fitTexts(findings, budget)),
+		}))
+	if err != nil {
+		return nil, phaseError(PhaseSynthesis, err)
+	}
+
+	var result ChapterAssignmentResult
+	if err := resp.Output(&result); err != nil {
+		return nil, invalidOutput(PhaseSynthesis, err)
+	}
+
+	assigned := make([][]string, chapterCount)
+	used := make([]bool, len(findings))
+	for _, a := range result.Assignments {
+		if a.Finding < 1 || a.Finding > len(findings) {
+			continue
+		}
+		for _, chapter := range a.Chapters {
+			if chapter < 1 || chapter > chapterCount {
+				continue
+			}
+			assigned[chapter-1] = append(assigned[chapter-1], findings[a.Finding-1])
+			used[a.Finding-1] = true
+		}
+	}
+
+	for i, ok := range used {
+		if ok {
+			continue
+		}
+		log.Printf("finding %d was not assigned to a chapter; using it in every chapter", i+1)
+		for chapter := range assigned {
+			assigned[chapter] = append(assigned[chapter], findings[i])
+		}
+	}
+	return assigned, nil
+}
+
+// draftChapters drafts every chapter from its findings, at most cfg.Parallelism at a time.
+// The first failure cancels the drafts still running.
+func draftChapters(ctx context.Context, g *genkit.Genkit, input *DeepResearchInput, researchPlan, chapterStructure string, chapters []ChapterInfo, assigned [][]string, language string, reportType *ReportTypeSpec, cfg SynthesisConfig) ([]ChapterDraft, error) {
+	p := genkit.LookupPrompt(g, "chapter_draft")
+	if p == nil {
+		return nil, promptNotFound(PhaseSynthesis, "chapter_draft")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	drafts := make([]ChapterDraft, len(chapters))
+	errs := make([]error, len(chapters))
+	sem := make(chan struct{}, cfg.Parallelism)
+	var wg sync.WaitGroup
+	for i, chapter := range chapters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			draft, err := draftChapter(ctx, p, i+1, chapter.Title, map[string]any{
+				"topic":              input.Topic,
+				"investigationPlan":  researchPlan,
+				"chapterStructure":   chapterStructure,
+				"chapterDescription": chapter.Description,
+				"findings":           strings.Join(fitTexts(assigned[i], cfg.TokenBudget), "\n\n"),
+				"reportGuidance":     reportType.guidance(PhaseSynthesis),
+				"language":           language,
+			})
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+			drafts[i] = draft
+		}()
+	}
+	wg.Wait()
+
+	// Report the failure that caused the cancellation rather than the cancellations it caused
+	var canceled error
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case errors.Is(err, context.Canceled) && canceled == nil:
+			canceled = err
+		case !errors.Is(err, context.Canceled):
+			return nil, err
+		}
+	}
+	if canceled != nil {
+		return nil, phaseError(PhaseSynthesis, canceled)
+	}
+	return drafts, nil
+}
+
+// draftChapter drafts chapter number from the chapter_draft input, keeping title when the model drops it
+func draftChapter(ctx context.Context, p ai.Prompt, number int, title string, input map[string]any) (ChapterDraft, error) {
+	input["chapterNumber"] = number
+	input["chapterTitle"] = title
+	resp, err := executePrompt(ctx, p, PhaseSynthesis, ai.WithInput(input))
+	if err != nil {
+		return ChapterDraft{}, phaseError(PhaseSynthesis, fmt.Errorf("chapter %d: %w", number, err))
+	}
+
+	var draft ChapterDraft
+	if err := resp.Output(&draft); err != nil {
+		return ChapterDraft{}, invalidOutput(PhaseSynthesis, err)
+	}
+	if draft.Title == "" {
+		draft.Title = title
+	}
+	return draft, nil
+}
+
+// consolidateChapters asks for transitions and terminology fixes across the drafts
+func consolidateChapters(ctx context.Context, g *genkit.Genkit, topic string, drafts []ChapterDraft, language string, budget int) (*ConsolidationResult, error) {
+	p := genkit.LookupPrompt(g, "synthesis_consolidation")
+	if p == nil {
+		return nil, promptNotFound(PhaseSynthesis, "synthesis_consolidation")
+	}
+
+	contents := make([]string, len(drafts))
+	for i, draft := range drafts {
+		contents[i] = draft.Content
+	}
+	contents = fitTexts(contents, budget)
+	var b strings.Builder
+	for i, draft := range drafts {
+		b.WriteString(fmt.Sprintf("%d. %s\n%s\n\n", i+1, draft.Title, contents[i]))
+	}
+
+	resp, err := executePrompt(ctx, p, PhaseSynthesis,
+		ai.WithInput(map[string]any{
+			"topic":    topic,
+			"chapters": b.String(),
+			"language": language,
+		}))
+	if err != nil {
+		return nil, phaseError(PhaseSynthesis, err)
+	}
+
+	var result ConsolidationResult
+	if err := resp.Output(&result); err != nil {
+		return nil, invalidOutput(PhaseSynthesis, err)
+	}
+	return &result, nil
+}
+
+// consolidatedResult applies the transitions and terminology of the consolidation pass to the drafts
+func consolidatedResult(chapters []ChapterInfo, drafts []ChapterDraft, consolidation *ConsolidationResult) *SynthesisResult {
+	transitions := make(map[int]string, len(consolidation.Transitions))
+	for _, t := range consolidation.Transitions {
+		if t.Text != "" {
+			transitions[t.Chapter] = t.Text
+		}
+	}
+
+	terms := newTermReplacer(consolidation.Replacements)
+
+	result := &SynthesisResult{
+		Chapters:         make([]ChapterContent, len(drafts)),
+		StructureChanges: consolidation.StructureChanges,
+	}
+	for i, draft := range drafts {
+		content := terms.replace(draft.Content)
+		if t, ok := transitions[i+1]; ok {
+			content = t + "\n\n" + content
+		}
+		result.Chapters[i] = ChapterContent{
+			Title:      terms.replace(draft.Title),
+			Content:    content,
+			Importance: chapters[i].Importance,
+		}
+	}
+	return result
+}
+
+// sourceHeading matches the headings of the source lists in drafted chapters
+var sourceHeading = regexp.MustCompile(`(?i)^#{1,6}\s*(出典|参考文献|参考資料|情報源|sources|references)`)
+
+// sourceLine matches a single labelled source, e.g. "出典: https://..."
+var sourceLine = regexp.MustCompile(`(?i)^\s*([-*]|\d+\.)?\s*(出典|参考|情報源|sources?|references?)\s*[:：]`)
+
+// urlPattern matches URLs, including those of Markdown links
+var urlPattern = regexp.MustCompile(`https?://[^\s)<>\]]+`)
+
+// termReplacer applies the consolidation's terminology to whole terms of the
+// prose, leaving URLs and source lists as the chapters cite them
+type termReplacer struct {
+	replacements []TermReplacement
+}
+
+func newTermReplacer(replacements []TermReplacement) termReplacer {
+	var terms []TermReplacement
+	for _, r := range replacements {
+		if r.From != "" && r.From != r.To {
+			terms = append(terms, r)
+		}
+	}
+	// Longest first, so that a term wins over the terms it contains
+	sort.SliceStable(terms, func(i, j int) bool { return len(terms[i].From) > len(terms[j].From) })
+	return termReplacer{replacements: terms}
+}
+
+func (t termReplacer) replace(text string) string {
+	if len(t.replacements) == 0 {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	inSources := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			inSources = sourceHeading.MatchString(strings.TrimSpace(line))
+		}
+		if inSources || sourceLine.MatchString(line) {
+			continue
+		}
+		// Replace between the URLs only
+		var b strings.Builder
+		last := 0
+		for _, loc := range urlPattern.FindAllStringIndex(line, -1) {
+			b.WriteString(t.replaceTerms(line[last:loc[0]]))
+			b.WriteString(line[loc[0]:loc[1]])
+			last = loc[1]
+		}
+		b.WriteString(t.replaceTerms(line[last:]))
+		lines[i] = b.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// replaceTerms replaces the terms of text that are not part of a longer word
+func (t termReplacer) replaceTerms(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		matched := false
+		for _, r := range t.replacements {
+			if strings.HasPrefix(text[i:], r.From) && wholeTerm(text, i, i+len(r.From)) {
+				b.WriteString(r.To)
+				i += len(r.From)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			b.WriteString(text[i : i+size])
+			i += size
+		}
+	}
+	return b.String()
+}
+
+// wholeTerm reports whether text[start:end] is not glued to a longer word.
+// Only ASCII words have boundaries; Japanese text has no spaces between
+// words, so its terms match anywhere.
+func wholeTerm(text string, start, end int) bool {
+	first, _ := utf8.DecodeRuneInString(text[start:end])
+	before, _ := utf8.DecodeLastRuneInString(text[:start])
+	if start > 0 && isWordRune(first) && isWordRune(before) {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(text[start:end])
+	after, _ := utf8.DecodeRuneInString(text[end:])
+	return end == len(text) || !isWordRune(last) || !isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r < utf8.RuneSelf && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+}
@@ -0,0 +1,109 @@
+package flow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestFitTexts(t *testing.T) {
+	short := "short"
+	long := strings.Repeat("長", 1000)
+
+	got := fitTexts([]string{long, short}, 500)
+	if got[1] != short {
+		t.Errorf("short text was cut: %q", got[1])
+	}
+	if !strings.HasSuffix(got[0], "…(省略)") || len(got[0]) >= len(long) {
+		t.Errorf("long text was not cut: %d bytes", len(got[0]))
+	}
+	// The cut must land on a rune boundary
+	if strings.ContainsRune(got[0], '�') {
+		t.Errorf("long text was cut mid-rune")
+	}
+
+	if got := fitTexts([]string{short}, 500); got[0] != short {
+		t.Errorf("text within budget changed: %q", got[0])
+	}
+}
+
+func TestDeepResearchFlowDraftsChaptersWhenFindingsExceedBudget(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	fake.On(fakemodel.Prompt(g, "planning"), fakemodel.JSON(PlanningResult{
+		KeyQuestions: []string{"What is Go?", "Who uses Go?"},
+		ChapterStructure: []ChapterInfo{
+			{Title: "概要", Description: "overview", Importance: "high"},
+			{Title: "利用者", Description: "users", Importance: "medium"},
+		},
+	}))
+	fake.On(fakemodel.Prompt(g, "research"),
+		fakemodel.JSON(ResearchResult{Findings: "Golang is a compiled language", SourceUrls: []string{"https://go.dev"}}),
+		fakemodel.JSON(ResearchResult{Findings: "Google runs Golang services", SourceUrls: []string{"https://go.dev"}}),
+	)
+	fake.On(fakemodel.Prompt(g, "chapter_assignment"), fakemodel.JSON(ChapterAssignmentResult{
+		Assignments: []ChapterAssignment{{Finding: 1, Chapters: []int{1}}, {Finding: 2, Chapters: []int{2}}},
+	}))
+	fake.On(fakemodel.Contains("担当する章: 1. 概要"), fakemodel.JSON(ChapterDraft{Title: "概要", Content: "Golang compiles to machine code."}))
+	fake.On(fakemodel.Contains("担当する章: 2. 利用者"), fakemodel.JSON(ChapterDraft{Title: "利用者", Content: "Google uses Golang."}))
+	fake.On(fakemodel.Prompt(g, "synthesis_consolidation"), fakemodel.JSON(ConsolidationResult{
+		Transitions:  []ChapterTransition{{Chapter: 2, Text: "Having covered the language, we turn to its users."}},
+		Replacements: []TermReplacement{{From: "Golang", To: "Go"}},
+	}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Synthesis: SynthesisConfig{TokenBudget: 20}}
+	got, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	want := "1. 概要\nGo compiles to machine code.\n\n2. 利用者\nHaving covered the language, we turn to its users.\n\nGoogle uses Go.\n\n"
+	if got.DetailedReport != want {
+		t.Errorf("detailed report = %q, want %q", got.DetailedReport, want)
+	}
+
+	for _, req := range fake.Calls() {
+		text := fakemodel.RequestText(req)
+		if fakemodel.Prompt(g, "synthesis")(req) {
+			t.Errorf("single-pass synthesis prompt was used")
+		}
+		// Each chapter only sees the findings assigned to it
+		if strings.Contains(text, "担当する章: 2. 利用者") && strings.Contains(text, "compiled language") {
+			t.Errorf("chapter 2 received a finding assigned to chapter 1")
+		}
+	}
+}
+
+func TestConsolidatedResultReplacesWholeTermsOnly(t *testing.T) {
+	chapters := []ChapterInfo{{Title: "Golang の概要", Importance: ImportanceHigh}}
+	drafts := []ChapterDraft{{
+		Title: "Golang の概要",
+		Content: "Golang は Golangci と違い、Golangの公式サイト (https://example.com/Golang/doc) で学べる。\n" +
+			"詳しくは [Golang ブログ](https://go.dev/blog/Golang) を参照。\n" +
+			"出典: Golang Team, https://golang.org\n" +
+			"## 参考文献\n" +
+			"- Golang Spec: https://golang.org/ref/spec\n" +
+			"## まとめ\n" +
+			"Golang は簡潔である。",
+	}}
+	consolidation := &ConsolidationResult{Replacements: []TermReplacement{{From: "Golang", To: "Go"}}}
+
+	got := consolidatedResult(chapters, drafts, consolidation).Chapters[0]
+	if got.Title != "Go の概要" {
+		t.Errorf("title = %q", got.Title)
+	}
+	want := "Go は Golangci と違い、Goの公式サイト (https://example.com/Golang/doc) で学べる。\n" +
+		"詳しくは [Go ブログ](https://go.dev/blog/Golang) を参照。\n" +
+		"出典: Golang Team, https://golang.org\n" +
+		"## 参考文献\n" +
+		"- Golang Spec: https://golang.org/ref/spec\n" +
+		"## まとめ\n" +
+		"Go は簡潔である。"
+	if got.Content != want {
+		t.Errorf("content = %q, want %q", got.Content, want)
+	}
+}
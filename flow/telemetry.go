@@ -0,0 +1,127 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans and metrics go to the global providers, which telemetry.Setup
+// installs; without it they are no-ops.
+var (
+	tracer = otel.Tracer("research/flow")
+	meter  = otel.Meter("research/flow")
+
+	runCount, _ = meter.Int64Counter("research.runs",
+		metric.WithDescription("Flow runs by final status"))
+	runDuration, _ = meter.Float64Histogram("research.run.duration",
+		metric.WithDescription("Duration of flow runs"), metric.WithUnit("s"))
+	runFailures, _ = meter.Int64Counter("research.run.failures",
+		metric.WithDescription("Failed flow runs by phase and cause"))
+	phaseDuration, _ = meter.Float64Histogram("research.phase.duration",
+		metric.WithDescription("Duration of research phases"), metric.WithUnit("s"))
+)
+
+// failureCauses are the causes failures are counted by
+var failureCauses = []error{
+	ErrInvalidInput, ErrRunNotFound, ErrRunNotPaused, ErrRunNotCompleted, ErrRunBusy, ErrForbidden,
+	ErrPromptNotFound, ErrUserTimeout, ErrNotApproved, ErrModelRefused,
+	ErrRateLimited, ErrModelUnavailable, ErrModelRequest, ErrInvalidOutput,
+	ErrToolFailed, ErrBudgetExceeded, ErrCanceled, ErrInternal,
+}
+
+// startPhase opens the span of a research phase. The returned function ends
+// it and records the phase duration; a pause is not counted as an error.
+func startPhase(ctx context.Context, phase string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "phase "+phase, trace.WithAttributes(attribute.String("research.phase", phase)))
+	return ctx, func(err error) {
+		endSpan(span, err)
+		phaseDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+			attribute.String("phase", phase),
+			attribute.String("outcome", outcomeOf(err)),
+		))
+	}
+}
+
+// startPrompt opens the span of one prompt execution
+func startPrompt(ctx context.Context, p ai.Prompt, phase string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "prompt "+promptName(p), trace.WithAttributes(
+		attribute.String("research.phase", phase),
+		attribute.String("prompt.name", promptName(p)),
+		attribute.String("gen_ai.request.model", phaseModel(ctx, p, phase)),
+	))
+}
+
+// endPrompt records the token usage of a prompt execution and ends its span
+func endPrompt(span trace.Span, resp *ai.ModelResponse, err error) {
+	if resp != nil {
+		span.SetAttributes(attribute.String("gen_ai.response.finish_reason", string(resp.FinishReason)))
+		if u := resp.Usage; u != nil {
+			span.SetAttributes(
+				attribute.Int("gen_ai.usage.input_tokens", u.InputTokens),
+				attribute.Int("gen_ai.usage.output_tokens", u.OutputTokens),
+				attribute.Int("gen_ai.usage.total_tokens", u.TotalTokens),
+			)
+		}
+	}
+	endSpan(span, err)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, errPaused) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func outcomeOf(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, errPaused):
+		return "paused"
+	default:
+		return "error"
+	}
+}
+
+// recordRun counts a finished flow run and its duration, and for failures
+// the phase and cause
+func recordRun(ctx context.Context, flow string, start time.Time, result *DeepResearchResult, err error) {
+	status := string(RunFailed)
+	if err == nil && result != nil {
+		status = string(result.Status)
+	}
+	attrs := metric.WithAttributes(attribute.String("flow", flow), attribute.String("status", status))
+	runCount.Add(ctx, 1, attrs)
+	runDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err == nil {
+		return
+	}
+
+	phase, cause := "", ErrInternal.Error()
+	var pe *PhaseError
+	if errors.As(err, &pe) {
+		phase = pe.Phase
+	}
+	for _, c := range failureCauses {
+		if errors.Is(err, c) {
+			cause = c.Error()
+			break
+		}
+	}
+	runFailures.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("flow", flow),
+		attribute.String("phase", phase),
+		attribute.String("cause", cause),
+	))
+}
@@ -0,0 +1,71 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/firebase/genkit/go/core/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestDeepResearchFlowTracesPhasesAndPrompts(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracing.TracerProvider().RegisterSpanProcessor(recorder)
+	t.Cleanup(func() { tracing.TracerProvider().UnregisterSpanProcessor(recorder) })
+
+	if _, err := DeepResearchFlow(g, user.Tools(), DeepResearchConfig{}).Run(context.Background(), &DeepResearchInput{Topic: "Go"}); err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = append(spans[s.Name()], s)
+	}
+	for _, phase := range []string{PhasePlanning, PhasePlanConfirmation, PhaseResearch, PhaseSynthesis, PhaseSummary, PhaseReportDelivery} {
+		if len(spans["phase "+phase]) != 1 {
+			t.Errorf("got %d spans for phase %s, want 1", len(spans["phase "+phase]), phase)
+		}
+	}
+
+	questions := spans["research_question"]
+	if len(questions) != 2 {
+		t.Fatalf("got %d research_question spans, want one per key question", len(questions))
+	}
+	for i, q := range questions {
+		if got := attr(q, "research.question_index").AsInt64(); got != int64(i+1) {
+			t.Errorf("question span %d has index %d", i, got)
+		}
+	}
+
+	prompts := spans["prompt research"]
+	if len(prompts) != 2 {
+		t.Fatalf("got %d research prompt spans, want 2", len(prompts))
+	}
+	p := prompts[0]
+	if p.Parent().SpanID() != questions[0].SpanContext().SpanID() {
+		t.Error("research prompt span is not a child of its question span")
+	}
+	if got := attr(p, "gen_ai.request.model").AsString(); got != "googleai/gemini-2.5-flash-lite" {
+		t.Errorf("model = %q", got)
+	}
+	if attr(p, "gen_ai.usage.input_tokens").AsInt64() == 0 || attr(p, "gen_ai.usage.output_tokens").AsInt64() == 0 {
+		t.Error("research prompt span lacks token counts")
+	}
+}
+
+func attr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
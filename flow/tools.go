@@ -0,0 +1,220 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// Flows whose MCP tools ToolPolicy.Flows limits. resumeDeepResearchFlow
+// continues the runs of deepResearchFlow and shares its entry.
+const (
+	ToolFlowSimple       = "simpleFlow"
+	ToolFlowDeepResearch = "deepResearchFlow"
+)
+
+// toolPhases are the phases of deepResearchFlow that are given MCP tools
+var toolPhases = []string{
+	PhaseClarification,
+	PhasePlanning,
+	PhasePlanConfirmation,
+	PhaseDraftReview,
+	PhaseReportDelivery,
+}
+
+// questionPhases ask the user through AskUserTool when runs are stored
+var questionPhases = []string{PhaseClarification, PhasePlanConfirmation, PhaseDraftReview}
+
+// ToolPolicy limits the MCP tools each flow and each phase of
+// deepResearchFlow may use. Entries are tool names or path.Match patterns
+// such as "ask-me_*"; Genkit names MCP tools "<server>_<tool>".
+type ToolPolicy struct {
+	// Flows maps a flow to the tools it may use. A flow without an entry may
+	// use every tool; an empty list allows none.
+	Flows map[string][]string `yaml:"flows"`
+	// Phases maps a phase to the tools it may use, within those of its flow.
+	// A phase without an entry uses the tools its prompts declare.
+	Phases map[string][]string `yaml:"phases"`
+}
+
+// Validate rejects unknown flows and phases and malformed patterns
+func (p ToolPolicy) Validate() error {
+	for name, patterns := range p.Flows {
+		if name != ToolFlowSimple && name != ToolFlowDeepResearch {
+			return fmt.Errorf("tools.flows: unknown flow %q, expected %s or %s", name, ToolFlowSimple, ToolFlowDeepResearch)
+		}
+		if err := validatePatterns(patterns); err != nil {
+			return fmt.Errorf("tools.flows.%s: %w", name, err)
+		}
+	}
+	for phase, patterns := range p.Phases {
+		if !slices.Contains(toolPhases, phase) {
+			return fmt.Errorf("tools.phases: phase %q uses no tools, expected one of %v", phase, toolPhases)
+		}
+		if err := validatePatterns(patterns); err != nil {
+			return fmt.Errorf("tools.phases.%s: %w", phase, err)
+		}
+	}
+	return nil
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			return fmt.Errorf("invalid tool pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// matchTool reports whether name matches one of patterns
+func matchTool(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	})
+}
+
+// FlowTools returns the tools that flow may use
+func (p ToolPolicy) FlowTools(flow string, tools []ai.Tool) []ai.Tool {
+	patterns, ok := p.Flows[flow]
+	if !ok {
+		return tools
+	}
+	var allowed []ai.Tool
+	for _, t := range tools {
+		if matchTool(patterns, t.Name()) {
+			allowed = append(allowed, t)
+		}
+	}
+	return allowed
+}
+
+// phaseTools decides which tools each tool phase of deepResearchFlow may use
+type phaseTools map[string]func(name string) bool
+
+// phaseTools returns which tools each phase may use: those its entry names,
+// or else those its prompts declare, as far as deepResearchFlow may use them
+func (p ToolPolicy) phaseTools(g *genkit.Genkit) phaseTools {
+	flowPatterns, limited := p.Flows[ToolFlowDeepResearch]
+	allowed := phaseTools{}
+	for _, phase := range toolPhases {
+		patterns, ok := p.Phases[phase]
+		if !ok {
+			patterns = declaredTools(g, phase)
+		}
+		allowed[phase] = func(name string) bool {
+			return matchTool(patterns, name) && (!limited || matchTool(flowPatterns, name))
+		}
+	}
+	return allowed
+}
+
+// refs returns the tools among tools that phase may use
+func (t phaseTools) refs(phase string, tools []ai.ToolRef) []ai.ToolRef {
+	allowed, ok := t[phase]
+	if !ok {
+		return nil
+	}
+	var refs []ai.ToolRef
+	for _, tool := range tools {
+		if allowed(tool.Name()) {
+			refs = append(refs, tool)
+		}
+	}
+	return refs
+}
+
+// middleware withholds from the model the tools the phase may not use. A
+// prompt executed without tools falls back to the tools it declares, which
+// the policy must still limit.
+func (t phaseTools) middleware(phase string) ai.ModelMiddleware {
+	allowed, ok := t[phase]
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		if !ok {
+			return next
+		}
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			if slices.ContainsFunc(req.Tools, func(d *ai.ToolDefinition) bool { return !allowed(d.Name) }) {
+				filtered := *req
+				filtered.Tools = slices.DeleteFunc(slices.Clone(req.Tools), func(d *ai.ToolDefinition) bool { return !allowed(d.Name) })
+				req = &filtered
+			}
+			return next(ctx, req, cb)
+		}
+	}
+}
+
+// withPhaseTools scopes the tools of each phase to the run
+func withPhaseTools(ctx context.Context, tools phaseTools) context.Context {
+	run := *runStateFrom(ctx)
+	run.tools = tools
+	return withRunState(ctx, &run)
+}
+
+// declaredTools returns the tools the prompts of a phase declare
+func declaredTools(g *genkit.Genkit, phase string) []string {
+	var names []string
+	for _, p := range loadedPhasePrompts(g, phase) {
+		for _, name := range promptTools(p) {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// loadedPhasePrompts returns the prompts of a phase that g has loaded
+func loadedPhasePrompts(g *genkit.Genkit, phase string) []ai.Prompt {
+	var prompts []ai.Prompt
+	for _, name := range phasePrompts[phase] {
+		if p := genkit.LookupPrompt(g, name); p != nil {
+			prompts = append(prompts, p)
+		}
+	}
+	return prompts
+}
+
+// promptTools are the tools a prompt file declares
+func promptTools(p ai.Prompt) []string {
+	tools, _ := promptMetadata(p)["tools"].([]string)
+	return tools
+}
+
+// UndefinedTools returns the tools that the prompts or policy refer to but g
+// has not registered. A pattern is undefined when it matches no tool.
+func UndefinedTools(g *genkit.Genkit, policy ToolPolicy) []string {
+	var registered []string
+	for _, t := range genkit.ListTools(g) {
+		registered = append(registered, t.Name())
+	}
+
+	var undefined []string
+	check := func(pattern string) {
+		if slices.Contains(undefined, pattern) || slices.ContainsFunc(registered, func(name string) bool { return matchTool([]string{pattern}, name) }) {
+			return
+		}
+		undefined = append(undefined, pattern)
+	}
+	for _, phase := range phases {
+		for _, p := range loadedPhasePrompts(g, phase) {
+			for _, name := range promptTools(p) {
+				check(name)
+			}
+		}
+	}
+	for _, entries := range []map[string][]string{policy.Flows, policy.Phases} {
+		for _, patterns := range entries {
+			for _, pattern := range patterns {
+				check(pattern)
+			}
+		}
+	}
+	slices.Sort(undefined)
+	return undefined
+}
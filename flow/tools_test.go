@@ -0,0 +1,128 @@
+package flow
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+// requestTools returns the names of the tools offered in the first request matching m
+func requestTools(t *testing.T, fake *fakemodel.Plugin, m fakemodel.Matcher) []string {
+	t.Helper()
+	for _, req := range fake.Calls() {
+		if m(req) {
+			var names []string
+			for _, d := range req.Tools {
+				names = append(names, d.Name)
+			}
+			return names
+		}
+	}
+	t.Fatal("no matching model request")
+	return nil
+}
+
+func defineDocsSearch(g *genkit.Genkit) ai.Tool {
+	return genkit.DefineTool(g, "docs_search", "stub docs search",
+		func(ctx *ai.ToolContext, query string) (string, error) { return "", nil })
+}
+
+func TestPhaseToolsFollowPromptsAndPolicy(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	tools := append(user.Tools(), defineDocsSearch(g))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{Tools: ToolPolicy{Phases: map[string][]string{PhasePlanning: {"docs_*"}}}}
+	if _, err := DeepResearchFlow(g, tools, cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"}); err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	if got := requestTools(t, fake, fakemodel.Prompt(g, "planning")); !slices.Equal(got, []string{"docs_search"}) {
+		t.Errorf("planning tools = %v, want the policy's [docs_search]", got)
+	}
+	got := requestTools(t, fake, fakemodel.Prompt(g, "report_delivery"))
+	if !slices.Contains(got, "ask-me_chat") || slices.Contains(got, "docs_search") {
+		t.Errorf("report_delivery tools = %v, want the ask-me tools its prompt declares", got)
+	}
+}
+
+func TestFlowAllowlistLimitsDeclaredTools(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	askmetest.New(g)
+	scriptDeepResearch(g, fake)
+
+	// Without tools the prompts fall back to the ask-me tools they declare
+	cfg := DeepResearchConfig{Tools: ToolPolicy{Flows: map[string][]string{ToolFlowDeepResearch: {"ask-me_chat"}}}}
+	if _, err := DeepResearchFlow(g, nil, cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"}); err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+
+	for _, prompt := range []string{"planning", "plan_confirmation", "report_delivery"} {
+		if got := requestTools(t, fake, fakemodel.Prompt(g, prompt)); !slices.Equal(got, []string{"ask-me_chat"}) {
+			t.Errorf("%s tools = %v, want [ask-me_chat]", prompt, got)
+		}
+	}
+}
+
+func TestFlowTools(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	tools := append(askmetest.New(g).Tools(), defineDocsSearch(g))
+
+	if got := (ToolPolicy{}).FlowTools(ToolFlowSimple, tools); len(got) != len(tools) {
+		t.Errorf("without an entry got %d tools, want all %d", len(got), len(tools))
+	}
+	policy := ToolPolicy{Flows: map[string][]string{ToolFlowSimple: {"docs_*"}}}
+	if got := policy.FlowTools(ToolFlowSimple, tools); len(got) != 1 || got[0].Name() != "docs_search" {
+		t.Errorf("got %v, want docs_search only", got)
+	}
+	policy = ToolPolicy{Flows: map[string][]string{ToolFlowSimple: {}}}
+	if got := policy.FlowTools(ToolFlowSimple, tools); len(got) != 0 {
+		t.Errorf("an empty entry allowed %v", got)
+	}
+}
+
+func TestUndefinedTools(t *testing.T) {
+	g, _ := newTestGenkit(t)
+	policy := ToolPolicy{Flows: map[string][]string{ToolFlowSimple: {"docs_*"}}}
+
+	got := UndefinedTools(g, policy)
+	if want := []string{"ask-me_chat", "ask-me_get_thread_history", "docs_*"}; !slices.Equal(got, want) {
+		t.Errorf("before the tools exist got %v, want %v", got, want)
+	}
+
+	askmetest.New(g)
+	defineDocsSearch(g)
+	if got := UndefinedTools(g, policy); len(got) != 0 {
+		t.Errorf("undefined tools = %v, want none", got)
+	}
+}
+
+func TestToolPolicyValidate(t *testing.T) {
+	for name, policy := range map[string]ToolPolicy{
+		"unknown flow":    {Flows: map[string][]string{"recipeGeneratorFlow": {"*"}}},
+		"toolless phase":  {Phases: map[string][]string{PhaseResearch: {"docs_search"}}},
+		"empty pattern":   {Phases: map[string][]string{PhasePlanning: {""}}},
+		"invalid pattern": {Flows: map[string][]string{ToolFlowSimple: {"docs_["}}},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted %+v", name, policy)
+		} else if !strings.Contains(err.Error(), "tools.") {
+			t.Errorf("%s: error %q does not name the config key", name, err)
+		}
+	}
+	valid := ToolPolicy{
+		Flows:  map[string][]string{ToolFlowDeepResearch: {"ask-me_*"}},
+		Phases: map[string][]string{PhaseReportDelivery: {"ask-me_chat"}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate rejected a valid policy: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// ModelPrice is what a model charges per million tokens
+type ModelPrice struct {
+	Input  float64 `yaml:"input" json:"input"`
+	Output float64 `yaml:"output" json:"output"`
+}
+
+// PriceTable maps model names, e.g. "googleai/gemini-2.5-pro", to their prices.
+// Calls to models missing from the table are left out of the cost and the
+// models are listed in RunUsage.Unpriced.
+type PriceTable map[string]ModelPrice
+
+// DefaultPrices are the list prices in USD of the Gemini models the prompts pin
+var DefaultPrices = PriceTable{
+	"googleai/gemini-2.5-flash-lite": {Input: 0.10, Output: 0.40},
+	"googleai/gemini-2.5-flash":      {Input: 0.30, Output: 2.50},
+	"googleai/gemini-2.5-pro":        {Input: 1.25, Output: 10.00},
+}
+
+// Validate rejects negative prices
+func (t PriceTable) Validate() error {
+	for model, p := range t {
+		if p.Input < 0 || p.Output < 0 {
+			return fmt.Errorf("prices for model %q must not be negative", model)
+		}
+	}
+	return nil
+}
+
+// Cost estimates the cost of a model call from its token counts. It reports
+// false for a model without a price.
+func (t PriceTable) Cost(model string, inputTokens, outputTokens int) (float64, bool) {
+	p, ok := t[model]
+	return (float64(inputTokens)*p.Input + float64(outputTokens)*p.Output) / 1e6, ok
+}
+
+// TokenUsage adds up the model calls of a phase, a model or a whole run
+type TokenUsage struct {
+	Calls        int `json:"calls"`
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	// Cost is estimated from the price table, in its currency
+	Cost float64 `json:"cost"`
+}
+
+func (u *TokenUsage) add(o TokenUsage) {
+	u.Calls += o.Calls
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.Cost += o.Cost
+}
+
+// RunUsage is the token usage and estimated cost of a run
+type RunUsage struct {
+	Total   TokenUsage            `json:"total"`
+	ByPhase map[string]TokenUsage `json:"byPhase"`
+	ByModel map[string]TokenUsage `json:"byModel"`
+	// Unpriced lists the models called that have no price, so the cost is
+	// too low by their share
+	Unpriced []string `json:"unpriced,omitempty"`
+}
+
+// usageStats collects RunUsage over a run
+type usageStats struct {
+	mu     sync.Mutex
+	prices PriceTable
+	usage  RunUsage
+}
+
+// newUsageStats starts counting from the usage of earlier requests of the run, if any
+func newUsageStats(prices PriceTable, prior *RunUsage) *usageStats {
+	s := &usageStats{prices: prices}
+	if prior != nil {
+		s.usage = RunUsage{
+			Total:    prior.Total,
+			ByPhase:  maps.Clone(prior.ByPhase),
+			ByModel:  maps.Clone(prior.ByModel),
+			Unpriced: slices.Clone(prior.Unpriced),
+		}
+	}
+	return s
+}
+
+func (s *usageStats) record(phase, model string, u *ai.GenerationUsage) {
+	if s == nil {
+		return
+	}
+	call := TokenUsage{Calls: 1}
+	priced := true
+	if u != nil {
+		call.InputTokens, call.OutputTokens = u.InputTokens, u.OutputTokens
+		call.Cost, priced = s.prices.Cost(model, u.InputTokens, u.OutputTokens)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !priced && !slices.Contains(s.usage.Unpriced, model) {
+		log.Printf("model %s has no price, its calls are left out of the estimated cost", model)
+		s.usage.Unpriced = append(s.usage.Unpriced, model)
+	}
+	if s.usage.ByPhase == nil {
+		s.usage.ByPhase = map[string]TokenUsage{}
+		s.usage.ByModel = map[string]TokenUsage{}
+	}
+	s.usage.Total.add(call)
+	byPhase, byModel := s.usage.ByPhase[phase], s.usage.ByModel[model]
+	byPhase.add(call)
+	byModel.add(call)
+	s.usage.ByPhase[phase], s.usage.ByModel[model] = byPhase, byModel
+}
+
+// total is the usage of the run so far
+func (s *usageStats) total() TokenUsage {
+	if s == nil {
+		return TokenUsage{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage.Total
+}
+
+func (s *usageStats) snapshot() *RunUsage {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.usage.Total.Calls == 0 {
+		return nil
+	}
+	return &RunUsage{
+		Total:    s.usage.Total,
+		ByPhase:  maps.Clone(s.usage.ByPhase),
+		ByModel:  maps.Clone(s.usage.ByModel),
+		Unpriced: slices.Clone(s.usage.Unpriced),
+	}
+}
+
+// logUsage logs what a run has spent so far, for attribution per topic and
+// caller
+func logUsage(ctx context.Context, run *Run, u *RunUsage) {
+	if u == nil {
+		return
+	}
+	caller := Caller(ctx)
+	if caller == "" {
+		caller = "anonymous"
+	}
+	log.Printf("run %s (%q) for %s: %d model calls, %d input and %d output tokens, estimated cost %.4f",
+		run.ID, run.Input.Topic, caller, u.Total.Calls, u.Total.InputTokens, u.Total.OutputTokens, u.Total.Cost)
+	if len(u.Unpriced) > 0 {
+		log.Printf("run %s: the cost leaves out models without a price: %s", run.ID, strings.Join(u.Unpriced, ", "))
+	}
+}
+
+// countUsage records the token usage of every model call a phase makes,
+// re-asks and retried attempts included
+func countUsage(phase, model string, stats *usageStats) ai.ModelMiddleware {
+	return func(next ai.ModelFunc) ai.ModelFunc {
+		return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+			resp, err := next(ctx, req, cb)
+			if err == nil {
+				stats.record(phase, model, resp.Usage)
+			}
+			return resp, err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package flow
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/fakemodel"
+	"research/mcp/ask-me/askmetest"
+)
+
+func TestDeepResearchFlowReportsUsageAcrossPauses(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	user := askmetest.New(g)
+	confirm := fakemodel.Prompt(g, "plan_confirmation")
+	fake.On(fakemodel.All(confirm, fakemodel.HasToolResponse(AskUserTool)), fakemodel.JSON(PlanConfirmationResult{Decision: PlanApprove}))
+	fake.On(confirm, fakemodel.ToolCall(AskUserTool, map[string]any{"question": "この計画でよいですか？"}))
+	scriptDeepResearch(g, fake)
+
+	cfg := DeepResearchConfig{
+		Retry:  testRetryPolicy,
+		Runs:   NewMemoryRunStore(),
+		Prices: PriceTable{"googleai/gemini-2.5-flash-lite": {Input: 1, Output: 2}},
+	}
+	paused, err := DeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &DeepResearchInput{Topic: "Go"})
+	if err != nil {
+		t.Fatalf("DeepResearchFlow failed: %v", err)
+	}
+	done, err := ResumeDeepResearchFlow(g, user.Tools(), cfg).Run(context.Background(), &ResumeInput{RunID: paused.RunID, Reply: "はい"})
+	if err != nil {
+		t.Fatalf("resumeDeepResearchFlow failed: %v", err)
+	}
+
+	got := done.Usage
+	if got == nil {
+		t.Fatal("result has no usage")
+	}
+	if got.Total.Calls != len(fake.Calls()) {
+		t.Errorf("total calls = %d, want %d including the calls before the pause", got.Total.Calls, len(fake.Calls()))
+	}
+	var sum TokenUsage
+	for _, u := range got.ByPhase {
+		sum.add(u)
+	}
+	if sum.Calls != got.Total.Calls || sum.InputTokens != got.Total.InputTokens || sum.OutputTokens != got.Total.OutputTokens {
+		t.Errorf("phases add up to %+v, total is %+v", sum, got.Total)
+	}
+	if got.Total.InputTokens == 0 || got.Total.OutputTokens == 0 {
+		t.Errorf("total = %+v, want the token counts of the responses", got.Total)
+	}
+	want := (float64(got.Total.InputTokens) + 2*float64(got.Total.OutputTokens)) / 1e6
+	if math.Abs(got.Total.Cost-want) > 1e-12 {
+		t.Errorf("cost = %v, want %v", got.Total.Cost, want)
+	}
+	if got.ByPhase[PhaseResearch].Calls != 2 || got.ByPhase[PhasePlanConfirmation].Calls != 2 {
+		t.Errorf("by phase = %+v, want 2 research and 2 plan confirmation calls", got.ByPhase)
+	}
+	if got.ByModel["googleai/gemini-2.5-flash-lite"].Calls == 0 {
+		t.Errorf("by model = %+v, want calls counted against the pinned model", got.ByModel)
+	}
+
+	stored, err := cfg.Runs.Load(context.Background(), done.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Usage == nil || stored.Usage.Total != got.Total {
+		t.Errorf("stored usage = %+v, want %+v", stored.Usage, got.Total)
+	}
+}
+
+func TestUsageFlagsUnpricedModels(t *testing.T) {
+	stats := newUsageStats(PriceTable{"googleai/gemini-2.5-pro": {Input: 1, Output: 1}}, nil)
+	stats.record(PhaseResearch, "googleai/gemini-2.5-pro", &ai.GenerationUsage{InputTokens: 1e6, OutputTokens: 1e6})
+	stats.record(PhaseResearch, "ollama/llama3.1", &ai.GenerationUsage{InputTokens: 10, OutputTokens: 10})
+	stats.record(PhaseSynthesis, "ollama/llama3.1", &ai.GenerationUsage{InputTokens: 10, OutputTokens: 10})
+
+	got := stats.snapshot()
+	if got.Total.Cost != 2 {
+		t.Errorf("cost = %v, want 2 for the priced model alone", got.Total.Cost)
+	}
+	if !slices.Equal(got.Unpriced, []string{"ollama/llama3.1"}) {
+		t.Errorf("unpriced = %v, want [ollama/llama3.1]", got.Unpriced)
+	}
+
+	// A resumed run keeps the flag
+	if again := newUsageStats(nil, got).snapshot(); !slices.Equal(again.Unpriced, got.Unpriced) {
+		t.Errorf("unpriced after resuming = %v, want %v", again.Unpriced, got.Unpriced)
+	}
+}
+
+func TestUsageRecordsDefaultModel(t *testing.T) {
+	g, fake := newTestGenkit(t)
+	p := genkit.DefinePrompt(g, "unpinned", ai.WithPrompt("Say hello."))
+	fake.On(fakemodel.Any(), fakemodel.Text("こんにちは"))
+
+	run := &runState{
+		retry:        testRetryPolicy,
+		defaultModel: "googleai/gemini-2.5-flash-lite",
+		usage:        newUsageStats(PriceTable{"googleai/gemini-2.5-flash-lite": {Input: 1, Output: 1}}, nil),
+	}
+	if _, err := executePrompt(withRunState(context.Background(), run), p, PhaseSummary); err != nil {
+		t.Fatalf("executePrompt failed: %v", err)
+	}
+
+	got := run.usage.snapshot()
+	if got.ByModel["googleai/gemini-2.5-flash-lite"].Calls != 1 || len(got.Unpriced) != 0 {
+		t.Errorf("by model = %+v, unpriced = %v; want the call under the default model", got.ByModel, got.Unpriced)
+	}
+}
@@ -0,0 +1,175 @@
+// Package health serves the liveness and readiness endpoints.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/flow"
+	"research/mcphost"
+)
+
+// DefaultModelProbeInterval is how long a model probe result is reused
+const DefaultModelProbeInterval = 5 * time.Minute
+
+// modelProbeTimeout caps how long a model may take to answer a probe
+const modelProbeTimeout = 15 * time.Second
+
+// Config governs the readiness checks
+type Config struct {
+	// ProbeModels sends each model a one-word request to check that it is
+	// reachable; without it models are not checked
+	ProbeModels bool `yaml:"probeModels"`
+	// ModelProbeInterval is how long a probe result is reused; zero uses DefaultModelProbeInterval
+	ModelProbeInterval time.Duration `yaml:"modelProbeInterval"`
+}
+
+// Validate rejects a negative probe interval
+func (c Config) Validate() error {
+	if c.ModelProbeInterval < 0 {
+		return fmt.Errorf("health.modelProbeInterval must not be negative, got %s", c.ModelProbeInterval)
+	}
+	return nil
+}
+
+// Report is the body of /readyz
+type Report struct {
+	// Status is "ready" or "not_ready"
+	Status     string                 `json:"status"`
+	MCPServers []mcphost.ServerStatus `json:"mcpServers"`
+	Prompts    PromptStatus           `json:"prompts"`
+	Models     []ModelStatus          `json:"models,omitempty"`
+}
+
+// PromptStatus tells whether the prompts the flows need were loaded
+type PromptStatus struct {
+	Loaded  int      `json:"loaded"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+// ModelStatus is the result of the latest probe of a model
+type ModelStatus struct {
+	Name      string        `json:"name"`
+	Reachable bool          `json:"reachable"`
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	CheckedAt time.Time     `json:"checkedAt"`
+}
+
+// Checker reports whether the server can serve flows
+type Checker struct {
+	g       *genkit.Genkit
+	host    *mcphost.Host
+	models  []string
+	limiter *flow.RateLimiter
+	cfg     Config
+
+	// probing is held while models are probed, so that concurrent checks
+	// wait for one round of probes instead of each starting their own
+	probing sync.Mutex
+	mu      sync.Mutex
+	probes  map[string]ModelStatus
+}
+
+// NewChecker checks the servers of host, the prompts of g and, when
+// cfg.ProbeModels is set, the reachability of models. Probes count against
+// the limits of limiter like any other model call.
+func NewChecker(g *genkit.Genkit, host *mcphost.Host, models []string, limiter *flow.RateLimiter, cfg Config) *Checker {
+	if cfg.ModelProbeInterval == 0 {
+		cfg.ModelProbeInterval = DefaultModelProbeInterval
+	}
+	return &Checker{g: g, host: host, models: models, limiter: limiter, cfg: cfg, probes: map[string]ModelStatus{}}
+}
+
+// Report checks every component. The server is ready when all enabled MCP
+// servers are connected, no prompt is missing and every probed model answered.
+func (c *Checker) Report(ctx context.Context) Report {
+	r := Report{Status: "ready", MCPServers: c.host.Check(ctx)}
+	r.Prompts.Missing, r.Prompts.Loaded = flow.MissingPrompts(c.g)
+	if c.cfg.ProbeModels {
+		r.Models = c.probeModels(ctx)
+	}
+
+	ready := len(r.Prompts.Missing) == 0
+	for _, s := range r.MCPServers {
+		ready = ready && s.State != mcphost.StateFailed
+	}
+	for _, m := range r.Models {
+		ready = ready && m.Reachable
+	}
+	if !ready {
+		r.Status = "not_ready"
+	}
+	return r
+}
+
+// probeModels returns the status of each model, probing those whose last
+// result is older than the probe interval. Checks arriving during a probe
+// wait for it and reuse its results.
+func (c *Checker) probeModels(ctx context.Context) []ModelStatus {
+	c.probing.Lock()
+	defer c.probing.Unlock()
+
+	var wg sync.WaitGroup
+	status := make([]ModelStatus, len(c.models))
+	for i, name := range c.models {
+		c.mu.Lock()
+		last, ok := c.probes[name]
+		c.mu.Unlock()
+		if ok && time.Since(last.CheckedAt) < c.cfg.ModelProbeInterval {
+			status[i] = last
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status[i] = c.probe(ctx, name)
+			c.mu.Lock()
+			c.probes[name] = status[i]
+			c.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return status
+}
+
+func (c *Checker) probe(ctx context.Context, model string) ModelStatus {
+	ctx, cancel := context.WithTimeout(ctx, modelProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := genkit.Generate(ctx, c.g, ai.WithModelName(model), ai.WithPrompt("Reply with OK."),
+		ai.WithMiddleware(c.limiter.Middleware(model)))
+	s := ModelStatus{Name: model, Reachable: err == nil, Latency: time.Since(start), CheckedAt: time.Now()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// Live answers /healthz: the process is up and serving requests
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Ready answers /readyz with the Report, and 503 while the server is not ready
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	report := c.Report(r.Context())
+	status := http.StatusOK
+	if report.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
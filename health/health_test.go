@@ -0,0 +1,116 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/firebase/genkit/go/plugins/mcp"
+
+	"research/flow"
+	"research/internal/fakemodel"
+	"research/mcphost"
+)
+
+func TestReadyReportsEachComponent(t *testing.T) {
+	fake := fakemodel.New("googleai", "gemini-2.5-flash-lite", "gemini-2.5-pro")
+	fake.On(fakemodel.Any(), fakemodel.Text("OK"))
+	g := genkit.Init(context.Background(),
+		genkit.WithPlugins(fake),
+		genkit.WithPromptDir(filepath.Join("..", "prompts")),
+	)
+	host := mcphost.Connect(context.Background(), g, []mcp.MCPClientOptions{
+		{Name: "broken", Stdio: &mcp.StdioConfig{Command: filepath.Join(t.TempDir(), "missing-server")}},
+		{Name: "off", Disabled: true, Stdio: &mcp.StdioConfig{Command: "true"}},
+	})
+	t.Cleanup(func() { host.Close() })
+
+	checker := NewChecker(g, host, []string{"googleai/gemini-2.5-flash-lite"}, nil, Config{ProbeModels: true})
+	rec := httptest.NewRecorder()
+	checker.Ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || report.Status != "not_ready" {
+		t.Errorf("got %d %s, want 503 not_ready while an MCP server is down", rec.Code, report.Status)
+	}
+	if len(report.MCPServers) != 2 || report.MCPServers[0].State != mcphost.StateFailed || report.MCPServers[0].Error == "" ||
+		report.MCPServers[1].State != mcphost.StateDisabled {
+		t.Errorf("mcp servers = %+v, want broken failed with its error and off disabled", report.MCPServers)
+	}
+	if len(report.Prompts.Missing) != 0 || report.Prompts.Loaded == 0 {
+		t.Errorf("prompts = %+v, want all loaded", report.Prompts)
+	}
+	if len(report.Models) != 1 || !report.Models[0].Reachable {
+		t.Errorf("models = %+v, want the model reachable", report.Models)
+	}
+
+	// The probe result is reused within the interval
+	checker.Report(context.Background())
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model probed %d times, want once", calls)
+	}
+}
+
+func TestReadyWithoutPrompts(t *testing.T) {
+	g := genkit.Init(context.Background(), genkit.WithPromptDir(t.TempDir()))
+	checker := NewChecker(g, mcphost.Connect(context.Background(), g, nil), nil, nil, Config{})
+
+	report := checker.Report(context.Background())
+	if report.Status != "not_ready" || len(report.Prompts.Missing) == 0 {
+		t.Errorf("got %+v, want not_ready with the missing prompts", report)
+	}
+	if report.Models != nil {
+		t.Errorf("models = %+v, want no probes when ProbeModels is off", report.Models)
+	}
+}
+
+func TestReadyProbesOnceAtATime(t *testing.T) {
+	fake := fakemodel.New("googleai", "gemini-2.5-flash-lite")
+	fake.On(fakemodel.Any(), func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		time.Sleep(50 * time.Millisecond)
+		return fakemodel.Text("OK")(req)
+	})
+	g := genkit.Init(context.Background(),
+		genkit.WithPlugins(fake),
+		genkit.WithPromptDir(filepath.Join("..", "prompts")),
+	)
+	host := mcphost.Connect(context.Background(), g, nil)
+	models := []string{"googleai/gemini-2.5-flash-lite"}
+	limiter := flow.NewRateLimiter(flow.RateLimitConfig{models[0]: {RequestsPerMinute: 1}}, "")
+
+	checker := NewChecker(g, host, models, limiter, Config{ProbeModels: true})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			checker.Ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("got %d, want 200 from the shared probe", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := len(fake.Calls()); calls != 1 {
+		t.Errorf("model probed %d times by concurrent checks, want once", calls)
+	}
+
+	// A probe waits its turn under the model's rate limit like a flow would
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report := NewChecker(g, host, models, limiter, Config{ProbeModels: true}).Report(ctx)
+	if len(report.Models) != 1 || report.Models[0].Reachable || len(fake.Calls()) != 1 {
+		t.Errorf("models = %+v after %d calls, want the probe held back by the limiter", report.Models, len(fake.Calls()))
+	}
+}
@@ -0,0 +1,158 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"research/flow"
+)
+
+var (
+	// ErrUnauthenticated is returned for requests without a valid API key
+	ErrUnauthenticated = errors.New("missing or invalid API key")
+	// ErrForbidden is returned for requests whose API key may not invoke the flow
+	ErrForbidden = errors.New("API key may not invoke this flow")
+)
+
+// AllFlows in APIKey.Flows allows every flow
+const AllFlows = "*"
+
+// minKeyLength rejects keys short enough to guess
+const minKeyLength = 16
+
+// APIKey lets a caller invoke a set of flows
+type APIKey struct {
+	// Name identifies the caller in logs and in the runs it starts or changes
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// KeyEnv names an environment variable holding the key, so that it can be kept out of the file
+	KeyEnv string `yaml:"keyEnv"`
+	// Flows lists the flows the key may invoke, or "*" for all of them
+	Flows []string `yaml:"flows"`
+	// Admin lets the key resume and regenerate runs that other keys started
+	Admin bool `yaml:"admin"`
+}
+
+// AuthConfig lists the API keys accepted by the server. Without keys every
+// request is allowed, which is only safe on localhost.
+type AuthConfig struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+// Validate rejects unnamed, short, duplicate and flowless keys and unknown flows
+func (c AuthConfig) Validate() error {
+	names := map[string]bool{}
+	keys := map[string]bool{}
+	for i, k := range c.Keys {
+		if k.Name == "" {
+			return fmt.Errorf("auth.keys[%d] has no name", i)
+		}
+		if names[k.Name] {
+			return fmt.Errorf("auth key name %q is used twice", k.Name)
+		}
+		names[k.Name] = true
+		if k.Key == "" && k.KeyEnv != "" {
+			return fmt.Errorf("auth key %q: environment variable %s is not set", k.Name, k.KeyEnv)
+		}
+		if len(k.Key) < minKeyLength {
+			return fmt.Errorf("auth key %q must be at least %d characters", k.Name, minKeyLength)
+		}
+		if keys[k.Key] {
+			return fmt.Errorf("auth key %q has the same key as another entry", k.Name)
+		}
+		keys[k.Key] = true
+		if len(k.Flows) == 0 {
+			return fmt.Errorf("auth key %q lists no flows; use %q for all", k.Name, AllFlows)
+		}
+		for _, name := range k.Flows {
+			if name != AllFlows && !slices.Contains(flow.FlowNames, name) {
+				return fmt.Errorf("auth key %q: unknown flow %q, expected %q or one of %v", k.Name, name, AllFlows, flow.FlowNames)
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticator checks the API key of each flow request
+type Authenticator struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	name  string
+	hash  [sha256.Size]byte
+	flows []string
+	admin bool
+}
+
+// NewAuthenticator returns an authenticator for cfg, or nil when cfg has no
+// keys and requests are not authenticated
+func NewAuthenticator(cfg AuthConfig) *Authenticator {
+	if len(cfg.Keys) == 0 {
+		return nil
+	}
+	a := &Authenticator{}
+	for _, k := range cfg.Keys {
+		a.keys = append(a.keys, apiKey{name: k.Name, hash: sha256.Sum256([]byte(k.Key)), flows: k.Flows, admin: k.Admin})
+	}
+	return a
+}
+
+// Require serves next only to requests whose API key may invoke flowName,
+// and attributes the request to the key's name with flow.WithCaller, and to
+// an admin with flow.WithAdmin. The key is sent as "Authorization: Bearer
+// <key>" or in the X-API-Key header.
+func (a *Authenticator) Require(flowName string, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := a.lookup(requestKey(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="research"`)
+			WriteError(w, ErrUnauthenticated)
+			return
+		}
+		if !slices.Contains(key.flows, AllFlows) && !slices.Contains(key.flows, flowName) {
+			log.Printf("auth: %s may not invoke %s", key.name, flowName)
+			WriteError(w, fmt.Errorf("%w: %s", ErrForbidden, flowName))
+			return
+		}
+		ctx := flow.WithCaller(r.Context(), key.name)
+		if key.admin {
+			ctx = flow.WithAdmin(ctx)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// lookup finds the key matching secret. Hashes are compared in constant time,
+// so the response time does not reveal how much of a key was right.
+func (a *Authenticator) lookup(secret string) (apiKey, bool) {
+	if secret == "" {
+		return apiKey{}, false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	var found apiKey
+	ok := false
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// requestKey returns the API key of r, from a bearer token or the X-API-Key header
+func requestKey(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
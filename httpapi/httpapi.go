@@ -0,0 +1,130 @@
+// Package httpapi serves flows over HTTP with typed JSON error responses.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/firebase/genkit/go/core"
+	"github.com/firebase/genkit/go/core/api"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/flow"
+)
+
+// ErrorBody is the JSON body of a failed flow request
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	// Code is a stable, machine-readable name of the cause, e.g. "user_timeout"
+	Code string `json:"code"`
+	// Phase is the research phase that failed, when the failure is phase-specific
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message"`
+}
+
+// causes maps each flow and auth error sentinel to its HTTP status and error code
+var causes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrUnauthenticated, http.StatusUnauthorized, "unauthenticated"},
+	{ErrForbidden, http.StatusForbidden, "forbidden"},
+	{flow.ErrInvalidInput, http.StatusBadRequest, "invalid_input"},
+	{flow.ErrRunNotFound, http.StatusNotFound, "run_not_found"},
+	{flow.ErrRunNotPaused, http.StatusConflict, "run_not_paused"},
+	{flow.ErrRunNotCompleted, http.StatusConflict, "run_not_completed"},
+	{flow.ErrRunBusy, http.StatusConflict, "run_busy"},
+	{flow.ErrForbidden, http.StatusForbidden, "forbidden"},
+	{flow.ErrPromptNotFound, http.StatusInternalServerError, "prompt_not_found"},
+	{flow.ErrUserTimeout, http.StatusGatewayTimeout, "user_timeout"},
+	{flow.ErrNotApproved, http.StatusConflict, "plan_not_approved"},
+	{flow.ErrModelRefused, http.StatusUnprocessableEntity, "model_refused"},
+	{flow.ErrRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{flow.ErrModelUnavailable, http.StatusServiceUnavailable, "model_unavailable"},
+	{flow.ErrModelRequest, http.StatusBadGateway, "model_request_rejected"},
+	{flow.ErrInvalidOutput, http.StatusBadGateway, "invalid_model_output"},
+	{flow.ErrToolFailed, http.StatusBadGateway, "tool_failed"},
+	{flow.ErrBudgetExceeded, http.StatusTooManyRequests, "budget_exceeded"},
+	{flow.ErrCanceled, http.StatusRequestTimeout, "canceled"},
+	{flow.ErrInternal, http.StatusInternalServerError, "internal"},
+}
+
+// Handler serves a flow like genkit.Handler, but reports failures as an
+// ErrorBody with a status code derived from the error's cause. Streaming
+// requests are passed through to genkit.Handler unchanged.
+func Handler(a api.Action) http.HandlerFunc {
+	stream := genkit.Handler(a)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") == "true" || r.Header.Get("Accept") == "text/event-stream" {
+			stream(w, r)
+			return
+		}
+
+		var body struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if r.Body != nil && r.ContentLength != 0 {
+			defer r.Body.Close()
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				WriteError(w, core.NewPublicError(core.INVALID_ARGUMENT, err.Error(), nil))
+				return
+			}
+		}
+
+		out, err := a.RunJSON(r.Context(), body.Data, nil)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]json.RawMessage{"result": out})
+	}
+}
+
+// WriteError writes err as an ErrorBody
+func WriteError(w http.ResponseWriter, err error) {
+	status, detail := Describe(err)
+	writeJSON(w, status, ErrorBody{Error: detail})
+}
+
+// Describe returns the HTTP status and error detail for err
+func Describe(err error) (int, ErrorDetail) {
+	detail := ErrorDetail{Message: err.Error()}
+	var phaseErr *flow.PhaseError
+	if errors.As(err, &phaseErr) {
+		detail.Phase = phaseErr.Phase
+	}
+
+	for _, c := range causes {
+		if errors.Is(err, c.err) {
+			detail.Code = c.code
+			return c.status, detail
+		}
+	}
+
+	// Errors raised by Genkit itself, such as input schema validation
+	var userErr *core.UserFacingError
+	if errors.As(err, &userErr) {
+		detail.Code = strings.ToLower(string(userErr.Status))
+		return core.HTTPStatusCode(userErr.Status), detail
+	}
+	var genkitErr *core.GenkitError
+	if errors.As(err, &genkitErr) {
+		detail.Code = strings.ToLower(string(genkitErr.Status))
+		return core.HTTPStatusCode(genkitErr.Status), detail
+	}
+
+	detail.Code = "internal"
+	return http.StatusInternalServerError, detail
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,105 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/flow"
+)
+
+type echoInput struct {
+	Fail string `json:"fail,omitempty"`
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	g := genkit.Init(context.Background())
+	echo := genkit.DefineFlow(g, "echo", func(ctx context.Context, input *echoInput) (string, error) {
+		switch input.Fail {
+		case "timeout":
+			return "", &flow.PhaseError{Phase: flow.PhasePlanConfirmation, Cause: flow.ErrUserTimeout, Err: errors.New("timeout waiting for reply")}
+		case "input":
+			return "", fmt.Errorf("%w: unknown phase", flow.ErrInvalidInput)
+		case "plain":
+			return "", errors.New("boom")
+		}
+		return "ok", nil
+	})
+
+	srv := httptest.NewServer(Handler(echo))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func post(t *testing.T, url, body string) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatalf("response is not JSON: %v", err)
+	}
+	return resp, raw
+}
+
+func TestHandlerResult(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, body := post(t, srv.URL, `{"data": {}}`)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"result":"ok"}` {
+		t.Errorf("got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	srv := newTestServer(t)
+
+	tests := []struct {
+		fail   string
+		status int
+		code   string
+		phase  string
+	}{
+		{"timeout", http.StatusGatewayTimeout, "user_timeout", flow.PhasePlanConfirmation},
+		{"input", http.StatusBadRequest, "invalid_input", ""},
+		{"plain", http.StatusInternalServerError, "internal", ""},
+	}
+	for _, tt := range tests {
+		resp, raw := post(t, srv.URL, fmt.Sprintf(`{"data": {"fail": %q}}`, tt.fail))
+
+		var body ErrorBody
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status || body.Error.Code != tt.code || body.Error.Phase != tt.phase {
+			t.Errorf("fail=%s: got %d %+v, want %d %s %q", tt.fail, resp.StatusCode, body.Error, tt.status, tt.code, tt.phase)
+		}
+	}
+}
+
+func TestHandlerRejectsSchemaViolations(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, raw := post(t, srv.URL, `{"data": {"fail": 1}}`)
+	var body ErrorBody
+	if err := json.Unmarshal(raw, &body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || body.Error.Code != "invalid_argument" {
+		t.Errorf("got %d %+v", resp.StatusCode, body.Error)
+	}
+}
@@ -0,0 +1,345 @@
+// Package fakemodel provides a deterministic Genkit model plugin that replays
+// scripted responses, so flows can be exercised in tests without network access.
+package fakemodel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core/api"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// Reply builds the model response for a matched request
+type Reply func(req *ai.ModelRequest) (*ai.ModelResponse, error)
+
+// Matcher reports whether a rule applies to a request
+type Matcher func(req *ai.ModelRequest) bool
+
+type rule struct {
+	match   Matcher
+	replies []Reply
+	calls   int
+}
+
+// Plugin registers fake models under a provider name. Registering it as
+// "googleai" lets the existing prompt files resolve their pinned models to it.
+type Plugin struct {
+	Provider string
+	Models   []string
+
+	mu     sync.Mutex
+	rules  []*rule
+	calls  []*ai.ModelRequest
+	models []string
+}
+
+// New returns a plugin defining the given models under provider
+func New(provider string, models ...string) *Plugin {
+	return &Plugin{Provider: provider, Models: models}
+}
+
+func (p *Plugin) Name() string {
+	return p.Provider
+}
+
+func (p *Plugin) Init(ctx context.Context) []api.Action {
+	actions := make([]api.Action, 0, len(p.Models))
+	for _, name := range p.Models {
+		m := ai.NewModel(api.NewName(p.Provider, name), &ai.ModelOptions{
+			Label: "Fake " + name,
+			Supports: &ai.ModelSupports{
+				Multiturn:  true,
+				SystemRole: true,
+				Tools:      true,
+				ToolChoice: true,
+			},
+		}, p.generateAs(api.NewName(p.Provider, name)))
+		actions = append(actions, m.(api.Action))
+	}
+	return actions
+}
+
+// On scripts replies for requests matching m. Replies are used in order and
+// the last one repeats; rules are tried in the order they were added.
+func (p *Plugin) On(m Matcher, replies ...Reply) *Plugin {
+	if len(replies) == 0 {
+		panic("fakemodel: On requires at least one reply")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = append(p.rules, &rule{match: m, replies: replies})
+	return p
+}
+
+// Calls returns every request the fake models received
+func (p *Plugin) Calls() []*ai.ModelRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*ai.ModelRequest(nil), p.calls...)
+}
+
+// CallsTo returns the requests received by the named model, e.g. "googleai/gemini-2.5-pro"
+func (p *Plugin) CallsTo(model string) []*ai.ModelRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var calls []*ai.ModelRequest
+	for i, req := range p.calls {
+		if p.models[i] == model {
+			calls = append(calls, req)
+		}
+	}
+	return calls
+}
+
+// Reset drops all scripted rules and recorded calls
+func (p *Plugin) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = nil
+	p.calls = nil
+	p.models = nil
+}
+
+func (p *Plugin) generateAs(model string) ai.ModelFunc {
+	return func(ctx context.Context, req *ai.ModelRequest, cb ai.ModelStreamCallback) (*ai.ModelResponse, error) {
+		return p.generate(ctx, model, req)
+	}
+}
+
+func (p *Plugin) generate(ctx context.Context, model string, req *ai.ModelRequest) (*ai.ModelResponse, error) {
+	p.mu.Lock()
+	p.calls = append(p.calls, req)
+	p.models = append(p.models, model)
+	var reply Reply
+	for _, r := range p.rules {
+		if r.match(req) {
+			reply = r.replies[min(r.calls, len(r.replies)-1)]
+			r.calls++
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if reply == nil {
+		return nil, fmt.Errorf("fakemodel: no scripted response for request: %.200q", RequestText(req))
+	}
+
+	resp, err := reply(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	if resp.FinishReason == "" {
+		resp.FinishReason = ai.FinishReasonStop
+	}
+	if resp.Usage == nil {
+		resp.Usage = estimateUsage(req, resp)
+	}
+	return resp, nil
+}
+
+// estimateUsage reports roughly four characters per token so accounting code sees non-zero usage
+func estimateUsage(req *ai.ModelRequest, resp *ai.ModelResponse) *ai.GenerationUsage {
+	in := len(RequestText(req)) / 4
+	out := 0
+	if resp.Message != nil {
+		out = len(resp.Message.Text()) / 4
+	}
+	return &ai.GenerationUsage{InputTokens: in, OutputTokens: out, TotalTokens: in + out}
+}
+
+// Text replies with a plain text message
+func Text(text string) Reply {
+	return func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		return &ai.ModelResponse{Message: ai.NewModelTextMessage(text)}, nil
+	}
+}
+
+// Truncated replies with text cut off at the output token limit
+func Truncated(text string) Reply {
+	return func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		return &ai.ModelResponse{Message: ai.NewModelTextMessage(text), FinishReason: ai.FinishReasonLength}, nil
+	}
+}
+
+// JSON replies with v marshalled as the message text, for prompts with an output schema
+func JSON(v any) Reply {
+	return func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("fakemodel: failed to marshal reply: %w", err)
+		}
+		return &ai.ModelResponse{Message: ai.NewModelTextMessage(string(b))}, nil
+	}
+}
+
+// ToolCall replies with a request to call the named tool with input
+func ToolCall(name string, input any) Reply {
+	return func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		return &ai.ModelResponse{
+			Message: ai.NewModelMessage(ai.NewToolRequestPart(&ai.ToolRequest{Name: name, Input: input})),
+		}, nil
+	}
+}
+
+// ToolCallWithJSON replies with a tool request plus v as JSON text. Prompts
+// with an output schema parse every turn, so a bare tool request fails them.
+func ToolCallWithJSON(name string, input any, v any) Reply {
+	return func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("fakemodel: failed to marshal reply: %w", err)
+		}
+		return &ai.ModelResponse{
+			Message: ai.NewModelMessage(
+				ai.NewTextPart(string(b)),
+				ai.NewToolRequestPart(&ai.ToolRequest{Name: name, Input: input}),
+			),
+		}, nil
+	}
+}
+
+// Error fails the model call with err
+func Error(err error) Reply {
+	return func(req *ai.ModelRequest) (*ai.ModelResponse, error) {
+		return nil, err
+	}
+}
+
+// Any matches every request
+func Any() Matcher {
+	return func(req *ai.ModelRequest) bool { return true }
+}
+
+// Contains matches requests whose rendered messages contain every substring
+func Contains(substrs ...string) Matcher {
+	return func(req *ai.ModelRequest) bool {
+		text := RequestText(req)
+		for _, s := range substrs {
+			if !strings.Contains(text, s) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// HasToolResponse matches requests whose history already contains a response from the named tool
+func HasToolResponse(name string) Matcher {
+	return func(req *ai.ModelRequest) bool {
+		for _, msg := range req.Messages {
+			for _, part := range msg.Content {
+				if part.IsToolResponse() && part.ToolResponse.Name == name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// Not inverts m
+func Not(m Matcher) Matcher {
+	return func(req *ai.ModelRequest) bool { return !m(req) }
+}
+
+// All matches requests matched by every matcher
+func All(ms ...Matcher) Matcher {
+	return func(req *ai.ModelRequest) bool {
+		for _, m := range ms {
+			if !m(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Prompt matches requests rendered from the named prompt, identified by the
+// text of its system section. Prompt names are not carried on model
+// requests, so this is the closest stable signal.
+func Prompt(g *genkit.Genkit, name string) Matcher {
+	var once sync.Once
+	var marker string
+	return func(req *ai.ModelRequest) bool {
+		once.Do(func() { marker = systemMarker(g, name) })
+		if marker == "" {
+			return false
+		}
+		return strings.Contains(RequestText(req), marker)
+	}
+}
+
+// systemMarker renders the prompt with placeholder input and returns the
+// longest line of its leading section, which holds the system instructions
+func systemMarker(g *genkit.Genkit, name string) string {
+	p := genkit.LookupPrompt(g, name)
+	if p == nil {
+		return ""
+	}
+	action, ok := p.(api.Action)
+	if !ok {
+		return ""
+	}
+	meta, _ := action.Desc().Metadata["prompt"].(map[string]any)
+	input, _ := meta["input"].(map[string]any)
+	schema, _ := input["schema"].(map[string]any)
+
+	opts, err := p.Render(context.Background(), placeholderInput(schema))
+	if err != nil {
+		return ""
+	}
+
+	if len(opts.Messages) == 0 || len(opts.Messages[0].Content) == 0 {
+		return ""
+	}
+
+	marker := ""
+	for _, line := range strings.Split(opts.Messages[0].Content[0].Text, "\n") {
+		if line = strings.TrimSpace(line); len(line) > len(marker) {
+			marker = line
+		}
+	}
+	return marker
+}
+
+// placeholderInput returns zero values for the required properties of an input schema
+func placeholderInput(schema map[string]any) map[string]any {
+	props, _ := schema["properties"].(map[string]any)
+	required, _ := schema["required"].([]any)
+
+	input := make(map[string]any, len(required))
+	for _, r := range required {
+		key, _ := r.(string)
+		prop, _ := props[key].(map[string]any)
+		switch prop["type"] {
+		case "boolean":
+			input[key] = false
+		case "number", "integer":
+			input[key] = 0
+		case "array":
+			input[key] = []any{}
+		case "object":
+			input[key] = map[string]any{}
+		default:
+			input[key] = ""
+		}
+	}
+	return input
+}
+
+// RequestText concatenates the text of every message in the request
+func RequestText(req *ai.ModelRequest) string {
+	var b strings.Builder
+	for _, msg := range req.Messages {
+		b.WriteString(msg.Text())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,43 @@
+package fakemodel
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+func TestRepliesInOrderAndLastRepeats(t *testing.T) {
+	fake := New("fake", "m")
+	g := genkit.Init(context.Background(), genkit.WithPlugins(fake))
+	fake.On(Contains("ping"), Text("first"), Text("second"))
+
+	var got []string
+	for range 3 {
+		text, err := genkit.GenerateText(context.Background(), g, ai.WithModelName("fake/m"), ai.WithPrompt("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, text)
+	}
+
+	if strings.Join(got, ",") != "first,second,second" {
+		t.Errorf("got %v", got)
+	}
+	if len(fake.Calls()) != 3 {
+		t.Errorf("calls = %d, want 3", len(fake.Calls()))
+	}
+}
+
+func TestUnmatchedRequestFails(t *testing.T) {
+	fake := New("fake", "m")
+	g := genkit.Init(context.Background(), genkit.WithPlugins(fake))
+	fake.On(Contains("ping"), Text("pong"))
+
+	_, err := genkit.GenerateText(context.Background(), g, ai.WithModelName("fake/m"), ai.WithPrompt("hello"))
+	if err == nil || !strings.Contains(err.Error(), "no scripted response") {
+		t.Fatalf("err = %v, want no scripted response", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Package toolcall keeps the errors of failed tool calls. Genkit reports a
+// failed tool as a message of its own, so the flows record the original
+// error here and classify it with errors.Is and errors.As.
+package toolcall
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/firebase/genkit/go/ai"
+)
+
+// Error is a failed tool call
+type Error struct {
+	Tool string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tool %q failed: %v", e.Tool, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type recorderKey struct{}
+
+// recorder holds the first tool failure of a generation
+type recorder struct {
+	mu  sync.Mutex
+	err *Error
+}
+
+// Record returns a context whose wrapped tool calls keep their failures. The
+// returned function replaces a generation error with the tool failure that
+// caused it, if any.
+func Record(ctx context.Context) (context.Context, func(error) error) {
+	r := &recorder{}
+	return context.WithValue(ctx, recorderKey{}, r), func(err error) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err == nil || r.err == nil {
+			return err
+		}
+		return r.err
+	}
+}
+
+// Wrap returns t with its failures kept in the calling context, see Record
+func Wrap(t ai.Tool) ai.Tool {
+	def := t.Definition()
+	return ai.NewToolWithInputSchema(def.Name, def.Description, def.InputSchema, func(tc *ai.ToolContext, input any) (any, error) {
+		out, err := t.RunRaw(tc, input)
+		if err == nil {
+			return out, err
+		}
+		failure := &Error{Tool: def.Name, Err: err}
+		if r, ok := tc.Value(recorderKey{}).(*recorder); ok {
+			r.mu.Lock()
+			if r.err == nil {
+				r.err = failure
+			}
+			r.mu.Unlock()
+		}
+		return out, failure
+	})
+}
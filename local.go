@@ -0,0 +1,76 @@
+package main
+
+import (
+	"research/config"
+	"research/search"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core/api"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/firebase/genkit/go/plugins/compat_oai"
+	"github.com/firebase/genkit/go/plugins/ollama"
+	"github.com/openai/openai-go/option"
+)
+
+// localProvider is the model name prefix for OpenAI-compatible local servers
+const localProvider = "local"
+
+// localModelSupports assumes a chat model with tool calling, which the ask-me phases need
+var localModelSupports = ai.ModelSupports{
+	Multiturn:  true,
+	SystemRole: true,
+	Tools:      true,
+}
+
+// localModelPlugin returns the plugin for the configured local model server, or nil
+func localModelPlugin(cfg *config.LocalModelConfig) api.Plugin {
+	if cfg == nil {
+		return nil
+	}
+
+	switch cfg.Provider {
+	case config.LocalProviderOllama:
+		return &ollama.Ollama{ServerAddress: cfg.BaseURL}
+	default:
+		// Local servers usually ignore the key, but the client requires one
+		apiKey := cfg.APIKey
+		if apiKey == "" {
+			apiKey = "unused"
+		}
+		return &compat_oai.OpenAICompatible{
+			Provider: localProvider,
+			Opts: []option.RequestOption{
+				option.WithBaseURL(cfg.BaseURL),
+				option.WithAPIKey(apiKey),
+			},
+		}
+	}
+}
+
+// defineLocalModels registers the configured models once the plugin is initialised
+func defineLocalModels(g *genkit.Genkit, cfg *config.LocalModelConfig, plugin api.Plugin) {
+	for _, name := range cfg.Models {
+		switch p := plugin.(type) {
+		case *ollama.Ollama:
+			p.DefineModel(g, ollama.ModelDefinition{Name: name, Type: "chat"}, &ai.ModelOptions{
+				Label:    name,
+				Supports: &localModelSupports,
+			})
+		case *compat_oai.OpenAICompatible:
+			genkit.RegisterAction(g, p.DefineModel(localProvider, name, ai.ModelOptions{
+				Label:    name,
+				Supports: &localModelSupports,
+			}))
+		}
+	}
+}
+
+// searchProvider returns the configured web search backend, or nil
+func searchProvider(cfg config.SearchConfig) search.Provider {
+	switch cfg.Provider {
+	case "searxng":
+		return search.NewSearXNG(cfg.BaseURL)
+	default:
+		return nil
+	}
+}
@@ -2,55 +2,175 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"research/config"
 	"research/flow"
-	mcpconfig "research/mcp"
+	"research/health"
+	"research/httpapi"
+	"research/internal/toolcall"
+	"research/mcphost"
+	"research/telemetry"
+	"slices"
+	"syscall"
 
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/core/api"
 	"github.com/firebase/genkit/go/genkit"
 	"github.com/firebase/genkit/go/plugins/googlegenai"
-	"github.com/firebase/genkit/go/plugins/mcp"
-	"github.com/firebase/genkit/go/plugins/server"
 )
 
 func main() {
 	ctx := context.Background()
 
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		log.Fatal("Failed to load config:", err)
+	}
+	if info, err := os.Stat(cfg.PromptDir); err != nil || !info.IsDir() {
+		log.Fatalf("Prompt directory %q not found; set promptDir or RESEARCH_PROMPT_DIR", cfg.PromptDir)
+	}
+
+	// Before genkit.Init, so that Genkit's spans are exported too
+	shutdownTelemetry, err := telemetry.Setup(ctx, cfg.Telemetry)
+	if err != nil {
+		log.Fatal("Failed to set up telemetry:", err)
+	}
+	defer shutdownTelemetry(ctx)
+
+	plugins := []api.Plugin{&googlegenai.GoogleAI{}}
+	localPlugin := localModelPlugin(cfg.LocalModel)
+	if localPlugin != nil {
+		plugins = append(plugins, localPlugin)
+	}
+
 	g := genkit.Init(
 		ctx,
-		genkit.WithPlugins(&googlegenai.GoogleAI{}),
-		genkit.WithDefaultModel("googleai/gemini-2.5-flash-lite"),
+		genkit.WithPlugins(plugins...),
+		genkit.WithDefaultModel(cfg.DefaultModelName()),
+		genkit.WithPromptDir(cfg.PromptDir),
 	)
 
-	host, err := mcp.NewMCPHost(g, mcp.MCPHostOptions{})
+	if localPlugin != nil {
+		defineLocalModels(g, cfg.LocalModel, localPlugin)
+	}
 
-	if err != nil {
-		log.Fatal("Failed to create MCP host:", err)
+	// Servers that cannot be reached are reported by /readyz instead of stopping the server
+	host := mcphost.Connect(ctx, g, cfg.MCPClients())
+	defer host.Close()
+	if missing, _ := flow.MissingPrompts(g); len(missing) > 0 {
+		log.Printf("Prompts not found in %s: %v", cfg.PromptDir, missing)
 	}
 
-	for _, server := range mcpconfig.Servers {
-		host.Connect(ctx, g, server.Name, server)
+	mcpTools := host.Register(func(t ai.Tool) ai.Tool { return toolcall.Wrap(telemetry.TraceTool(t)) })
+	go host.Supervise(ctx, cfg.MCPSupervision)
+	if err := checkTools(g, host, cfg.Tools); err != nil {
+		log.Fatal(err)
 	}
 
-	mcpTools, err := host.GetActiveTools(ctx, g)
-	if err != nil {
-		log.Fatal("Failed to get active tools:", err)
+	// One limiter for every flow, so concurrent runs share the model quota
+	limiter := flow.NewRateLimiter(cfg.RateLimits, cfg.DefaultModelName())
+	recipeGeneratorFlow := flow.RecipeGeneratorFlow(g, limiter)
+	simpleFlow := flow.SimpleFlow(g, cfg.Tools.FlowTools(flow.ToolFlowSimple, mcpTools), limiter)
+	deepResearchConfig := flow.DeepResearchConfig{
+		Models:              cfg.Models,
+		DefaultModel:        cfg.DefaultModelName(),
+		ReportTypeDir:       cfg.ReportTypeDir,
+		Search:              searchProvider(cfg.Search),
+		Retry:               cfg.Retry,
+		Effort:              cfg.ResearchEffort,
+		ClarifyingQuestions: cfg.ClarifyingQuestions,
+		Synthesis:           cfg.Synthesis,
+		Prices:              cfg.Prices,
+		Budget:              cfg.Budget,
+		Cache:               flow.NewResponseCache(cfg.Cache),
+		RateLimiter:         limiter,
+		Tools:               cfg.Tools,
+		Runs:                flow.NewFileRunStore(cfg.RunDir),
 	}
+	deepResearchFlow := flow.DeepResearchFlow(g, mcpTools, deepResearchConfig)
+	resumeDeepResearchFlow := flow.ResumeDeepResearchFlow(g, mcpTools, deepResearchConfig)
+	regenerateChapterFlow := flow.RegenerateChapterFlow(g, deepResearchConfig)
 
-	for _, tool := range mcpTools {
-		genkit.RegisterAction(g, tool)
+	auth := httpapi.NewAuthenticator(cfg.Auth)
+	if auth == nil {
+		log.Println("No API keys configured; flows can be invoked without authentication")
 	}
 
-	recipeGeneratorFlow := flow.RecipeGeneratorFlow(g)
-	simpleFlow := flow.SimpleFlow(g, mcpTools)
-	deepResearchFlow := flow.DeepResearchFlow(g, mcpTools)
+	flows := []api.Action{deepResearchFlow, resumeDeepResearchFlow, regenerateChapterFlow}
+	if cfg.Features.ExampleFlows {
+		flows = append(flows, recipeGeneratorFlow, simpleFlow)
+	}
 
 	// Start a server to serve the flow and keep the app running for the Developer UI
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /recipeGeneratorFlow", genkit.Handler(recipeGeneratorFlow))
-	mux.HandleFunc("POST /simpleFlow", genkit.Handler(simpleFlow))
-	mux.HandleFunc("POST /deepResearchFlow", genkit.Handler(deepResearchFlow))
+	for _, f := range flows {
+		mux.Handle("POST /"+f.Name(), auth.Require(f.Name(), httpapi.Handler(f)))
+	}
+	if cfg.Features.Metrics {
+		mux.Handle("GET /metrics", telemetry.Handler())
+	}
+	models := append(flow.PhaseModels(g, cfg.Models), cfg.DefaultModelName())
+	checker := health.NewChecker(g, host, slices.Compact(slices.Sorted(slices.Values(models))), limiter, cfg.Health)
+	mux.HandleFunc("GET /healthz", checker.Live)
+	mux.HandleFunc("GET /readyz", checker.Ready)
 
-	log.Println("Starting server on http://localhost:3400")
-	log.Fatal(server.Start(ctx, "127.0.0.1:3400", mux))
+	log.Printf("Starting server on http://%s", cfg.Server.Addr)
+	if err := serve(ctx, cfg.Server, mux); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkTools fails when the prompts or the tool policy refer to tools that do
+// not exist. Tools of servers that are down are only logged, since the
+// supervisor registers them once their server is back.
+func checkTools(g *genkit.Genkit, host *mcphost.Host, policy flow.ToolPolicy) error {
+	var undefined []string
+	for _, name := range flow.UndefinedTools(g, policy) {
+		if host.MayProvide(name) {
+			log.Printf("Tool %s is unavailable until its MCP server is up", name)
+			continue
+		}
+		undefined = append(undefined, name)
+	}
+	if len(undefined) > 0 {
+		return fmt.Errorf("prompts or the tools config refer to undefined tools: %v", undefined)
+	}
+	return nil
+}
+
+// serve runs the HTTP server until it fails or the process is interrupted,
+// then gives running requests cfg.ShutdownTimeout to finish
+func serve(ctx context.Context, cfg config.ServerConfig, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	return nil
 }
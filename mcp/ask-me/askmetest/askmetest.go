@@ -0,0 +1,97 @@
+// Package askmetest registers the ask-me tools against an in-memory chat
+// provider so flows that talk to the user can be tested in-process.
+package askmetest
+
+import (
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+
+	"research/internal/toolcall"
+	mcpconfig "research/mcp"
+	"research/mcp/ask-me/internal/app"
+	"research/mcp/ask-me/internal/provider/memory"
+)
+
+// ErrReplyTimeout is the error a Chat call wraps when no reply arrives
+var ErrReplyTimeout = app.ErrReplyTimeout
+
+// Tool names as the MCP host exposes them to flows and prompts
+var (
+	ChatTool          = mcpconfig.ServerAskMe + "_chat"
+	ThreadHistoryTool = mcpconfig.ServerAskMe + "_get_thread_history"
+)
+
+type chatProvider interface {
+	app.ChatProvider
+	QueueReply(messages ...string)
+	QueueTimeout()
+	QueueError(err error)
+	Sent() []app.ChatRequest
+	Pending() int
+}
+
+// Harness is a scripted user reachable through the ask-me tools
+type Harness struct {
+	provider chatProvider
+	tools    []ai.Tool
+}
+
+// New defines the ask-me tools on g, named and wrapped as main.go registers
+// the MCP tools
+func New(g *genkit.Genkit) *Harness {
+	provider := memory.NewChatProvider()
+	return &Harness{
+		provider: provider,
+		tools:    app.DefineTools(g, provider, mcpconfig.ServerAskMe+"_", toolcall.Wrap),
+	}
+}
+
+// Tools returns the ask-me tools, in place of the MCP tools main.go passes to flows
+func (h *Harness) Tools() []ai.Tool {
+	return h.tools
+}
+
+// Reply queues user replies, consumed one per chat call
+func (h *Harness) Reply(messages ...string) *Harness {
+	h.provider.QueueReply(messages...)
+	return h
+}
+
+// Timeout makes the next chat call fail as if the user never replied
+func (h *Harness) Timeout() *Harness {
+	h.provider.QueueTimeout()
+	return h
+}
+
+// Fail makes the next chat call fail with err
+func (h *Harness) Fail(err error) *Harness {
+	h.provider.QueueError(err)
+	return h
+}
+
+// Sent returns the messages sent to the user in order
+func (h *Harness) Sent() []string {
+	sent := h.provider.Sent()
+	messages := make([]string, len(sent))
+	for i, req := range sent {
+		messages[i] = req.Message
+	}
+	return messages
+}
+
+// SentContaining reports whether any message sent to the user contains substr
+func (h *Harness) SentContaining(substr string) bool {
+	for _, msg := range h.Sent() {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending reports how many queued replies were never consumed
+func (h *Harness) Pending() int {
+	return h.provider.Pending()
+}
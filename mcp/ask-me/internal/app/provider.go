@@ -2,8 +2,13 @@ package app
 
 import (
 	"context"
+
+	mcpconfig "research/mcp"
 )
 
+// ErrReplyTimeout is returned by Chat when the user does not reply in time
+var ErrReplyTimeout = mcpconfig.ErrReplyTimeout
+
 type ChatProvider interface {
 	Chat(ctx context.Context, req ChatRequest) (ChatResponse, error)
 	GetThreadHistory(ctx context.Context, threadID string) (GetThreadHistoryResponse, error)
@@ -0,0 +1,29 @@
+package app
+
+import (
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// DefineTools registers the ask-me tools backed by provider. The MCP server
+// registers them unprefixed; in-process hosts pass the "<server>_" prefix the
+// MCP host would otherwise add, and may wrap each tool before it is registered.
+func DefineTools(g *genkit.Genkit, provider ChatProvider, prefix string, wrap func(ai.Tool) ai.Tool) []ai.Tool {
+	tools := []ai.Tool{
+		ai.NewTool(prefix+"chat", "Ask the user a question when you need clarification, additional information, or confirmation. IMPORTANT: If this is a follow-up to a previous conversation, ALWAYS include the thread_id from the previous response to continue in the same thread. Only leave thread_id null for completely new topics. This maintains conversation context and keeps related discussions together.",
+			func(ctx *ai.ToolContext, req ChatRequest) (ChatResponse, error) {
+				return provider.Chat(ctx.Context, req)
+			}),
+		ai.NewTool(prefix+"get_thread_history", "Get the conversation history of a specific thread. Use this to review previous messages in a conversation thread to understand context or see what has been discussed before.",
+			func(ctx *ai.ToolContext, threadID string) (GetThreadHistoryResponse, error) {
+				return provider.GetThreadHistory(ctx.Context, threadID)
+			}),
+	}
+	for i, t := range tools {
+		if wrap != nil {
+			tools[i] = wrap(t)
+		}
+		genkit.RegisterAction(g, tools[i])
+	}
+	return tools
+}
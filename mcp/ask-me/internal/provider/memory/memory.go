@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"research/mcp/ask-me/internal/app"
+)
+
+var _ app.ChatProvider = (*memory)(nil)
+
+// reply is a scripted user answer, or the error Chat fails with instead
+type reply struct {
+	text string
+	err  error
+}
+
+// memory is a scripted in-process ChatProvider for tests
+type memory struct {
+	mu       sync.Mutex
+	replies  []reply
+	sent     []app.ChatRequest
+	threads  map[string][]string
+	threadNo int
+}
+
+func NewChatProvider() *memory {
+	return &memory{
+		threads: make(map[string][]string),
+	}
+}
+
+// QueueReply queues user replies, answered one per Chat call in order
+func (m *memory) QueueReply(messages ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, msg := range messages {
+		m.replies = append(m.replies, reply{text: msg})
+	}
+}
+
+// QueueTimeout makes the next Chat call fail as if the user never replied
+func (m *memory) QueueTimeout() {
+	m.QueueError(app.ErrReplyTimeout)
+}
+
+// QueueError makes the next Chat call fail with err
+func (m *memory) QueueError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replies = append(m.replies, reply{err: err})
+}
+
+// Sent returns every outbound request in the order it was sent
+func (m *memory) Sent() []app.ChatRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]app.ChatRequest(nil), m.sent...)
+}
+
+// Pending reports how many queued replies have not been consumed
+func (m *memory) Pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.replies)
+}
+
+func (m *memory) Chat(ctx context.Context, req app.ChatRequest) (app.ChatResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, req)
+
+	threadID := ""
+	if req.ThreadID != nil {
+		threadID = *req.ThreadID
+	}
+	if _, ok := m.threads[threadID]; !ok || threadID == "" {
+		m.threadNo++
+		threadID = fmt.Sprintf("thread-%d", m.threadNo)
+	}
+	m.threads[threadID] = append(m.threads[threadID], req.Message)
+
+	// An empty queue behaves like a user who never answers
+	if len(m.replies) == 0 {
+		return app.ChatResponse{}, fmt.Errorf("failed to wait for reply: %w", app.ErrReplyTimeout)
+	}
+	next := m.replies[0]
+	m.replies = m.replies[1:]
+	if next.err != nil {
+		return app.ChatResponse{}, fmt.Errorf("failed to wait for reply: %w", next.err)
+	}
+
+	m.threads[threadID] = append(m.threads[threadID], next.text)
+	return app.ChatResponse{
+		Message:  next.text,
+		ThreadID: threadID,
+	}, nil
+}
+
+func (m *memory) GetThreadHistory(ctx context.Context, threadID string) (app.GetThreadHistoryResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, ok := m.threads[threadID]
+	if !ok {
+		return app.GetThreadHistoryResponse{}, fmt.Errorf("failed to get thread history: unknown thread %q", threadID)
+	}
+
+	return app.GetThreadHistoryResponse{
+		ThreadID: threadID,
+		Messages: append([]string(nil), messages...),
+	}, nil
+}
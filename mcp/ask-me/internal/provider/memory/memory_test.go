@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"research/mcp/ask-me/internal/app"
+)
+
+func TestChatKeepsThreadAndHistory(t *testing.T) {
+	ctx := context.Background()
+	m := NewChatProvider()
+	m.QueueReply("yes", "blue")
+
+	first, err := m.Chat(ctx, app.ChatRequest{Message: "ready?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Chat(ctx, app.ChatRequest{Message: "colour?", ThreadID: &first.ThreadID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ThreadID != first.ThreadID || second.Message != "blue" {
+		t.Errorf("second reply = %+v", second)
+	}
+
+	history, err := m.GetThreadHistory(ctx, first.ThreadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Messages) != 4 {
+		t.Errorf("history = %q, want 4 messages", history.Messages)
+	}
+	if len(m.Sent()) != 2 {
+		t.Errorf("sent = %d, want 2", len(m.Sent()))
+	}
+}
+
+func TestChatTimesOut(t *testing.T) {
+	m := NewChatProvider()
+	m.QueueTimeout()
+
+	if _, err := m.Chat(context.Background(), app.ChatRequest{Message: "hello?"}); !errors.Is(err, app.ErrReplyTimeout) {
+		t.Errorf("err = %v, want ErrReplyTimeout", err)
+	}
+	// An exhausted queue also behaves like a user who never replies
+	if _, err := m.Chat(context.Background(), app.ChatRequest{Message: "anyone?"}); !errors.Is(err, app.ErrReplyTimeout) {
+		t.Errorf("err = %v, want ErrReplyTimeout", err)
+	}
+}
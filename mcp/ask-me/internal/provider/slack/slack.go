@@ -23,13 +23,21 @@ type slack struct {
 	timeout    time.Duration
 }
 
-func NewChatProvider(oAuthToken, channel string) *slack {
+// defaultReplyTimeout is how long Chat waits for a reply unless told otherwise
+const defaultReplyTimeout = 24 * time.Hour
+
+// NewChatProvider returns a provider posting to channel. A zero replyTimeout
+// waits defaultReplyTimeout for each reply.
+func NewChatProvider(oAuthToken, channel string, replyTimeout time.Duration) *slack {
+	if replyTimeout <= 0 {
+		replyTimeout = defaultReplyTimeout
+	}
 	return &slack{
 		oAuthToken: oAuthToken,
 		channel:    channel,
 		client:     &http.Client{Timeout: 30 * time.Second},
 		replies:    make(map[string][]string),
-		timeout:    24 * time.Hour,
+		timeout:    replyTimeout,
 	}
 }
 
@@ -127,7 +135,7 @@ func (s *slack) waitForReply(ctx context.Context, threadID string, timeout time.
 	for {
 		select {
 		case <-ctx.Done():
-			return "", fmt.Errorf("timeout waiting for reply")
+			return "", app.ErrReplyTimeout
 		case <-ticker.C:
 			messages, err := s.getThreadMessages(ctx, threadID)
 			if err != nil {
@@ -1,6 +1,8 @@
 package mcp
 
 import (
+	"errors"
+
 	"github.com/firebase/genkit/go/plugins/mcp"
 )
 
@@ -9,6 +11,10 @@ const (
 	ServerAskMe = "ask-me"
 )
 
+// ErrReplyTimeout is the error of an ask-me chat call the user did not answer
+// in time. It reaches the MCP host as text, which restores it.
+var ErrReplyTimeout = errors.New("timeout waiting for reply")
+
 var Servers = []mcp.MCPClientOptions{
 	{
 		Name: ServerAskMe,
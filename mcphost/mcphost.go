@@ -0,0 +1,421 @@
+// Package mcphost connects to the configured MCP servers and keeps track of
+// the state of each connection.
+package mcphost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/firebase/genkit/go/plugins/mcp"
+
+	mcpconfig "research/mcp"
+)
+
+// ErrServerUnavailable is returned by calls to the tools of a server that is
+// down or being restarted
+var ErrServerUnavailable = errors.New("MCP server unavailable")
+
+// State is the state of a server connection
+type State string
+
+const (
+	StateConnected State = "connected"
+	StateFailed    State = "failed"
+	StateDisabled  State = "disabled"
+)
+
+// probeTimeout caps how long a server may take to list its tools
+const probeTimeout = 10 * time.Second
+
+// connectTimeout caps the start and handshake of a server. It is generous
+// since "go run" compiles the server first.
+const connectTimeout = 2 * time.Minute
+
+// ServerStatus describes the connection to one MCP server
+type ServerStatus struct {
+	Name  string `json:"name"`
+	State State  `json:"state"`
+	// Error is why the server is not connected
+	Error string   `json:"error,omitempty"`
+	Tools []string `json:"tools,omitempty"`
+	// Since is when the server entered its state
+	Since time.Time `json:"since"`
+	// Restarts counts the reconnections after the server was lost
+	Restarts int `json:"restarts,omitempty"`
+}
+
+// Host holds the connections to the MCP servers. Unlike Genkit's MCPHost it
+// remembers why a server could not be reached, and the tools it registers
+// survive reconnections.
+type Host struct {
+	g *genkit.Genkit
+	// registering is set by Register; wrap is applied to tools before they are registered
+	registering bool
+	wrap        func(ai.Tool) ai.Tool
+	// lost wakes the supervisor when a server may have died
+	lost chan struct{}
+
+	mu      sync.Mutex
+	servers []*server
+}
+
+type server struct {
+	opts   mcp.MCPClientOptions
+	client *mcp.GenkitMCPClient
+	// tools are the tools of the current connection by name; names lists
+	// every tool the server has had, in order
+	tools map[string]ai.Tool
+	names []string
+	// registered are the stable tools registered for the names
+	registered map[string]ai.Tool
+	// conn ends with the connection, failing the calls in flight
+	conn   context.Context
+	cancel context.CancelFunc
+
+	state State
+	err   error
+	since time.Time
+	// connected is set once the server has had a connection; only
+	// reconnections after that count as restarts
+	connected bool
+	restarts  int
+	// retryAt and backoff schedule the next reconnection attempt
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// Connect connects to each server and lists its tools. A server that cannot
+// be reached is logged and reported by Status; the others are still used.
+func Connect(ctx context.Context, g *genkit.Genkit, servers []mcp.MCPClientOptions) *Host {
+	h := &Host{g: g, lost: make(chan struct{}, 1)}
+	for _, opts := range servers {
+		s := &server{opts: opts, tools: map[string]ai.Tool{}, registered: map[string]ai.Tool{}}
+		h.servers = append(h.servers, s)
+		if opts.Disabled {
+			s.set(StateDisabled, nil)
+			continue
+		}
+		client, tools, err := connect(ctx, g, opts)
+		if err != nil {
+			log.Printf("mcp: %v", err)
+			s.set(StateFailed, err)
+			continue
+		}
+		s.install(client, tools)
+		h.watch(s, client)
+	}
+	return h
+}
+
+// connect starts a client and lists its tools
+func connect(ctx context.Context, g *genkit.Genkit, opts mcp.MCPClientOptions) (*mcp.GenkitMCPClient, []ai.Tool, error) {
+	client, err := newClient(ctx, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to %s: %w", opts.Name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	tools, err := client.GetActiveTools(ctx, g)
+	if err != nil {
+		// Stop a server process that started but does not answer
+		client.Disconnect()
+		return nil, nil, fmt.Errorf("failed to list the tools of %s: %w", opts.Name, err)
+	}
+	return client, tools, nil
+}
+
+// newClient connects to a server within connectTimeout. Genkit's handshake
+// ignores contexts, so a server that never answers is abandoned and closed
+// should it answer later.
+func newClient(ctx context.Context, opts mcp.MCPClientOptions) (*mcp.GenkitMCPClient, error) {
+	type result struct {
+		client *mcp.GenkitMCPClient
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, err := mcp.NewGenkitMCPClient(opts)
+		done <- result{client, err}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	select {
+	case r := <-done:
+		return r.client, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.client != nil {
+				r.client.Disconnect()
+			}
+		}()
+		return nil, fmt.Errorf("no answer within %s: %w", connectTimeout, ctx.Err())
+	}
+}
+
+// install makes client the server's connection. h.mu must be held once the
+// host is shared.
+func (s *server) install(client *mcp.GenkitMCPClient, tools []ai.Tool) {
+	s.client = client
+	s.conn, s.cancel = context.WithCancel(context.Background())
+	s.tools = map[string]ai.Tool{}
+	for _, t := range tools {
+		s.tools[t.Name()] = t
+		if !slices.Contains(s.names, t.Name()) {
+			s.names = append(s.names, t.Name())
+		}
+	}
+	s.backoff = 0
+	if s.connected {
+		s.restarts++
+	}
+	s.connected = true
+	s.set(StateConnected, nil)
+}
+
+// drop closes a connection found dead and fails the calls in flight. h.mu must be held.
+func (s *server) drop(err error) {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.client != nil {
+		s.client.Disconnect()
+		s.client = nil
+	}
+	s.tools = map[string]ai.Tool{}
+	s.set(StateFailed, err)
+}
+
+func (s *server) set(state State, err error) {
+	if s.state != state {
+		s.since = time.Now()
+	}
+	s.state, s.err = state, err
+}
+
+// Register registers the tools of the servers with Genkit, passing each
+// through wrap first, and returns them. The registered tools stay valid
+// across reconnections; while their server is down, calls fail with
+// ErrServerUnavailable. Tools of servers that come up later are registered
+// as they appear.
+func (h *Host) Register(wrap func(ai.Tool) ai.Tool) []ai.Tool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.registering, h.wrap = true, wrap
+	var tools []ai.Tool
+	for _, s := range h.servers {
+		tools = append(tools, h.register(s)...)
+	}
+	return tools
+}
+
+// register registers the server's tools that are not registered yet and
+// returns all of them. h.mu must be held.
+func (h *Host) register(s *server) []ai.Tool {
+	var tools []ai.Tool
+	for _, name := range s.names {
+		t, ok := s.registered[name]
+		if !ok {
+			t = h.stableTool(s, s.tools[name])
+			if h.wrap != nil {
+				t = h.wrap(t)
+			}
+			genkit.RegisterAction(h.g, t)
+			s.registered[name] = t
+		}
+		tools = append(tools, t)
+	}
+	return tools
+}
+
+// stableTool calls the tool of the server's current connection
+func (h *Host) stableTool(s *server, t ai.Tool) ai.Tool {
+	def := t.Definition()
+	return ai.NewToolWithInputSchema(def.Name, def.Description, def.InputSchema, func(tc *ai.ToolContext, input any) (any, error) {
+		h.mu.Lock()
+		current, conn, state := s.tools[def.Name], s.conn, s.state
+		h.mu.Unlock()
+		if state != StateConnected || current == nil {
+			return nil, fmt.Errorf("%w: %s is %s, cannot call %s", ErrServerUnavailable, s.opts.Name, state, def.Name)
+		}
+
+		ctx, cancel := context.WithCancel(tc)
+		defer cancel()
+		stop := context.AfterFunc(conn, cancel)
+		defer stop()
+		out, err := current.RunRaw(ctx, input)
+		if err != nil && conn.Err() != nil {
+			return nil, fmt.Errorf("%w: %s stopped during the call to %s", ErrServerUnavailable, s.opts.Name, def.Name)
+		}
+		if err != nil {
+			// The call may have failed because the server died
+			h.wake()
+			if remote := remoteError(err.Error()); remote != nil {
+				return nil, remote
+			}
+			return nil, err
+		}
+		// Tool errors come back as results for the model to read, except
+		// those callers need to match
+		if msg, ok := resultError(out); ok {
+			if remote := remoteError(msg); remote != nil {
+				return nil, remote
+			}
+		}
+		return out, nil
+	})
+}
+
+// remoteErrors are the errors servers report as text that callers match
+var remoteErrors = []error{mcpconfig.ErrReplyTimeout}
+
+// remoteError returns the error a server reported as msg wrapped in the
+// remote error it names, or nil
+func remoteError(msg string) error {
+	for _, remote := range remoteErrors {
+		if strings.Contains(msg, remote.Error()) {
+			return fmt.Errorf("%w: %s", remote, msg)
+		}
+	}
+	return nil
+}
+
+// resultError returns the text of a tool result the server flagged as an error
+func resultError(out any) (string, bool) {
+	result, ok := out.(map[string]any)
+	if !ok || result["isError"] != true {
+		return "", false
+	}
+	var text []string
+	content, _ := result["content"].([]any)
+	for _, c := range content {
+		if part, ok := c.(map[string]any); ok {
+			if t, ok := part["text"].(string); ok {
+				text = append(text, t)
+			}
+		}
+	}
+	return strings.Join(text, "\n"), true
+}
+
+// Tools returns the registered tools, or before Register the tools of the
+// connected servers
+func (h *Host) Tools() []ai.Tool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var tools []ai.Tool
+	for _, s := range h.servers {
+		for _, name := range s.names {
+			if t, ok := s.registered[name]; ok {
+				tools = append(tools, t)
+			} else if t, ok := s.tools[name]; ok {
+				tools = append(tools, t)
+			}
+		}
+	}
+	return tools
+}
+
+// MayProvide reports whether a server that is enabled but not connected may
+// provide the tool, judging by the "<server>_" prefix of the tool names
+func (h *Host) MayProvide(tool string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.servers {
+		if s.state == StateFailed && strings.HasPrefix(tool, s.opts.Name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the state of each server as of the last connection or Check
+func (h *Host) Status() []ServerStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := make([]ServerStatus, 0, len(h.servers))
+	for _, s := range h.servers {
+		st := ServerStatus{Name: s.opts.Name, State: s.state, Since: s.since, Restarts: s.restarts}
+		if s.err != nil {
+			st.Error = s.err.Error()
+		}
+		for _, name := range s.names {
+			if _, ok := s.tools[name]; ok {
+				st.Tools = append(st.Tools, name)
+			}
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// Check asks each connected server for its tools and marks the servers that
+// no longer answer as failed
+func (h *Host) Check(ctx context.Context) []ServerStatus {
+	type probe struct {
+		s      *server
+		client *mcp.GenkitMCPClient
+	}
+	h.mu.Lock()
+	var connected []probe
+	for _, s := range h.servers {
+		if s.state == StateConnected {
+			connected = append(connected, probe{s, s.client})
+		}
+	}
+	h.mu.Unlock()
+
+	for _, p := range connected {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		_, err := p.client.GetActiveTools(probeCtx, h.g)
+		cancel()
+		if err == nil {
+			continue
+		}
+		h.mu.Lock()
+		// The supervisor may have replaced the connection in the meantime
+		if p.s.client == p.client {
+			log.Printf("mcp: %s stopped answering: %v", p.s.opts.Name, err)
+			p.s.drop(fmt.Errorf("stopped answering: %w", err))
+			h.wake()
+		}
+		h.mu.Unlock()
+	}
+	return h.Status()
+}
+
+// wake tells the supervisor to look at the servers now
+func (h *Host) wake() {
+	select {
+	case h.lost <- struct{}{}:
+	default:
+	}
+}
+
+// Close disconnects from every server
+func (h *Host) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var errs []error
+	for _, s := range h.servers {
+		if s.cancel != nil {
+			s.cancel()
+		}
+		if s.client != nil {
+			if err := s.client.Disconnect(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.opts.Name, err))
+			}
+			s.client = nil
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,175 @@
+package mcphost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+	"github.com/firebase/genkit/go/plugins/mcp"
+	"github.com/mark3labs/mcp-go/client/transport"
+
+	mcpconfig "research/mcp"
+)
+
+// TestMain doubles as a stdio MCP server when started by a test
+func TestMain(m *testing.M) {
+	if os.Getenv("MCPHOST_TEST_SERVER") == "1" {
+		serveTestServer()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+type crashInput struct {
+	// Exit ends the server process instead of answering
+	Exit bool `json:"exit,omitempty"`
+	// Timeout fails the call the way an unanswered ask-me chat does
+	Timeout bool `json:"timeout,omitempty"`
+}
+
+func serveTestServer() {
+	g := genkit.Init(context.Background())
+	genkit.DefineTool(g, "crash", "Answers, or ends the server", func(ctx *ai.ToolContext, in crashInput) (string, error) {
+		if in.Exit {
+			os.Exit(1)
+		}
+		if in.Timeout {
+			return "", fmt.Errorf("failed to wait for reply: %w", mcpconfig.ErrReplyTimeout)
+		}
+		return "alive", nil
+	})
+	server := mcp.NewMCPServer(g, mcp.MCPServerOptions{Name: "test", Version: "1.0.0"})
+	if err := server.ServeStdio(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func testServer(t *testing.T) mcp.MCPClientOptions {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mcp.MCPClientOptions{Name: "test", Stdio: &mcp.StdioConfig{Command: exe, Env: []string{"MCPHOST_TEST_SERVER=1"}}}
+}
+
+// Without the connection of Genkit's client, dead servers wait for the next
+// check; this fails when a Genkit upgrade moves it
+func TestServerRefFindsGenkitConnection(t *testing.T) {
+	client, err := mcp.NewGenkitMCPClient(testServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+
+	ref := serverRef(client)
+	if ref == nil || ref.Client == nil {
+		t.Fatal("serverRef found no connection in Genkit's client")
+	}
+	if stdio, ok := ref.Transport.(*transport.Stdio); !ok || stdio.Stderr() == nil {
+		t.Errorf("transport = %T, want a stdio transport whose exit can be watched", ref.Transport)
+	}
+}
+
+func TestSuperviseRestartsDeadServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := genkit.Init(ctx)
+	host := Connect(ctx, g, []mcp.MCPClientOptions{testServer(t)})
+	t.Cleanup(func() { host.Close() })
+	tools := host.Register(nil)
+	if len(tools) != 1 || tools[0].Name() != "test_crash" {
+		t.Fatalf("tools = %v, want test_crash", tools)
+	}
+	// No periodic check comes before the end of the test, so the restart
+	// follows from the process exiting
+	go host.Supervise(ctx, SupervisionConfig{CheckInterval: time.Hour, InitialBackoff: 10 * time.Millisecond})
+
+	crash := tools[0]
+	if out, err := crash.RunRaw(ctx, map[string]any{"exit": false}); err != nil || out == nil {
+		t.Fatalf("call = %v, %v; want an answer", out, err)
+	}
+
+	// The call in flight when the server dies fails instead of hanging
+	if _, err := crash.RunRaw(ctx, map[string]any{"exit": true}); !errors.Is(err, ErrServerUnavailable) {
+		t.Fatalf("call to a dying server: err = %v, want ErrServerUnavailable", err)
+	}
+
+	// Until the server is back, calls fail with ErrServerUnavailable; afterwards
+	// the same registered tool reaches the new process
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		_, err := crash.RunRaw(ctx, map[string]any{"exit": false})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrServerUnavailable) {
+			t.Fatalf("call while restarting: err = %v, want ErrServerUnavailable", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not come back: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := host.Status()[0]
+	if status.State != StateConnected || status.Restarts != 1 || len(status.Tools) != 1 {
+		t.Errorf("status = %+v, want connected after one restart", status)
+	}
+}
+
+func TestSuperviseFirstStartIsNoRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The server's command does not exist until the first start has failed
+	opts := testServer(t)
+	exe := opts.Stdio.Command
+	opts.Stdio.Command = filepath.Join(t.TempDir(), "server")
+	g := genkit.Init(ctx)
+	host := Connect(ctx, g, []mcp.MCPClientOptions{opts})
+	t.Cleanup(func() { host.Close() })
+	if status := host.Status()[0]; status.State != StateFailed {
+		t.Fatalf("status = %+v, want the first start failed", status)
+	}
+	host.Register(nil)
+	if err := os.Symlink(exe, opts.Stdio.Command); err != nil {
+		t.Fatal(err)
+	}
+	go host.Supervise(ctx, SupervisionConfig{CheckInterval: time.Hour, InitialBackoff: 10 * time.Millisecond})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for host.Status()[0].State != StateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not come up: %+v", host.Status()[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := host.Status()[0]; status.Restarts != 0 {
+		t.Errorf("restarts = %d, want 0 for a server that was never connected before", status.Restarts)
+	}
+}
+
+func TestToolErrorsAreRestored(t *testing.T) {
+	ctx := context.Background()
+	g := genkit.Init(ctx)
+	host := Connect(ctx, g, []mcp.MCPClientOptions{testServer(t)})
+	t.Cleanup(func() { host.Close() })
+	tools := host.Register(nil)
+	if len(tools) != 1 {
+		t.Fatalf("tools = %v, want test_crash", tools)
+	}
+
+	_, err := tools[0].RunRaw(ctx, map[string]any{"timeout": true})
+	if !errors.Is(err, mcpconfig.ErrReplyTimeout) {
+		t.Errorf("err = %v, want ErrReplyTimeout", err)
+	}
+}
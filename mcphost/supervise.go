@@ -0,0 +1,130 @@
+package mcphost
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Supervision defaults
+const (
+	DefaultCheckInterval  = 15 * time.Second
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = time.Minute
+)
+
+// SupervisionConfig governs how dead servers are detected and restarted
+type SupervisionConfig struct {
+	// CheckInterval is how often each server is asked for its tools; a failed
+	// tool call triggers a check at once, and a server whose process exits or
+	// whose stream breaks is dropped without waiting for one
+	CheckInterval time.Duration `yaml:"checkInterval"`
+	// InitialBackoff is the wait after a failed restart attempt; it doubles
+	// with every further failure up to MaxBackoff. The first attempt is immediate.
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+// Validate rejects negative durations and a maximum below the initial backoff
+func (c SupervisionConfig) Validate() error {
+	if c.CheckInterval < 0 || c.InitialBackoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("mcpSupervision durations must not be negative")
+	}
+	if c.MaxBackoff > 0 && c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("mcpSupervision.maxBackoff %s is below initialBackoff %s", c.MaxBackoff, c.InitialBackoff)
+	}
+	return nil
+}
+
+func (c SupervisionConfig) withDefaults() SupervisionConfig {
+	if c.CheckInterval == 0 {
+		c.CheckInterval = DefaultCheckInterval
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = DefaultInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = max(DefaultMaxBackoff, c.InitialBackoff)
+	}
+	return c
+}
+
+// Supervise checks the servers until ctx is done. Servers that stopped
+// answering, or never came up, are restarted with exponential backoff; their
+// tools are registered again on the new connection.
+func (h *Host) Supervise(ctx context.Context, cfg SupervisionConfig) {
+	cfg = cfg.withDefaults()
+	nextCheck := time.Now().Add(cfg.CheckInterval)
+	for {
+		wait := time.Until(nextCheck)
+		if retry, ok := h.nextRetry(); ok {
+			wait = min(wait, time.Until(retry))
+		}
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-h.lost:
+			timer.Stop()
+			h.Check(ctx)
+		case <-timer.C:
+			if !time.Now().Before(nextCheck) {
+				h.Check(ctx)
+				nextCheck = time.Now().Add(cfg.CheckInterval)
+			}
+		}
+		h.restart(ctx, cfg)
+	}
+}
+
+// nextRetry returns the earliest restart of a failed server
+func (h *Host) nextRetry() (next time.Time, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.servers {
+		if s.state == StateFailed && (!ok || s.retryAt.Before(next)) {
+			next, ok = s.retryAt, true
+		}
+	}
+	return next, ok
+}
+
+// restart reconnects the failed servers whose backoff has passed
+func (h *Host) restart(ctx context.Context, cfg SupervisionConfig) {
+	h.mu.Lock()
+	var due []*server
+	for _, s := range h.servers {
+		if s.state == StateFailed && !time.Now().Before(s.retryAt) {
+			due = append(due, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range due {
+		client, tools, err := connect(ctx, h.g, s.opts)
+
+		h.mu.Lock()
+		if err != nil {
+			s.backoff = min(max(s.backoff*2, cfg.InitialBackoff), cfg.MaxBackoff)
+			s.retryAt = time.Now().Add(s.backoff)
+			s.err = err
+			log.Printf("mcp: restarting %s failed, next attempt in %s: %v", s.opts.Name, s.backoff, err)
+		} else {
+			back := s.connected
+			s.install(client, tools)
+			h.watch(s, client)
+			if h.registering {
+				// Register the tools the server did not have before
+				h.register(s)
+			}
+			if back {
+				log.Printf("mcp: %s is back with %d tools", s.opts.Name, len(tools))
+			} else {
+				log.Printf("mcp: %s is up with %d tools", s.opts.Name, len(tools))
+			}
+		}
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,88 @@
+package mcphost
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/firebase/genkit/go/plugins/mcp"
+	"github.com/mark3labs/mcp-go/client/transport"
+)
+
+// maxExitMessage caps the stderr line quoted when a server process exits
+const maxExitMessage = 200
+
+// watch drops the server as soon as client's connection ends, a stdio
+// server's process exiting or a remote stream breaking, and wakes the
+// supervisor instead of leaving the loss to the next check. Servers whose
+// connection cannot be watched are still found by Check.
+func (h *Host) watch(s *server, client *mcp.GenkitMCPClient) {
+	ref := serverRef(client)
+	if ref == nil {
+		return
+	}
+	lost := func(err error) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		// Connections the host closed or replaced itself are not lost
+		if s.client != client {
+			return
+		}
+		log.Printf("mcp: %s %v", s.opts.Name, err)
+		s.drop(err)
+		h.wake()
+	}
+
+	if stdio, ok := ref.Transport.(*transport.Stdio); ok {
+		if stderr := stdio.Stderr(); stderr != nil {
+			go func() { lost(waitExit(stderr)) }()
+		}
+		return
+	}
+	// Only transports with a long-lived stream report its loss
+	ref.Client.OnConnectionLost(func(err error) {
+		lost(fmt.Errorf("lost its connection: %w", err))
+	})
+}
+
+// waitExit reads a server process's stderr until the process exits, which
+// closes it, and returns an error quoting the last line written, as that
+// usually says why. Reading also keeps a chatty server from blocking on a
+// full pipe.
+func waitExit(stderr io.Reader) error {
+	r := bufio.NewReader(stderr)
+	var last string
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			last = line
+		}
+		if err != nil {
+			break
+		}
+	}
+	if last == "" {
+		return errors.New("process exited")
+	}
+	if len(last) > maxExitMessage {
+		last = strings.ToValidUTF8(last[:maxExitMessage], "") + "…"
+	}
+	return fmt.Errorf("process exited: %s", last)
+}
+
+// serverRef returns the connection Genkit's client keeps unexported, as the
+// client offers no other way to learn that its server is gone. It returns
+// nil should the field change in a Genkit upgrade, leaving dead servers to
+// Check; TestServerRefFindsGenkitConnection catches that.
+func serverRef(c *mcp.GenkitMCPClient) *mcp.ServerRef {
+	f := reflect.ValueOf(c).Elem().FieldByName("server")
+	if !f.IsValid() || f.Type() != reflect.TypeFor[*mcp.ServerRef]() {
+		return nil
+	}
+	return *(**mcp.ServerRef)(unsafe.Pointer(f.UnsafeAddr()))
+}
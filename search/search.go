@@ -0,0 +1,32 @@
+// Package search provides web search for models without built-in grounding.
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Result is a single web search hit
+type Result struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
+}
+
+// Provider searches the web on behalf of a model that cannot
+type Provider interface {
+	Search(ctx context.Context, query string, limit int) ([]Result, error)
+	// CacheKey identifies where results come from, such as the endpoint,
+	// so that cached results of one backend are not served for another
+	CacheKey() string
+}
+
+// Format renders results as a numbered list for prompt input
+func Format(results []Result) string {
+	var b strings.Builder
+	for i, r := range results {
+		b.WriteString(fmt.Sprintf("[%d] %s\n%s\n%s\n\n", i+1, r.Title, r.URL, r.Snippet))
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var _ Provider = (*searxng)(nil)
+
+// searxng queries a self-hosted SearXNG instance, keeping queries off third-party APIs
+type searxng struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewSearXNG(baseURL string) *searxng {
+	return &searxng{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *searxng) CacheKey() string {
+	return "searxng " + s.baseURL
+}
+
+func (s *searxng) Search(ctx context.Context, query string, limit int) ([]Result, error) {
+	endpoint := fmt.Sprintf("%s/search?format=json&q=%s", s.baseURL, url.QueryEscape(query))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("searxng returned %s", resp.Status)
+	}
+
+	var searxResp struct {
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&searxResp); err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, r := range searxResp.Results {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, Result{Title: r.Title, URL: r.URL, Snippet: r.Content})
+	}
+
+	return results, nil
+}
@@ -0,0 +1,74 @@
+package search
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSearXNGSearch(t *testing.T) {
+	var gotQuery, gotFormat string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery, gotFormat = r.URL.Query().Get("q"), r.URL.Query().Get("format")
+		w.Write([]byte(`{"results": [
+			{"title": "Go", "url": "https://go.dev", "content": "The Go language"},
+			{"title": "Tour", "url": "https://go.dev/tour", "content": "A tour of Go"},
+			{"title": "Blog", "url": "https://go.dev/blog", "content": "The Go blog"}
+		]}`))
+	}))
+	defer srv.Close()
+
+	results, err := NewSearXNG(srv.URL+"/").Search(context.Background(), "go & generics", 2)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if gotQuery != "go & generics" || gotFormat != "json" {
+		t.Errorf("query = %q, format = %q", gotQuery, gotFormat)
+	}
+	want := []Result{
+		{Title: "Go", URL: "https://go.dev", Snippet: "The Go language"},
+		{Title: "Tour", URL: "https://go.dev/tour", Snippet: "A tour of Go"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want the limit of %d", len(results), len(want))
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+}
+
+func TestSearXNGSearchErrors(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+		},
+		"malformed": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`<html>not json</html>`))
+		},
+	} {
+		srv := httptest.NewServer(handler)
+		if _, err := NewSearXNG(srv.URL).Search(context.Background(), "go", 5); err == nil {
+			t.Errorf("%s: Search succeeded, want an error", name)
+		}
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	if _, err := NewSearXNG(srv.URL).Search(context.Background(), "go", 5); err == nil {
+		t.Error("Search of a stopped server succeeded, want an error")
+	}
+}
+
+func TestSearXNGCacheKey(t *testing.T) {
+	a, b := NewSearXNG("http://searx.internal/").CacheKey(), NewSearXNG("http://searx.internal").CacheKey()
+	if a != b {
+		t.Errorf("cache keys %q and %q differ for the same instance", a, b)
+	}
+	if other := NewSearXNG("http://searx.example").CacheKey(); other == a {
+		t.Errorf("cache key %q is shared by different instances", other)
+	}
+}
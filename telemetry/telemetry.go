@@ -0,0 +1,75 @@
+// Package telemetry exports traces over OTLP and serves metrics to Prometheus.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// DefaultServiceName names the service in traces when the config sets none
+const DefaultServiceName = "research"
+
+type Config struct {
+	// OTLPEndpoint is the OTLP/HTTP collector URL, e.g. http://localhost:4318.
+	// Traces are not exported when it is empty. OTEL_EXPORTER_OTLP_ENDPOINT overrides it.
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+	ServiceName  string `yaml:"serviceName"`
+}
+
+// Setup installs the global tracer and meter providers. Genkit's own spans
+// go through the same tracer provider, so it must run before genkit.Init.
+// The returned function flushes and stops both providers.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		cfg.OTLPEndpoint = endpoint
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = DefaultServiceName
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create telemetry resource: %w", err)
+	}
+
+	traceOpts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if cfg.OTLPEndpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		traceOpts = append(traceOpts, sdktrace.WithBatcher(exporter))
+	}
+	tracerProvider := sdktrace.NewTracerProvider(traceOpts...)
+
+	// The exporter registers with the default Prometheus registry served by Handler
+	reader, err := prometheus.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Prometheus exporter: %w", err)
+	}
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithResource(res), sdkmetric.WithReader(reader))
+
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+
+	return func(ctx context.Context) error {
+		return errors.Join(tracerProvider.Shutdown(ctx), meterProvider.Shutdown(ctx))
+	}, nil
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,35 @@
+package telemetry
+
+import (
+	"strings"
+
+	"github.com/firebase/genkit/go/ai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("research/telemetry")
+
+// TraceTool wraps an MCP tool so that every call gets a span with the tool
+// and server name. MCP tool names are namespaced as "<server>_<tool>".
+func TraceTool(t ai.Tool) ai.Tool {
+	def := t.Definition()
+	server, _, _ := strings.Cut(def.Name, "_")
+	attrs := []attribute.KeyValue{
+		attribute.String("mcp.tool", def.Name),
+		attribute.String("mcp.server", server),
+	}
+	return ai.NewToolWithInputSchema(def.Name, def.Description, def.InputSchema, func(tc *ai.ToolContext, input any) (any, error) {
+		ctx, span := tracer.Start(tc, "mcp_tool "+def.Name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+		defer span.End()
+
+		out, err := t.RunRaw(ctx, input)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return out, err
+	})
+}